@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/handlers"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// commands maps each subcommand to the function that runs it with the rest of the command line
+var commands = map[string]func(args []string) error{
+	"mine":          runMine,
+	"validate":      runValidate,
+	"decode":        runDecode,
+	"template":      runTemplate,
+	"verify-block":  runVerifyBlock,
+	"stats":         runStats,
+	"bench-schnorr": runBenchSchnorr,
+	"watch":         runWatch,
+	"serve":         runServe,
+	"rpc-mine":      runRPCMine,
+	"stratum":       runStratum,
+	"stratum-mine":  runStratumMine,
+	"prove":         runProve,
+	"verify-proof":  runVerifyProof,
+	"filter":        runFilter,
+	"compact":       runCompact,
+	"p2p-peer":      runP2PPeer,
+	"mempool":       runMempool,
+}
+
+// options holds the flags every subcommand shares
+type options struct {
+	mempool    string
+	output     string
+	network    string
+	payout     string
+	weight     int
+	workers    int
+	strategy   string
+	quarantine string
+	prevouts   string
+	profile    string
+	rules      string
+	exclude    string
+	batch      bool
+	maxMempool int
+	maxOrphans int
+	fullRBF    bool
+	limits     handlers.PackageLimits // sizes in kvB until apply
+}
+
+// newFlagSet creates the flag set for a subcommand with the common flags registered on it
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.mempool, "mempool", "mempool", "mempool directory, or a .tar, .tar.gz, .zip or .jsonl archive of it")
+	flags.StringVar(&opts.output, "output", "output.txt", "file the mined block's header, coinbase and txids are written to")
+	flags.StringVar(&opts.network, "network", "mainnet", "network addresses are for: mainnet, testnet, regtest or signet")
+	flags.StringVar(&opts.payout, "payout", "", "descriptor or address the coinbase pays to, e.g wpkh(02...) or addr(bc1...)")
+	flags.IntVar(&opts.weight, "weight", handlers.MaxBlockWeight, "weight budget for the block's transactions")
+	flags.IntVar(&opts.workers, "workers", handlers.ValidationWorkers, "number of goroutines validating transactions")
+	flags.StringVar(&opts.strategy, "strategy", handlers.StrategyFeeRate, "transaction selection order: feerate, fee or none")
+	flags.StringVar(&opts.quarantine, "quarantine", "", "directory mempool files that fail the integrity check are moved to")
+	flags.StringVar(&opts.prevouts, "prevouts", "", "comma separated json files of extra prevouts for raw hex transactions")
+	flags.StringVar(&opts.profile, "profile", "", "validation profile: consensus or default (the default for everything but verify-block)")
+	flags.StringVar(&opts.rules, "rules", "", "comma separated registered rules to validate with, instead of a profile")
+	flags.StringVar(&opts.exclude, "exclude-addresses", "", "comma separated addresses whose transactions are rejected")
+	flags.IntVar(&opts.maxMempool, "max-mempool", 0, "megabytes of transactions to keep, evicting the lowest scoring ones with their descendants (0 for no limit)")
+	flags.IntVar(&opts.maxOrphans, "max-orphans", handlers.MaxOrphanTxs, "most transactions to hold back while the mempool is read because their parents haven't been yet")
+	flags.IntVar(&opts.limits.AncestorCount, "limit-ancestor-count", handlers.DefaultPackageLimits.AncestorCount, "most unconfirmed ancestors a transaction may have, itself included")
+	flags.IntVar(&opts.limits.AncestorSize, "limit-ancestor-size", handlers.DefaultPackageLimits.AncestorSize/1000, "most kvB a transaction and its unconfirmed ancestors may take")
+	flags.IntVar(&opts.limits.DescendantCount, "limit-descendant-count", handlers.DefaultPackageLimits.DescendantCount, "most descendants a mempool transaction may have, itself included")
+	flags.IntVar(&opts.limits.DescendantSize, "limit-descendant-size", handlers.DefaultPackageLimits.DescendantSize/1000, "most kvB a mempool transaction and its descendants may take")
+	flags.BoolVar(&opts.fullRBF, "full-rbf", false, "let conflicting transactions replace ones that don't signal BIP125 replaceability")
+	flags.BoolVar(&opts.batch, "batch-schnorr", false, "verify taproot signatures in batches rather than one by one")
+	return flags
+}
+
+// apply pushes the shared options into the handlers package
+func (opts *options) apply() error {
+	if err := handlers.SetNetwork(opts.network); err != nil {
+		return err
+	}
+	if opts.payout != "" {
+		if err := handlers.SetPayoutDescriptor(opts.payout); err != nil {
+			return fmt.Errorf("payout descriptor: %v", err)
+		}
+	}
+	handlers.OutputFile = opts.output
+	handlers.BatchSchnorr = opts.batch
+	handlers.MaxMempoolBytes = int64(opts.maxMempool) * 1000 * 1000
+	handlers.MaxOrphanTxs = opts.maxOrphans
+	handlers.RBFPolicy.FullRBF = opts.fullRBF
+	handlers.MempoolLimits = opts.limits
+	handlers.MempoolLimits.AncestorSize *= 1000
+	handlers.MempoolLimits.DescendantSize *= 1000
+	return nil
+}
+
+// validationProfile resolves the -profile, -rules and -exclude-addresses flags into the profile to validate with,
+// falling back to fallback when neither -profile nor -rules is given
+func (opts *options) validationProfile(fallback *handlers.Profile) (*handlers.Profile, error) {
+	profile := fallback
+	var err error
+	switch {
+	case opts.rules != "":
+		profile, err = handlers.NewProfileFromNames("custom", strings.Split(opts.rules, ",")...)
+	case opts.profile != "":
+		profile, err = handlers.GetProfile(opts.profile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.exclude != "" {
+		profile = profile.With(profile.Name, handlers.NewExcludeAddressesRule(strings.Split(opts.exclude, ",")...))
+	}
+	return profile, nil
+}
+
+func (opts *options) prevoutFiles() []string {
+	if opts.prevouts == "" {
+		return nil
+	}
+	return strings.Split(opts.prevouts, ",")
+}
+
+func (opts *options) loadMempool() []types.TransactionData {
+	return handlers.LoadMempool(opts.mempool, opts.quarantine, opts.prevoutFiles()...)
+}
+
+// loadUTXOSet builds the UTXO set prevouts are resolved against: the mempool plus any prevout files
+func (opts *options) loadUTXOSet(transactions []types.TransactionData) handlers.UTXOSet {
+	return opts.addPrevoutFiles(handlers.NewUTXOSetFromMempool(transactions))
+}
+
+// loadConfirmedUTXOSet builds the UTXO set blocks are checked against: the confirmed outputs the mempool spends plus
+// any prevout files
+func (opts *options) loadConfirmedUTXOSet(transactions []types.TransactionData) handlers.UTXOSet {
+	return opts.addPrevoutFiles(handlers.NewConfirmedUTXOSet(transactions))
+}
+
+func (opts *options) addPrevoutFiles(utxos handlers.UTXOSet) handlers.UTXOSet {
+	for _, prevoutFile := range opts.prevoutFiles() {
+		if err := utxos.LoadPrevoutFile(prevoutFile); err != nil {
+			fmt.Println("Error reading prevout file: ", err)
+		}
+	}
+	return utxos
+}
+
+// newBuilder loads the mempool into a block builder set up with the chosen strategy and weight budget
+func (opts *options) newBuilder() (*handlers.BlockBuilder, error) {
+	builder, err := opts.newEmptyBuilder()
+	if err != nil {
+		return nil, err
+	}
+	mempool := handlers.LoadBoundedMempool(opts.mempool, opts.quarantine, opts.prevoutFiles()...)
+	builder.AddCandidates(mempool.Transactions())
+	builder.AddReplaced(mempool.Replaced())
+	return builder, nil
+}
+
+// newEmptyBuilder is newBuilder without the mempool
+func (opts *options) newEmptyBuilder() (*handlers.BlockBuilder, error) {
+	profile, err := opts.validationProfile(handlers.DefaultProfile)
+	if err != nil {
+		return nil, err
+	}
+	builder := handlers.NewBlockBuilder()
+	builder.SetProfile(profile)
+	builder.SetWorkers(opts.workers)
+	if err := builder.SetStrategy(opts.strategy); err != nil {
+		return nil, err
+	}
+	if err := builder.SetWeightBudget(opts.weight); err != nil {
+		return nil, err
+	}
+	return builder, nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// runMine is the original flow: pick transactions, mine the block and write output.txt
+func runMine(args []string) error {
+	var opts options
+	flags := newFlagSet("mine", &opts)
+	// -block-out writes the full mined block (raw hex, binary, getblock style json and a summary) next to output.txt
+	blockOut := flags.String("block-out", "", "base path to write the full serialized block to, e.g. block")
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	builder, err := opts.newBuilder()
+	if err != nil {
+		return err
+	}
+	built, err := builder.Finalize()
+	if err != nil {
+		return err
+	}
+	handlers.WriteBlockOutput(built.Block)
+	if *blockOut != "" {
+		if err := handlers.WriteBlockFiles(built.Block, built.TxData, *blockOut); err != nil {
+			return fmt.Errorf("writing block files: %v", err)
+		}
+	}
+	return nil
+}
+
+// runWatch keeps mining the best template for a mempool directory as files come and go, writing output.txt for every
+// block found, until interrupted
+func runWatch(args []string) error {
+	var opts options
+	flags := newFlagSet("watch", &opts)
+	interval := flags.Duration("interval", 2*time.Second, "how often the mempool directory is checked for changes")
+	minFeeGain := flags.Int("min-fee-gain", 10000, "sats a new template has to earn over the one being mined to restart mining")
+	connect := flags.String("connect", "", "comma separated p2p peers to announce blocks to and take transactions from")
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	profile, err := opts.validationProfile(handlers.DefaultProfile)
+	if err != nil {
+		return err
+	}
+	watcher := handlers.NewMempoolWatcher(opts.mempool, profile, opts.workers)
+	watcher.Prevouts = opts.loadUTXOSet(nil)
+	node := handlers.NewP2PNode()
+	node.StartHeight = handlers.BlockHeight - 1
+	// transactions from peers are validated with the mempool directory's on the next poll
+	node.OnTx = func(peer *handlers.Peer, tx *wire.MsgTx) {
+		watcher.Submit(tx)
+	}
+	node.OnBlock = func(peer *handlers.Peer, block *wire.MsgBlock) {
+		fmt.Println("peer", peer, "sent block", block.BlockHash())
+	}
+	if *connect != "" {
+		for _, addr := range strings.Split(*connect, ",") {
+			peer, err := node.Connect(addr)
+			if err != nil {
+				return err
+			}
+			rtt, err := peer.Ping()
+			if err != nil {
+				return err
+			}
+			fmt.Println("connected to", peer, "ping", rtt)
+		}
+	}
+	daemon := &handlers.MiningDaemon{
+		Watcher:    watcher,
+		Interval:   *interval,
+		MinFeeGain: *minFeeGain,
+		NewBuilder: opts.newEmptyBuilder,
+		OnBlock: func(built *handlers.BuiltBlock) {
+			handlers.WriteBlockOutput(built.Block)
+			fmt.Println("block", built.Summary.Hash, "with", len(built.Block.Transactions), "txs written to", opts.output)
+			node.AnnounceBlock(built.Block)
+		},
+	}
+	stop := make(chan struct{})
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		close(stop)
+	}()
+	return daemon.Run(stop)
+}
+
+// runP2PPeer stands in for a node on the p2p network, for watch -connect to talk to. it checks every block it's sent
+// against the mempool the way verify-block does, and with -relay announces the mempool's valid transactions to every
+// peer that connects
+func runP2PPeer(args []string) error {
+	var opts options
+	flags := newFlagSet("p2p-peer", &opts)
+	listen := flags.String("listen", "", "address to accept peers on (default 127.0.0.1 on the network's port)")
+	relay := flags.Bool("relay", false, "announce the mempool's valid transactions to peers")
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	if *listen == "" {
+		*listen = "127.0.0.1:" + handlers.NetParams.DefaultPort
+	}
+	profile, err := opts.validationProfile(handlers.DefaultProfile)
+	if err != nil {
+		return err
+	}
+	transactions := opts.loadMempool()
+	var relayTxs []*wire.MsgTx
+	if *relay {
+		for _, entry := range handlers.ValidateTxs(transactions, profile, opts.workers) {
+			if !entry.Valid() {
+				continue
+			}
+			tx, err := handlers.TransactionDataToMsgTx(entry.Tx)
+			if err != nil {
+				return err
+			}
+			relayTxs = append(relayTxs, tx)
+		}
+	}
+	node := handlers.NewP2PNode()
+	node.StartHeight = handlers.BlockHeight - 1
+	node.OnPeer = func(peer *handlers.Peer) {
+		fmt.Println("peer", peer, "connected")
+		if len(relayTxs) > 0 {
+			node.AnnounceTxs(relayTxs)
+			fmt.Println("announced", len(relayTxs), "txs")
+		}
+	}
+	received := 0
+	node.OnTx = func(peer *handlers.Peer, tx *wire.MsgTx) {
+		received++
+		fmt.Println("peer", peer, "sent tx", tx.TxHash(), "(", received, "so far )")
+	}
+	node.OnBlock = func(peer *handlers.Peer, block *wire.MsgBlock) {
+		errs := handlers.CheckBlockWithProfile(block, opts.loadConfirmedUTXOSet(transactions), handlers.ConsensusProfile)
+		if len(errs) > 0 {
+			fmt.Println("peer", peer, "sent block", block.BlockHash(), "which fails", len(errs), "checks, the first:", errs[0])
+			return
+		}
+		fmt.Println("peer", peer, "sent block", block.BlockHash(), "with", len(block.Transactions), "txs, valid")
+	}
+	fmt.Println("accepting peers on", *listen, "for", handlers.NetParams.Name)
+	return node.ListenAndServe(*listen)
+}
+
+// runServe serves getblocktemplate and submitblock over json-rpc, built from the mempool, until interrupted. blocks
+// submitted that pass the checks are written to output.txt
+func runServe(args []string) error {
+	var opts options
+	flags := newFlagSet("serve", &opts)
+	addr := flags.String("rpc-addr", "127.0.0.1:8332", "address to listen for json-rpc on")
+	user := flags.String("rpc-user", "", "user name clients have to authenticate with")
+	password := flags.String("rpc-password", "", "password clients have to authenticate with")
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	builder, err := opts.newBuilder()
+	if err != nil {
+		return err
+	}
+	server := handlers.NewRPCServer(builder)
+	server.User, server.Password = *user, *password
+	server.OnBlock = func(block *wire.MsgBlock) {
+		handlers.WriteBlockOutput(block)
+		fmt.Println("accepted block", block.BlockHash(), "with", len(block.Transactions), "txs, written to", opts.output)
+	}
+	fmt.Println("serving getblocktemplate on", *addr)
+	return http.ListenAndServe(*addr, server)
+}
+
+// runRPCMine is a minimal miner for testing a getblocktemplate server: it fetches a template, builds the block,
+// mines it and submits it
+func runRPCMine(args []string) error {
+	var opts options
+	flags := newFlagSet("rpc-mine", &opts)
+	url := flags.String("rpc-url", "http://127.0.0.1:8332", "url of the json-rpc server")
+	user := flags.String("rpc-user", "", "user name to authenticate with")
+	password := flags.String("rpc-password", "", "password to authenticate with")
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	client := &handlers.RPCClient{URL: *url, User: *user, Password: *password}
+	template, err := client.GetBlockTemplate()
+	if err != nil {
+		return err
+	}
+	fmt.Println("template at height", template.Height, "with", len(template.Transactions), "txs paying", template.CoinbaseValue)
+	block, err := handlers.BlockFromTemplate(template)
+	if err != nil {
+		return err
+	}
+	handlers.SolveBlock(block)
+	reason, err := client.SubmitBlock(block)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return fmt.Errorf("block %s rejected: %s", block.BlockHash(), reason)
+	}
+	fmt.Println("block", block.BlockHash(), "accepted")
+	return nil
+}
+
+// runStratum hands the block template out to miners over stratum v1 until interrupted. blocks found by shares are
+// written to output.txt
+func runStratum(args []string) error {
+	var opts options
+	flags := newFlagSet("stratum", &opts)
+	addr := flags.String("stratum-addr", "127.0.0.1:3333", "address to listen for miners on")
+	difficulty := flags.Float64("share-difficulty", 0, "share difficulty miners start at (default 1/64 of the network's)")
+	shareTime := flags.Duration("share-time", 5*time.Second, "how often vardiff aims for each miner to find a share")
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	builder, err := opts.newBuilder()
+	if err != nil {
+		return err
+	}
+	server, err := handlers.NewStratumServer(builder)
+	if err != nil {
+		return err
+	}
+	server.StartDifficulty = *difficulty
+	server.ShareTime = *shareTime
+	server.OnBlock = func(block *wire.MsgBlock) {
+		handlers.WriteBlockOutput(block)
+		fmt.Println("block", block.BlockHash(), "found by a share, written to", opts.output)
+	}
+	fmt.Println("serving stratum on", *addr, "at network difficulty", server.NetworkDifficulty())
+	return server.ListenAndServe(*addr)
+}
+
+// runStratumMine runs the CPU stratum client against a pool until interrupted or -blocks blocks are found
+func runStratumMine(args []string) error {
+	flags := flag.NewFlagSet("stratum-mine", flag.ExitOnError)
+	addr := flags.String("stratum-addr", "127.0.0.1:3333", "pool to connect to")
+	user := flags.String("user", "worker", "worker name")
+	password := flags.String("password", "x", "worker password")
+	blocks := flags.Int("blocks", 1, "stop after this many blocks, 0 to keep going")
+	flags.Parse(args)
+	client := &handlers.StratumClient{Addr: *addr, User: *user, Password: *password, MaxBlocks: *blocks}
+	stop := make(chan struct{})
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		close(stop)
+	}()
+	start := time.Now()
+	err := client.Run(stop)
+	fmt.Println("shares accepted:", client.Accepted.Load(), "rejected:", client.Rejected.Load(), "blocks:", client.Blocks.Load(),
+		"in", time.Since(start).Round(time.Millisecond))
+	return err
+}
+
+// runValidate validates a single transaction file (json or raw hex) or every transaction in a directory, printing
+// one line per transaction
+func runValidate(args []string) error {
+	var opts options
+	flags := newFlagSet("validate", &opts)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: validate [flags] <file|dir|archive>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("validate takes exactly one file, directory or archive")
+	}
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	path := flags.Arg(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var transactions []types.TransactionData
+	switch {
+	case info.IsDir(), handlers.IsMempoolArchive(path):
+		transactions = handlers.LoadMempool(path, opts.quarantine, opts.prevoutFiles()...)
+	case handlers.IsRawTxFile(path):
+		// raw txs don't carry their prevouts, so they are looked up in the mempool
+		utxos := opts.loadUTXOSet(opts.loadMempool())
+		if transactions, err = handlers.LoadRawTxFile(path, utxos); err != nil {
+			return err
+		}
+	default:
+		transaction, err := handlers.LoadTxFile(path)
+		if err != nil {
+			return err
+		}
+		transactions = append(transactions, transaction)
+	}
+	profile, err := opts.validationProfile(handlers.DefaultProfile)
+	if err != nil {
+		return err
+	}
+	valid := 0
+	for _, entry := range handlers.ValidateTxs(transactions, profile, opts.workers) {
+		switch {
+		case entry.Err == nil:
+			fmt.Println(entry.Tx.TxID, "valid")
+			valid++
+		case errors.Is(entry.Err, handlers.ErrUnsupportedInputType):
+			fmt.Println(entry.Tx.TxID, "unsupported", entry.Err)
+		default:
+			fmt.Println(entry.Tx.TxID, "invalid", entry.Err)
+		}
+	}
+	fmt.Println("valid: ", valid, "of", len(transactions))
+	return nil
+}
+
+// runDecode decodes a raw hex transaction (given directly or as a file) and prints it decoderawtransaction style,
+// or in the esplora format with -esplora
+func runDecode(args []string) error {
+	var opts options
+	flags := newFlagSet("decode", &opts)
+	esplora := flags.Bool("esplora", false, "print the esplora json format, resolving prevouts from the mempool")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: decode [flags] <hex|file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("decode takes exactly one raw transaction")
+	}
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	rawTxHex := flags.Arg(0)
+	if fileBytes, err := os.ReadFile(rawTxHex); err == nil {
+		rawTxHex = string(fileBytes)
+	}
+	transaction, tx, err := handlers.DecodeRawTx(rawTxHex)
+	if err != nil {
+		return err
+	}
+	if !*esplora {
+		return printJSON(handlers.MsgTxToGetBlockTx(tx))
+	}
+	utxos := opts.loadUTXOSet(opts.loadMempool())
+	if err := utxos.ResolvePrevouts(&transaction); err != nil {
+		return err
+	}
+	esploraTx, err := handlers.ToEsploraTx(transaction)
+	if err != nil {
+		return err
+	}
+	return printJSON(esploraTx)
+}
+
+// runTemplate prints the block template for the current mempool without mining it
+func runTemplate(args []string) error {
+	var opts options
+	flags := newFlagSet("template", &opts)
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	builder, err := opts.newBuilder()
+	if err != nil {
+		return err
+	}
+	template, err := builder.Template()
+	if err != nil {
+		return err
+	}
+	return printJSON(template)
+}
+
+// runVerifyBlock runs the block checks against a mined block. the block can be an output.txt (its transactions are
+// taken from the mempool) or a full block as written by mine -block-out, either binary or hex
+func runVerifyBlock(args []string) error {
+	var opts options
+	flags := newFlagSet("verify-block", &opts)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: verify-block [flags] [output.txt|block.dat|block.hex]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	path := opts.output
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	transactions := opts.loadMempool()
+	block, err := loadBlock(path, transactions)
+	if err != nil {
+		return err
+	}
+	profile, err := opts.validationProfile(handlers.ConsensusProfile)
+	if err != nil {
+		return err
+	}
+	errs := handlers.CheckBlockWithProfile(block, opts.loadConfirmedUTXOSet(transactions), profile)
+	for _, blockErr := range errs {
+		fmt.Println("Block check failed: ", blockErr)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("block %s failed %d checks", block.BlockHash(), len(errs))
+	}
+	fmt.Println("block", block.BlockHash(), "with", len(block.Transactions), "txs is valid")
+	return nil
+}
+
+// loadBlock loads the block at path the way verify-block does: an output.txt with its transactions taken from the
+// mempool, or a full block
+func loadBlock(path string, transactions []types.TransactionData) (*wire.MsgBlock, error) {
+	if strings.HasSuffix(path, ".txt") {
+		return handlers.LoadOutputFile(path, transactions)
+	}
+	return handlers.LoadBlockFile(path)
+}
+
+// runProve prints the merkle branch and the merkleblock proof of each txid given, in the mined block
+func runProve(args []string) error {
+	var opts options
+	flags := newFlagSet("prove", &opts)
+	blockPath := flags.String("block", "", "block to prove against, an output.txt or a full block (default -output)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: prove [flags] <txid>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("prove takes at least one txid")
+	}
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	path := opts.output
+	if *blockPath != "" {
+		path = *blockPath
+	}
+	var transactions []types.TransactionData
+	if strings.HasSuffix(path, ".txt") {
+		transactions = opts.loadMempool()
+	}
+	block, err := loadBlock(path, transactions)
+	if err != nil {
+		return err
+	}
+	leaves := handlers.BlockTxIds(block)
+	indexes := make(map[chainhash.Hash]int, len(leaves))
+	for i, leaf := range leaves {
+		indexes[leaf] = i
+	}
+	blockHash := block.BlockHash()
+	var proofs []types.TxProof
+	for _, arg := range flags.Args() {
+		txId, err := chainhash.NewHashFromStr(arg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		index, ok := indexes[*txId]
+		if !ok {
+			return fmt.Errorf("transaction %s is not in block %s", txId, blockHash)
+		}
+		merkleBlock, err := handlers.NewMerkleBlock(block, []chainhash.Hash{*txId})
+		if err != nil {
+			return err
+		}
+		proof, err := handlers.SerializeMerkleBlock(merkleBlock)
+		if err != nil {
+			return err
+		}
+		// check our own proof the way a verifier would before handing it out
+		if _, err := handlers.VerifyMerkleBlock(merkleBlock); err != nil {
+			return fmt.Errorf("proof for %s doesn't verify: %v", txId, err)
+		}
+		txProof := types.TxProof{
+			TxID:       txId.String(),
+			BlockHash:  blockHash.String(),
+			Index:      index,
+			MerkleRoot: block.Header.MerkleRoot.String(),
+			Proof:      hex.EncodeToString(proof),
+		}
+		for _, node := range handlers.MerkleBranch(leaves, index) {
+			txProof.MerkleProof = append(txProof.MerkleProof, node.String())
+		}
+		proofs = append(proofs, txProof)
+	}
+	return printJSON(proofs)
+}
+
+// runVerifyProof checks a merkleblock proof (from prove or gettxoutproof) and prints the txids it proves, like
+// verifytxoutproof
+func runVerifyProof(args []string) error {
+	flags := flag.NewFlagSet("verify-proof", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: verify-proof <hex|file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("verify-proof takes exactly one proof")
+	}
+	proofHex := flags.Arg(0)
+	if fileBytes, err := os.ReadFile(proofHex); err == nil {
+		proofHex = string(fileBytes)
+	}
+	proof, err := hex.DecodeString(strings.TrimSpace(proofHex))
+	if err != nil {
+		return fmt.Errorf("proof is not hex: %v", err)
+	}
+	merkleBlock, err := handlers.DeserializeMerkleBlock(proof)
+	if err != nil {
+		return err
+	}
+	txIds, err := handlers.VerifyMerkleBlock(merkleBlock)
+	if err != nil {
+		return err
+	}
+	fmt.Println("proof for block", merkleBlock.Header.BlockHash(), "with", merkleBlock.Transactions, "txs is valid")
+	for _, txId := range txIds {
+		fmt.Println(txId)
+	}
+	return nil
+}
+
+// runFilter prints the BIP158 basic filter of the mined block, like getblockfilter, and with -match whether it
+// matches scripts or addresses
+func runFilter(args []string) error {
+	var opts options
+	flags := newFlagSet("filter", &opts)
+	prevHeader := flags.String("prev-header", "", "filter header of the previous block, to chain the header onto (default zero)")
+	match := flags.String("match", "", "comma separated scripts (hex) or addresses to test against the filter")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: filter [flags] [output.txt|block.dat|block.hex]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	if *prevHeader != "" {
+		header, err := chainhash.NewHashFromStr(*prevHeader)
+		if err != nil {
+			return fmt.Errorf("-prev-header: %v", err)
+		}
+		handlers.PrevFilterHeader = *header
+	}
+	path := opts.output
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	transactions := opts.loadMempool()
+	block, err := loadBlock(path, transactions)
+	if err != nil {
+		return err
+	}
+	// the filter commits to the scripts the block spends, so every input's prevout has to be found
+	utxos := opts.loadUTXOSet(transactions)
+	txData := make([]types.TransactionData, len(block.Transactions))
+	txData[0] = handlers.MsgTxToTransactionData(block.Transactions[0])
+	for i, tx := range block.Transactions[1:] {
+		transaction := handlers.MsgTxToTransactionData(tx)
+		if err := utxos.ResolvePrevouts(&transaction); err != nil {
+			return fmt.Errorf("tx %d (%s): %v", i+1, transaction.TxID, err)
+		}
+		utxos.AddTxOutputs(transaction)
+		txData[i+1] = transaction
+	}
+	filter, err := handlers.NewBasicFilter(block, txData)
+	if err != nil {
+		return err
+	}
+	result := handlers.BlockFilterResult(block, filter)
+	if *match != "" {
+		result.Matches = map[string]bool{}
+		for _, item := range strings.Split(*match, ",") {
+			pkScript, err := hex.DecodeString(item)
+			if err != nil {
+				if pkScript, err = handlers.AddressScript(item); err != nil {
+					return fmt.Errorf("-match %s: not a hex script or an address: %v", item, err)
+				}
+			}
+			if result.Matches[item], err = filter.Match(pkScript); err != nil {
+				return err
+			}
+		}
+	}
+	return printJSON(result)
+}
+
+// runCompact relays the mined block as a BIP152 compact block to a simulated peer whose mempool is the mempool
+// directory: the peer rebuilds what it can from short ids, asks for the rest with getblocktxn, and the byte counts of
+// each step are printed
+func runCompact(args []string) error {
+	var opts options
+	flags := newFlagSet("compact", &opts)
+	nonce := flags.Uint64("nonce", 0, "short id nonce (default random)")
+	missing := flags.Float64("missing", 0, "fraction of the block's transactions the peer's mempool doesn't have")
+	seed := flags.Int64("seed", 1, "seed for picking the transactions the peer is missing")
+	out := flags.String("out", "", "file to write the cmpctblock payload to, as hex")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: compact [flags] [output.txt|block.dat|block.hex]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	path := opts.output
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	transactions := opts.loadMempool()
+	block, err := loadBlock(path, transactions)
+	if err != nil {
+		return err
+	}
+	if *nonce == 0 {
+		*nonce = rand.Uint64()
+	}
+
+	// the peer's side starts from the bytes it received
+	compactBytes := handlers.NewCompactBlock(block, *nonce).Bytes()
+	if *out != "" {
+		if err := os.WriteFile(*out, []byte(hex.EncodeToString(compactBytes)+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	compact := new(handlers.CompactBlock)
+	if err := compact.Deserialize(bytes.NewReader(compactBytes)); err != nil {
+		return err
+	}
+	dropped := map[chainhash.Hash]bool{}
+	random := rand.New(rand.NewSource(*seed))
+	for _, tx := range block.Transactions[1:] {
+		if random.Float64() < *missing {
+			dropped[tx.WitnessHash()] = true
+		}
+	}
+	var peerMempool []*wire.MsgTx
+	for _, transaction := range transactions {
+		tx, err := handlers.TransactionDataToMsgTx(transaction)
+		if err != nil || dropped[tx.WitnessHash()] {
+			continue
+		}
+		peerMempool = append(peerMempool, tx)
+	}
+	partial, err := handlers.NewPartialBlock(compact, peerMempool)
+	if err != nil {
+		return err
+	}
+
+	report := types.CompactRelayReport{
+		BlockHash:        block.BlockHash().String(),
+		TxCount:          len(block.Transactions),
+		BlockSize:        block.SerializeSize(),
+		CompactBlockSize: len(compactBytes),
+		Prefilled:        len(compact.Prefilled),
+		FromMempool:      partial.FromMempool,
+		Collisions:       partial.Collisions,
+	}
+	// the missing transactions go over the wire too: getblocktxn to us, blocktxn back
+	var response *handlers.BlockTxn
+	if request := partial.Missing(); request != nil {
+		var requestBytes, responseBytes bytes.Buffer
+		request.Serialize(&requestBytes)
+		report.Missing = len(request.Indexes)
+		report.GetBlockTxnSize = requestBytes.Len()
+		received := new(handlers.GetBlockTxn)
+		if err := received.Deserialize(&requestBytes); err != nil {
+			return err
+		}
+		blockTxn, err := handlers.RespondBlockTxn(block, received)
+		if err != nil {
+			return err
+		}
+		blockTxn.Serialize(&responseBytes)
+		report.BlockTxnSize = responseBytes.Len()
+		response = new(handlers.BlockTxn)
+		if err := response.Deserialize(&responseBytes); err != nil {
+			return err
+		}
+	}
+	report.RelayBytes = report.CompactBlockSize + report.GetBlockTxnSize + report.BlockTxnSize
+	report.SavedPercent = 100 * (1 - float64(report.RelayBytes)/float64(report.BlockSize))
+	rebuilt, err := partial.Fill(response)
+	switch {
+	case err != nil:
+		report.ReconstructionErr = err.Error()
+	case rebuilt.BlockHash() != block.BlockHash() || !bytes.Equal(handlers.SerializeBlock(rebuilt), handlers.SerializeBlock(block)):
+		report.ReconstructionErr = "reconstructed block differs from the original"
+	default:
+		report.Reconstructed = true
+	}
+	return printJSON(report)
+}
+
+// runMempool prints mempool transactions like getmempoolentry, with the counts, sizes and fees of their unconfirmed
+// ancestors and descendants, which is what decides whether a CPFP child would be let in
+func runMempool(args []string) error {
+	var opts options
+	flags := newFlagSet("mempool", &opts)
+	families := flags.Bool("families", false, "only print transactions with unconfirmed ancestors or descendants")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: mempool [flags] [txid...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	mempool := handlers.LoadBoundedMempool(opts.mempool, opts.quarantine, opts.prevoutFiles()...)
+	if flags.NArg() > 0 {
+		entries := make([]types.MempoolEntry, 0, flags.NArg())
+		for _, txId := range flags.Args() {
+			entry, ok := mempool.Entry(txId)
+			if !ok {
+				return fmt.Errorf("%s is not in the mempool", txId)
+			}
+			entries = append(entries, entry)
+		}
+		return printJSON(entries)
+	}
+	entries := []types.MempoolEntry{}
+	for _, entry := range mempool.Entries() {
+		if !*families || entry.AncestorCount > 1 || entry.DescendantCount > 1 {
+			entries = append(entries, entry)
+		}
+	}
+	return printJSON(entries)
+}
+
+// runStats prints counts, fees, weights and feerate percentiles for the mempool
+func runStats(args []string) error {
+	var opts options
+	flags := newFlagSet("stats", &opts)
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	profile, err := opts.validationProfile(handlers.DefaultProfile)
+	if err != nil {
+		return err
+	}
+	transactions := opts.loadMempool()
+	stats := types.MempoolStats{
+		TxCount:            len(transactions),
+		InputTypes:         map[string]int{},
+		FeeRatePercentiles: map[string]float64{},
+	}
+	var feeRates []float64
+	for _, entry := range handlers.ValidateTxs(transactions, profile, opts.workers) {
+		stats.TotalFees += entry.Fee
+		stats.TotalWeight += entry.Weight
+		if len(entry.Tx.Vin) > 0 {
+			stats.InputTypes[string(handlers.InputType(entry.Tx.Vin[0]))]++
+		}
+		if errors.Is(entry.Err, handlers.ErrUnsupportedInputType) {
+			stats.UnsupportedCount++
+		} else if entry.Err == nil {
+			stats.ValidCount++
+			stats.ValidFees += entry.Fee
+			stats.ValidWeight += entry.Weight
+			feeRates = append(feeRates, entry.FeeRate*4)
+		} else {
+			stats.InvalidCount++
+		}
+	}
+	sort.Float64s(feeRates)
+	if len(feeRates) > 0 {
+		for _, percentile := range []int{10, 25, 50, 75, 90} {
+			stats.FeeRatePercentiles[fmt.Sprint(percentile)] = feeRates[(len(feeRates)-1)*percentile/100]
+		}
+	}
+	return printJSON(stats)
+}
+
+// runBenchSchnorr times verifying every taproot signature in the mempool one by one against verifying them in
+// batches of a few sizes. the signature cache is off so every run does the full work
+func runBenchSchnorr(args []string) error {
+	var opts options
+	flags := newFlagSet("bench-schnorr", &opts)
+	sizes := flags.String("sizes", "16,64,256,1024,0", "comma separated batch sizes to time, 0 for one batch of everything")
+	flags.Parse(args)
+	if err := opts.apply(); err != nil {
+		return err
+	}
+	handlers.SignatureCache = nil
+	sigs := handlers.CollectSchnorrSigs(opts.loadMempool())
+	if len(sigs) == 0 {
+		return errors.New("no taproot signatures in the mempool")
+	}
+
+	start := time.Now()
+	valid := 0
+	for _, sig := range sigs {
+		if handlers.VerifySchnorrSig(sig) {
+			valid++
+		}
+	}
+	single := time.Since(start)
+	fmt.Printf("%d signatures, %d valid\n", len(sigs), valid)
+	fmt.Printf("%-12s %12s %12s %8s\n", "batch size", "total", "per sig", "speedup")
+	fmt.Printf("%-12s %12s %12s %8s\n", "1 (single)", single.Round(time.Millisecond), single/time.Duration(len(sigs)), "1.00x")
+
+	for _, field := range strings.Split(*sizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 0 {
+			return fmt.Errorf("bad batch size %q", field)
+		}
+		if size == 0 || size > len(sigs) {
+			size = len(sigs)
+		}
+		start := time.Now()
+		batchValid := 0
+		for i := 0; i < len(sigs); i += size {
+			for _, ok := range handlers.VerifySchnorrBatch(sigs[i:min(i+size, len(sigs))]) {
+				if ok {
+					batchValid++
+				}
+			}
+		}
+		elapsed := time.Since(start)
+		if batchValid != valid {
+			return fmt.Errorf("batches of %d found %d valid signatures, one by one found %d", size, batchValid, valid)
+		}
+		fmt.Printf("%-12d %12s %12s %7.2fx\n", size, elapsed.Round(time.Millisecond), elapsed/time.Duration(len(sigs)),
+			float64(single)/float64(elapsed))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// MaxBlockWeight is the consensus limit on block weight, and the default weight budget when selecting transactions
+const MaxBlockWeight = 4000000
+
+// the selection strategies SortTxsByStrategy understands
+const (
+	StrategyFeeRate = "feerate" // highest fee per weight unit first
+	StrategyFee     = "fee"     // highest absolute fee first
+	StrategyNone    = "none"    // mempool (file) order
+)
+
+// SelectedTxs is the result of picking transactions for a block out of the mempool
+type SelectedTxs struct {
+	Txs            []*wire.MsgTx // the transactions without witnesses, which is what the block is mined with
+	TxsWithWitness []*wire.MsgTx
+	TxData         []types.TransactionData
+	TotalSize      int // serialized size of the selected txs with witnesses
+	TotalBaseSize  int // serialized size of the selected txs without witnesses
+	Weight         int // block weight including the header and the coinbase allowance
+	Considered     int // number of transactions that went through validation
+}
+
+// Fees is the total fee the selected transactions pay
+func (s SelectedTxs) Fees() int {
+	fees := 0
+	for _, transaction := range s.TxData {
+		fees += TxFee(transaction)
+	}
+	return fees
+}
+
+// SortTxsByStrategy orders the mempool according to a selection strategy. each transaction's fee and weight are
+// worked out once up front rather than on every comparison
+func SortTxsByStrategy(transactions []types.TransactionData, strategy string) error {
+	entries := NewTxEntries(transactions)
+	if err := SortEntries(entries, strategy); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		transactions[i] = entry.Tx
+	}
+	return nil
+}
+
+func errUnknownStrategy(strategy string) error {
+	return fmt.Errorf("unknown strategy %q (want %s, %s or %s)", strategy, StrategyFeeRate, StrategyFee, StrategyNone)
+}
+
+// SelectBlockTxs validates the (already sorted) mempool against the profile's rules and keeps the valid transactions
+// until the weight budget is used up, see SelectEntries. the order is kept apart from parents going in first
+func SelectBlockTxs(transactions []types.TransactionData, weightBudget int, profile *Profile) SelectedTxs {
+	return SelectEntries(NewTxEntries(transactions), weightBudget, StrategyNone, profile, ValidationWorkers)
+}
+
+// SelectEntries picks the valid entries that fit the weight budget the way core's block assembler does: every entry
+// is scored together with its unconfirmed ancestors that aren't in the block yet, by the strategy (the package's
+// feerate, its fee, or for StrategyNone where the entry is in the list), and the best package that still fits goes in
+// whole, parents before children, so the block comes out in an order it can be connected in. a package with an
+// invalid entry in it never goes in. entries are validated in batches on workers goroutines when a package needs
+// them, running ahead in the order packages are first scored in, so entries the block never gets to aren't validated
+func SelectEntries(entries []*TxEntry, weightBudget int, strategy string, profile *Profile, workers int) SelectedTxs {
+	var selected SelectedTxs
+	selected.Weight = 320 + 800*2 // 320 is the size of the block header and 600 is the  approx size of the coinbase tx
+	// with margin of error. we do 800*2 because... coinbase tx weight for nonsegwit and for segwit serialzing the tx with witness
+	batchSize := 32 * workers
+	if batchSize < 32 {
+		batchSize = 32
+	}
+	packages := newPackageSelector(entries, strategy)
+	ahead := packages.order()
+	considered := make([]bool, len(entries))
+	validate := func(pkg []int) {
+		var batch []*TxEntry
+		for _, i := range pkg {
+			if !considered[i] {
+				considered[i] = true
+				batch = append(batch, entries[i])
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		for len(batch) < batchSize && len(ahead) > 0 {
+			if i := ahead[0]; !considered[i] {
+				considered[i] = true
+				batch = append(batch, entries[i])
+			}
+			ahead = ahead[1:]
+		}
+		selected.Considered += len(batch)
+		ValidateEntries(batch, profile, workers)
+	}
+
+	for {
+		i, ok := packages.next()
+		if !ok {
+			break
+		}
+		// the weight of a transaction is its base size multiplied by 3 plus its size with witness. a package that
+		// would take the block to the weight budget (4,000,000 by default) is passed over, a smaller one may still fit
+		pkg, _, weight := packages.ancestorPackage(i)
+		if selected.Weight+weight >= weightBudget {
+			continue
+		}
+		validate(pkg)
+		valid := true
+		for _, j := range pkg {
+			if !entries[j].Valid() {
+				packages.fail(j)
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+		for _, j := range pkg {
+			entry := entries[j]
+			selected.Weight += entry.Weight
+			selected.TotalBaseSize += entry.BaseSize
+			selected.TotalSize += entry.Size
+			selected.Txs = append(selected.Txs, entry.Stripped)
+			selected.TxsWithWitness = append(selected.TxsWithWitness, entry.WithWitness)
+			selected.TxData = append(selected.TxData, entry.Tx)
+		}
+		packages.include(pkg)
+	}
+	return selected
+}
+
+// IsSupportedInputType reports whether we validate transactions whose (first) input spends this kind of output.
+// transactions spending anything else are skipped when picking txs for a block
+func IsSupportedInputType(inputType script.Class) bool {
+	return inputType == script.P2PKH || inputType == script.P2WPKH || inputType == script.P2WSH || inputType == script.P2TR || inputType == script.P2SH
+}
+
+// TxWeight returns the weight of a transaction, its base size times 3 plus its size with witnesses
+func TxWeight(transaction types.TransactionData) int {
+	_, _, serializedTxBytes, serializedWitnessTxBytes := SerializeATx(transaction)
+	return len(serializedTxBytes)*3 + len(serializedWitnessTxBytes)
+}
+
+// ErrTemplateOrder is why a template can't be built from, or assembled out of, transactions where one spends an
+// output of a transaction that comes after it: BIP22 has every transaction's depends come before it
+var ErrTemplateOrder = errors.New("transaction depends on one that comes after it")
+
+// BuildBlockTemplate describes the selected transactions as a getblocktemplate style template, without mining
+// anything. the coinbase value is what the block may pay out, the subsidy plus the fees of the selected txs. the
+// transactions have to be in an order the block can be connected in, parents first, as SelectEntries puts them
+func BuildBlockTemplate(selected SelectedTxs) (types.BlockTemplate, error) {
+	header := CreateBlockHeader(&chainhash.Hash{})
+	template := types.BlockTemplate{
+		Capabilities:             []string{"proposal"},
+		Version:                  header.Version,
+		Rules:                    []string{"csv", "!segwit", "taproot"},
+		VbAvailable:              map[string]int{},
+		PreviousBlockHash:        PrevBlockHash,
+		Transactions:             make([]types.BlockTemplateTx, 0, len(selected.TxData)),
+		CoinbaseValue:            BlockSubsidy(),
+		Target:                   fmt.Sprintf("%064x", blockchain.CompactToBig(header.Bits)),
+		MinTime:                  header.Timestamp.Unix(),
+		Mutable:                  []string{"time", "transactions", "prevblock"},
+		NonceRange:               "00000000ffffffff",
+		SigOpLimit:               MaxBlockSigOpCost,
+		SizeLimit:                wire.MaxBlockPayload,
+		WeightLimit:              MaxBlockWeight,
+		CurTime:                  time.Now().Unix(),
+		Bits:                     fmt.Sprintf("%08x", header.Bits),
+		Height:                   BlockHeight,
+		DefaultWitnessCommitment: hex.EncodeToString(CreateCoinbaseCommittmentScript(selected.TxsWithWitness)),
+	}
+	// depends lists the (1 based) positions of in template parents, as in getblocktemplate
+	positions := make(map[string]int, len(selected.TxData))
+	for i, transaction := range selected.TxData {
+		positions[transaction.TxID] = i + 1
+	}
+	for i, transaction := range selected.TxData {
+		depends := []int{}
+		for _, input := range transaction.Vin {
+			parent, ok := positions[input.TxID]
+			if !ok || slices.Contains(depends, parent) {
+				continue
+			}
+			if parent > i {
+				return types.BlockTemplate{}, fmt.Errorf("%w: %s at %d spends %s at %d", ErrTemplateOrder,
+					transaction.TxID, i+1, input.TxID, parent)
+			}
+			depends = append(depends, parent)
+		}
+		fee := TxFee(transaction)
+		template.CoinbaseValue += fee
+		template.Transactions = append(template.Transactions, types.BlockTemplateTx{
+			Data:    hex.EncodeToString(SerializeWireMsgTx(selected.TxsWithWitness[i])),
+			TxID:    transaction.TxID,
+			Hash:    transaction.WTxID,
+			Depends: depends,
+			Fee:     fee,
+			SigOps:  TxSigOpCost(transaction),
+			Weight:  TxWeight(transaction),
+		})
+	}
+	return template, nil
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BlockBuilder assembles a block out of candidate transactions. it holds all the state that used to live in main:
+// the candidates, the selection strategy and weight budget, and what got selected. typical use is
+//
+//	builder := handlers.NewBlockBuilder()
+//	builder.AddCandidates(handlers.LoadMempool("mempool", ""))
+//	built, err := builder.Finalize()
+//
+// a builder is not safe for concurrent use
+type BlockBuilder struct {
+	candidates   []types.TransactionData
+	extra        []*TxEntry // candidates added as entries, which keep their validation results
+	replaced     []types.Replacement
+	strategy     string
+	weightBudget int
+	profile      *Profile
+	workers      int
+	entries      []*TxEntry
+	selected     *SelectedTxs
+}
+
+// BuiltBlock is a block produced by a BlockBuilder along with what's needed to report on or serialize it
+type BuiltBlock struct {
+	Block    *wire.MsgBlock          // the full block, witnesses included
+	Coinbase *wire.MsgTx             // same as Block.Transactions[0]
+	TxData   []types.TransactionData // every tx in block order, coinbase first
+	Selected SelectedTxs
+	Summary  types.BlockSummary
+	Mined    bool // whether the header's nonce has been solved
+}
+
+// NewBlockBuilder returns a builder that selects by feerate up to the full block weight, validating with the default
+// profile
+func NewBlockBuilder() *BlockBuilder {
+	return &BlockBuilder{strategy: StrategyFeeRate, weightBudget: MaxBlockWeight, profile: DefaultProfile, workers: ValidationWorkers}
+}
+
+// AddCandidate adds a transaction the builder may put in the block. it gets validated during selection, so it
+// doesn't have to be checked beforehand
+func (b *BlockBuilder) AddCandidate(transaction types.TransactionData) {
+	b.candidates = append(b.candidates, transaction)
+	b.selected = nil
+}
+
+// AddCandidates adds several candidate transactions, see AddCandidate
+func (b *BlockBuilder) AddCandidates(transactions []types.TransactionData) {
+	b.candidates = append(b.candidates, transactions...)
+	b.selected = nil
+}
+
+// AddEntries adds candidates that are already wrapped in entries, e.g by a MempoolWatcher. entries that have been
+// validated aren't validated again
+func (b *BlockBuilder) AddEntries(entries []*TxEntry) {
+	b.extra = append(b.extra, entries...)
+	b.selected = nil
+}
+
+// AddReplaced records transactions the mempool the candidates came from replaced, for the template to report
+func (b *BlockBuilder) AddReplaced(replaced []types.Replacement) {
+	b.replaced = append(b.replaced, replaced...)
+}
+
+// Candidates returns the candidate transactions in the order they were added, the ones added as entries last
+func (b *BlockBuilder) Candidates() []types.TransactionData {
+	candidates := b.candidates
+	for _, entry := range b.extra {
+		candidates = append(candidates, entry.Tx)
+	}
+	return candidates
+}
+
+// Entries returns the candidates from the last selection in the order the strategy put them. only the ones selection
+// got to are validated
+func (b *BlockBuilder) Entries() []*TxEntry {
+	return b.entries
+}
+
+// SetStrategy sets the order candidates are considered in, one of StrategyFeeRate, StrategyFee or StrategyNone
+func (b *BlockBuilder) SetStrategy(strategy string) error {
+	// sorting nothing just checks the strategy name
+	if err := SortEntries(nil, strategy); err != nil {
+		return err
+	}
+	b.strategy = strategy
+	b.selected = nil
+	return nil
+}
+
+// SetWeightBudget sets the block weight the selected transactions (plus header and coinbase) have to fit in
+func (b *BlockBuilder) SetWeightBudget(weightBudget int) error {
+	if weightBudget <= 0 || weightBudget > MaxBlockWeight {
+		return fmt.Errorf("weight budget %d is not in (0, %d]", weightBudget, MaxBlockWeight)
+	}
+	b.weightBudget = weightBudget
+	b.selected = nil
+	return nil
+}
+
+// SetProfile sets the rules candidates have to pass to be selected
+func (b *BlockBuilder) SetProfile(profile *Profile) {
+	b.profile = profile
+	b.selected = nil
+}
+
+// SetWorkers sets how many goroutines validate the candidates
+func (b *BlockBuilder) SetWorkers(workers int) {
+	b.workers = workers
+	b.selected = nil
+}
+
+// Select applies the strategy to the candidates and picks the valid ones that fit the weight budget, each with its
+// unconfirmed ancestors, see SelectEntries. the result is kept until the candidates or settings change
+func (b *BlockBuilder) Select() (SelectedTxs, error) {
+	if b.selected != nil {
+		return *b.selected, nil
+	}
+	// candidates are put in strategy order using the weights and fees cached on their entries, then picked with
+	// their ancestors and validated in parallel as selection gets to them
+	entries := append(NewTxEntries(b.candidates), b.extra...)
+	if err := SortEntries(entries, b.strategy); err != nil {
+		return SelectedTxs{}, err
+	}
+	selected := SelectEntries(entries, b.weightBudget, b.strategy, b.profile, b.workers)
+	b.entries = entries
+	b.selected = &selected
+	return selected, nil
+}
+
+// Coinbase builds the coinbase for the selected transactions. it commits to their wtxids and claims the whole
+// reward, the block subsidy plus every selected transaction's fee
+func (b *BlockBuilder) Coinbase() (*wire.MsgTx, error) {
+	selected, err := b.Select()
+	if err != nil {
+		return nil, err
+	}
+	fees := selected.Fees()
+	coinbaseComScript := CreateCoinbaseCommittmentScript(selected.TxsWithWitness)
+	coinbaseTx := CreateAndModCoinbaseTxWithSecondOutput(coinbaseComScript)
+	coinbaseTx.TxOut[0].Value = int64(BlockSubsidy() + fees)
+	return coinbaseTx, nil
+}
+
+// Template returns the selection as a getblocktemplate style template
+func (b *BlockBuilder) Template() (types.BlockTemplate, error) {
+	selected, err := b.Select()
+	if err != nil {
+		return types.BlockTemplate{}, err
+	}
+	template, err := BuildBlockTemplate(selected)
+	if err != nil {
+		return types.BlockTemplate{}, err
+	}
+	template.Replaced = b.replaced
+	return template, nil
+}
+
+// Build assembles the block (coinbase first, then the selected transactions with their witnesses) without mining
+// it, i.e the header's nonce is not solved yet
+func (b *BlockBuilder) Build() (*BuiltBlock, error) {
+	selected, err := b.Select()
+	if err != nil {
+		return nil, err
+	}
+	coinbaseTx, err := b.Coinbase()
+	if err != nil {
+		return nil, err
+	}
+	// the merkle root commits to txids, so it's built from the stripped txs
+	merkleRoot, err := CreateMerkleTree(selected.Txs, false, coinbaseTx)
+	if err != nil {
+		return nil, err
+	}
+	block := wire.NewMsgBlock(CreateBlockHeader(merkleRoot))
+	block.AddTransaction(coinbaseTx)
+	for _, tx := range selected.TxsWithWitness {
+		block.AddTransaction(tx)
+	}
+	built := &BuiltBlock{
+		Block:    block,
+		Coinbase: coinbaseTx,
+		TxData:   append([]types.TransactionData{MsgTxToTransactionData(coinbaseTx)}, selected.TxData...),
+		Selected: selected,
+	}
+	built.Summary = SummarizeBlock(block, built.TxData)
+	return built, nil
+}
+
+// Finalize builds the block and mines it, returning it with the nonce solved
+func (b *BlockBuilder) Finalize() (*BuiltBlock, error) {
+	built, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("total txs: ", built.Selected.Considered, "validtxs: ", len(built.Selected.Txs), "block weight unit: ", built.Summary.Weight)
+	SolveBlock(built.Block)
+	built.Mined = true
+	// the header changed, so the hash in the summary did too
+	built.Summary.Hash = built.Block.BlockHash().String()
+	return built, nil
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// the parameters of BIP158 basic filters: remainders are FilterP bits, and items are hashed into N*FilterM values
+const (
+	FilterP = 19
+	FilterM = 784931
+)
+
+// PrevFilterHeader is the basic filter header of the block we build on (PrevBlockHash). we don't have the chain to
+// compute it, so it's zero unless set, e.g with filter -prev-header
+var PrevFilterHeader chainhash.Hash
+
+// BlockFilter is a BIP158 golomb coded set: N items, each hashed with siphash keyed by the block hash into
+// [0, N*M), sorted, and the differences between them rice coded with parameter P
+type BlockFilter struct {
+	N    uint32
+	P    uint8
+	M    uint64
+	key  [16]byte
+	data []byte // the golomb rice coded differences, without N
+}
+
+// BasicFilterElements returns the items of a block's basic filter: every output script it creates, apart from
+// empty and OP_RETURN ones, and the script of every prevout it spends. txData holds the TransactionData of every
+// transaction in the block in block order, coinbase first, for their prevouts. duplicates are removed
+func BasicFilterElements(block *wire.MsgBlock, txData []types.TransactionData) ([][]byte, error) {
+	if len(txData) != len(block.Transactions) {
+		return nil, fmt.Errorf("have prevouts for %d transactions, the block has %d", len(txData), len(block.Transactions))
+	}
+	seen := map[string]bool{}
+	var elements [][]byte
+	add := func(pkScript []byte) {
+		if len(pkScript) == 0 || seen[string(pkScript)] {
+			return
+		}
+		seen[string(pkScript)] = true
+		elements = append(elements, pkScript)
+	}
+	for _, tx := range block.Transactions {
+		for _, txOut := range tx.TxOut {
+			if len(txOut.PkScript) > 0 && txOut.PkScript[0] == txscript.OP_RETURN {
+				continue
+			}
+			add(txOut.PkScript)
+		}
+	}
+	for _, transaction := range txData[1:] {
+		for i, input := range transaction.Vin {
+			pkScript, err := hex.DecodeString(input.Prevout.ScriptPubKey)
+			if err != nil {
+				return nil, fmt.Errorf("%s input %d: bad prevout script: %v", transaction.TxID, i, err)
+			}
+			add(pkScript)
+		}
+	}
+	return elements, nil
+}
+
+// NewBasicFilter builds the basic filter of a block, see BasicFilterElements
+func NewBasicFilter(block *wire.MsgBlock, txData []types.TransactionData) (*BlockFilter, error) {
+	elements, err := BasicFilterElements(block, txData)
+	if err != nil {
+		return nil, err
+	}
+	blockHash := block.BlockHash()
+	return BuildFilter(FilterP, FilterM, filterKey(&blockHash), elements), nil
+}
+
+// filterKey is the siphash key for a block's filters, the first 16 bytes of its hash
+func filterKey(blockHash *chainhash.Hash) [16]byte {
+	var key [16]byte
+	copy(key[:], blockHash[:16])
+	return key
+}
+
+// BuildFilter builds a golomb coded set of items, which should have no duplicates
+func BuildFilter(p uint8, m uint64, key [16]byte, items [][]byte) *BlockFilter {
+	filter := &BlockFilter{N: uint32(len(items)), P: p, M: m, key: key}
+	values := filter.hashedItems(items)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	var writer bitWriter
+	last := uint64(0)
+	for _, value := range values {
+		delta := value - last
+		last = value
+		for quotient := delta >> p; quotient > 0; quotient-- {
+			writer.writeBit(true)
+		}
+		writer.writeBit(false)
+		writer.writeBits(delta, int(p))
+	}
+	filter.data = writer.bytes
+	return filter
+}
+
+// ParseBasicFilter reads a serialized basic filter (as Bytes writes it, or getblockfilter returns it) for the block
+func ParseBasicFilter(blockHash *chainhash.Hash, serialized []byte) (*BlockFilter, error) {
+	reader := bytes.NewReader(serialized)
+	n, err := wire.ReadVarInt(reader, 0)
+	if err != nil {
+		return nil, fmt.Errorf("filter item count: %v", err)
+	}
+	if n > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("filter with %d items", n)
+	}
+	return &BlockFilter{
+		N:    uint32(n),
+		P:    FilterP,
+		M:    FilterM,
+		key:  filterKey(blockHash),
+		data: serialized[len(serialized)-reader.Len():],
+	}, nil
+}
+
+// hashedItems maps items into [0, N*M) with siphash, using the 128 bit product instead of a modulo
+func (f *BlockFilter) hashedItems(items [][]byte) []uint64 {
+	k0 := binary.LittleEndian.Uint64(f.key[:8])
+	k1 := binary.LittleEndian.Uint64(f.key[8:])
+	modulus := uint64(f.N) * f.M
+	values := make([]uint64, len(items))
+	for i, item := range items {
+		values[i], _ = bits.Mul64(SipHash24(k0, k1, item), modulus)
+	}
+	return values
+}
+
+// Bytes serializes the filter: N as a compact size, then the coded values
+func (f *BlockFilter) Bytes() []byte {
+	var buf bytes.Buffer
+	wire.WriteVarInt(&buf, 0, uint64(f.N))
+	buf.Write(f.data)
+	return buf.Bytes()
+}
+
+// Hash is the filter's hash, what filter headers chain together
+func (f *BlockFilter) Hash() chainhash.Hash {
+	return chainhash.DoubleHashH(f.Bytes())
+}
+
+// Header returns the filter header given the previous block's, the double sha256 of the filter hash and it
+func (f *BlockFilter) Header(prevHeader chainhash.Hash) chainhash.Hash {
+	filterHash := f.Hash()
+	return chainhash.DoubleHashH(append(filterHash[:], prevHeader[:]...))
+}
+
+// Match reports whether item may be in the filter. false positives happen about once in M queries
+func (f *BlockFilter) Match(item []byte) (bool, error) {
+	return f.MatchAny([][]byte{item})
+}
+
+// MatchAny reports whether any of items may be in the filter, walking the filter once for all of them
+func (f *BlockFilter) MatchAny(items [][]byte) (bool, error) {
+	if f.N == 0 || len(items) == 0 {
+		return false, nil
+	}
+	queries := f.hashedItems(items)
+	sort.Slice(queries, func(i, j int) bool { return queries[i] < queries[j] })
+	reader := bitReader{bytes: f.data}
+	value := uint64(0)
+	for i := uint32(0); i < f.N; i++ {
+		delta, err := reader.readGolombRice(f.P)
+		if err != nil {
+			return false, err
+		}
+		value += delta
+		for len(queries) > 0 && queries[0] < value {
+			queries = queries[1:]
+		}
+		if len(queries) == 0 {
+			return false, nil
+		}
+		if queries[0] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// errFilterTruncated is returned when a filter ends before its N values do
+var errFilterTruncated = errors.New("filter data ends before all its items")
+
+// bitWriter appends bits most significant first, as golomb rice coding in BIP158 does
+type bitWriter struct {
+	bytes []byte
+	used  int // bits used in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 {
+		w.bytes = append(w.bytes, 0)
+	}
+	if bit {
+		w.bytes[len(w.bytes)-1] |= 0x80 >> w.used
+	}
+	w.used = (w.used + 1) % 8
+}
+
+// writeBits writes the low n bits of value, most significant first
+func (w *bitWriter) writeBits(value uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(value>>i&1 == 1)
+	}
+}
+
+type bitReader struct {
+	bytes []byte
+	pos   int // in bits
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.bytes)*8 {
+		return false, errFilterTruncated
+	}
+	bit := r.bytes[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+// readGolombRice reads a unary quotient then a p bit remainder
+func (r *bitReader) readGolombRice(p uint8) (uint64, error) {
+	quotient := uint64(0)
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		quotient++
+	}
+	remainder := uint64(0)
+	for i := uint8(0); i < p; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		remainder <<= 1
+		if bit {
+			remainder |= 1
+		}
+	}
+	return quotient<<p | remainder, nil
+}
+
+// SipHash24 is siphash-2-4 with the key given as two little endian words, the hash BIP158 (and BIP152) use
+func SipHash24(k0, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	length := len(data)
+	for ; len(data) >= 8; data = data[8:] {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	last := uint64(length) << 56
+	for i, b := range data {
+		last |= uint64(b) << (8 * i)
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BIP158's test vectors (testnet-19.json) for the blocks whose contents we have without a testnet node, the
+// genesis block being the one chaincfg carries
+func TestBasicFilterVectors(t *testing.T) {
+	tests := []struct {
+		name       string
+		block      *wire.MsgBlock
+		prevHeader string
+		filter     string
+		header     string
+	}{
+		{
+			name:       "testnet genesis",
+			block:      chaincfg.TestNet3Params.GenesisBlock,
+			prevHeader: "0000000000000000000000000000000000000000000000000000000000000000",
+			filter:     "019dfca8",
+			header:     "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a block of coinbases spends nothing, so the transactions' prevouts are all empty
+			filter, err := NewBasicFilter(test.block, make([]types.TransactionData, len(test.block.Transactions)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(filter.Bytes()); got != test.filter {
+				t.Errorf("filter %s, want %s", got, test.filter)
+			}
+			prevHeader, err := chainhash.NewHashFromStr(test.prevHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.Header(*prevHeader).String(); got != test.header {
+				t.Errorf("filter header %s, want %s", got, test.header)
+			}
+
+			blockHash := test.block.BlockHash()
+			parsed, err := ParseBasicFilter(&blockHash, filter.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tx := range test.block.Transactions {
+				for _, txOut := range tx.TxOut {
+					if ok, err := parsed.Match(txOut.PkScript); err != nil || !ok {
+						t.Errorf("parsed filter doesn't match output script %x: %v", txOut.PkScript, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestBasicFilterAgainstBtcutil builds the filter of a block of mempool transactions and checks it byte for byte
+// against btcutil's BIP158 implementation, header included
+func TestBasicFilterAgainstBtcutil(t *testing.T) {
+	files, err := os.ReadDir(mempoolTestDir)
+	if err != nil {
+		t.Skip("no mempool directory:", err)
+	}
+	coinbase, coinbaseData := CreateCoinbaseTx()
+	block := wire.NewMsgBlock(wire.NewBlockHeader(4, &chainhash.Hash{}, &chainhash.Hash{}, 0, 0))
+	block.AddTransaction(coinbase)
+	txData := []types.TransactionData{coinbaseData}
+	var prevOutScripts [][]byte
+	for _, file := range files[:min(len(files), 500)] {
+		transaction, err := LoadTxFile(filepath.Join(mempoolTestDir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := TransactionDataToMsgTx(transaction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTransaction(tx)
+		txData = append(txData, transaction)
+		for _, input := range transaction.Vin {
+			pkScript, _ := hex.DecodeString(input.Prevout.ScriptPubKey)
+			prevOutScripts = append(prevOutScripts, pkScript)
+		}
+	}
+
+	filter, err := NewBasicFilter(block, txData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := builder.BuildBasicFilter(block, prevOutScripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBytes, err := want.NBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(filter.Bytes(), wantBytes) {
+		t.Fatalf("filter of %d items differs from btcutil's, %d bytes against %d", filter.N, len(filter.Bytes()), len(wantBytes))
+	}
+	prevHeader := chainhash.HashH([]byte("previous filter header"))
+	wantHeader, err := builder.MakeHeaderForFilter(want, prevHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := filter.Header(prevHeader); header != wantHeader {
+		t.Errorf("filter header %s, btcutil has %s", header, wantHeader)
+	}
+}
+
+// testFilterItems makes n distinct items, prefix telling sets apart
+func testFilterItems(prefix string, n int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		item := sha256.Sum256([]byte(fmt.Sprintf("%s %d", prefix, i)))
+		items[i] = item[:]
+	}
+	return items
+}
+
+func TestFilterMatch(t *testing.T) {
+	key := filterKey(&chainhash.Hash{1, 2, 3})
+	members := testFilterItems("member", 1000)
+	filter := BuildFilter(FilterP, FilterM, key, members)
+	for i, item := range members {
+		if ok, err := filter.Match(item); err != nil || !ok {
+			t.Fatalf("item %d not matched: %v", i, err)
+		}
+	}
+	if ok, err := filter.MatchAny(append(testFilterItems("outsider", 10), members[500])); err != nil || !ok {
+		t.Errorf("MatchAny with one member among outsiders = %v, %v", ok, err)
+	}
+	// with M = 784931 a thousand outsiders should practically never match
+	outsiders := testFilterItems("outsider", 1000)
+	if ok, err := filter.MatchAny(outsiders); err != nil || ok {
+		t.Errorf("MatchAny with outsiders only = %v, %v", ok, err)
+	}
+
+	empty := BuildFilter(FilterP, FilterM, key, nil)
+	if got := hex.EncodeToString(empty.Bytes()); got != "00" {
+		t.Errorf("empty filter serializes to %s", got)
+	}
+	if ok, err := empty.Match(members[0]); err != nil || ok {
+		t.Errorf("empty filter Match = %v, %v", ok, err)
+	}
+
+	// the outsiders spread over the whole range, so finding out they're not in it means reading past the cut
+	truncated := &BlockFilter{N: filter.N, P: filter.P, M: filter.M, key: key, data: filter.data[:len(filter.data)/2]}
+	if _, err := truncated.MatchAny(outsiders); err == nil {
+		t.Error("truncated filter read past its end without an error")
+	}
+}
+
+// TestFilterFalsePositives checks that outsiders match about once in M queries, with a small M so that the rate can
+// be measured
+func TestFilterFalsePositives(t *testing.T) {
+	const p, m, queries = 6, 64, 20000
+	key := filterKey(&chainhash.Hash{4, 5, 6})
+	filter := BuildFilter(p, m, key, testFilterItems("member", 500))
+	matches := 0
+	for _, item := range testFilterItems("outsider", queries) {
+		ok, err := filter.Match(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			matches++
+		}
+	}
+	// the expected count is queries/m, about 312; allow for a wide margin either way
+	if expected := queries / m; matches < expected/2 || matches > expected*2 {
+		t.Errorf("%d false positives in %d queries, expected about %d", matches, queries, expected)
+	}
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// SerializeBlock returns the full serialized block (header, tx count and every tx with its witness), which is what
+// submitblock expects
+func SerializeBlock(block *wire.MsgBlock) []byte {
+	var blockBuf bytes.Buffer
+	block.Serialize(&blockBuf)
+	return blockBuf.Bytes()
+}
+
+// AttachWitnesses returns a copy of a block with its non coinbase transactions swapped for their witness carrying
+// versions. the block we mine is assembled from the stripped transactions, which is enough for the header and
+// output.txt, but a block handed to submitblock has to carry the witnesses
+func AttachWitnesses(block *wire.MsgBlock, witnessTxs []*wire.MsgTx) *wire.MsgBlock {
+	fullBlock := wire.NewMsgBlock(&block.Header)
+	fullBlock.AddTransaction(block.Transactions[0])
+	for _, tx := range witnessTxs {
+		fullBlock.AddTransaction(tx)
+	}
+	return fullBlock
+}
+
+// TxSigOpCost returns the weighted sigop cost of a transaction as counted against the 80,000 block limit. legacy
+// sigops count 4 each, witness sigops count 1 each
+func TxSigOpCost(transaction types.TransactionData) int {
+	legacySigOps := 0
+	for _, input := range transaction.Vin {
+		scriptSig, _ := hex.DecodeString(input.ScriptSig)
+		legacySigOps += script.CountSigOps(scriptSig, false)
+	}
+	for _, output := range transaction.Vout {
+		scriptPubKey, _ := hex.DecodeString(output.ScriptPubKey)
+		legacySigOps += script.CountSigOps(scriptPubKey, false)
+	}
+	sigOpCost := legacySigOps * 4
+	for _, input := range transaction.Vin {
+		if input.IsCoinbase {
+			continue
+		}
+		witnessProgram, _ := hex.DecodeString(input.Prevout.ScriptPubKey)
+		if InputType(input) == script.P2SH {
+			scriptSig, _ := hex.DecodeString(input.ScriptSig)
+			redeemScript, err := script.LastPush(scriptSig)
+			if err != nil {
+				continue
+			}
+			sigOpCost += script.CountSigOps(redeemScript, true) * 4
+			witnessProgram = redeemScript
+		}
+		// p2wpkh always costs one sigop, p2wsh costs whatever its witness script does
+		switch script.Classify(witnessProgram) {
+		case script.P2WPKH:
+			sigOpCost++
+		case script.P2WSH:
+			if len(input.Witness) > 0 {
+				witnessScript, _ := hex.DecodeString(input.Witness[len(input.Witness)-1])
+				sigOpCost += script.CountSigOps(witnessScript, true)
+			}
+		}
+	}
+	return sigOpCost
+}
+
+// SummarizeBlock totals up fees, sizes and sigops for a block. txData holds the TransactionData of every transaction
+// in the block in block order, coinbase first, since the prevout values needed for the fees aren't in the wire block
+func SummarizeBlock(block *wire.MsgBlock, txData []types.TransactionData) types.BlockSummary {
+	blockHash := block.BlockHash()
+	summary := types.BlockSummary{
+		Hash:         blockHash.String(),
+		Height:       BlockHeight,
+		TxCount:      len(block.Transactions),
+		Size:         block.SerializeSize(),
+		StrippedSize: block.SerializeSizeStripped(),
+	}
+	summary.Weight = summary.StrippedSize*3 + summary.Size
+	summary.VSize = (summary.Weight + 3) / 4
+	for i, transaction := range txData {
+		if i > 0 {
+			summary.Fees += TxFee(transaction)
+		}
+		summary.SigOpCost += TxSigOpCost(transaction)
+	}
+	if len(block.Transactions) > 0 {
+		for _, txOut := range block.Transactions[0].TxOut {
+			summary.CoinbaseValue += int(txOut.Value)
+		}
+	}
+	return summary
+}
+
+// BlockToGetBlockResult renders a block the way getblock does at verbosity 2. scripts are shown in the same asm
+// format as the rest of this code base rather than bitcoin core's
+func BlockToGetBlockResult(block *wire.MsgBlock, txData []types.TransactionData) types.GetBlockResult {
+	blockHash := block.BlockHash()
+	result := types.GetBlockResult{
+		Hash:              blockHash.String(),
+		Size:              block.SerializeSize(),
+		StrippedSize:      block.SerializeSizeStripped(),
+		Height:            BlockHeight,
+		Version:           block.Header.Version,
+		VersionHex:        fmt.Sprintf("%08x", uint32(block.Header.Version)),
+		MerkleRoot:        block.Header.MerkleRoot.String(),
+		Time:              block.Header.Timestamp.Unix(),
+		Nonce:             block.Header.Nonce,
+		Bits:              fmt.Sprintf("%08x", block.Header.Bits),
+		Difficulty:        Difficulty(block.Header.Bits),
+		NTx:               len(block.Transactions),
+		PreviousBlockHash: block.Header.PrevBlock.String(),
+	}
+	result.Weight = result.StrippedSize*3 + result.Size
+	for i, tx := range block.Transactions {
+		blockTx := MsgTxToGetBlockTx(tx)
+		if i > 0 && i < len(txData) {
+			fee := btcutil.Amount(TxFee(txData[i])).ToBTC()
+			blockTx.Fee = &fee
+		}
+		result.Tx = append(result.Tx, blockTx)
+	}
+	return result
+}
+
+// MsgTxToGetBlockTx renders a single transaction the way getblock/getrawtransaction do
+func MsgTxToGetBlockTx(tx *wire.MsgTx) types.GetBlockTx {
+	txHash := tx.TxHash()
+	wTxHash := tx.WitnessHash()
+	baseSize := tx.SerializeSizeStripped()
+	totalSize := tx.SerializeSize()
+	blockTx := types.GetBlockTx{
+		TxID:     txHash.String(),
+		Hash:     wTxHash.String(),
+		Version:  tx.Version,
+		Size:     totalSize,
+		Weight:   baseSize*3 + totalSize,
+		Locktime: tx.LockTime,
+		Hex:      hex.EncodeToString(SerializeWireMsgTx(tx)),
+	}
+	blockTx.VSize = (blockTx.Weight + 3) / 4
+	isCoinbase := blockchain.IsCoinBaseTx(tx)
+	for _, txIn := range tx.TxIn {
+		vin := types.GetBlockVin{Sequence: txIn.Sequence}
+		if isCoinbase {
+			vin.Coinbase = hex.EncodeToString(txIn.SignatureScript)
+		} else {
+			vout := txIn.PreviousOutPoint.Index
+			vin.TxID = txIn.PreviousOutPoint.Hash.String()
+			vin.Vout = &vout
+			vin.ScriptSig = &types.GetBlockScriptSig{
+				Asm: script.Disasm(txIn.SignatureScript),
+				Hex: hex.EncodeToString(txIn.SignatureScript),
+			}
+		}
+		for _, item := range txIn.Witness {
+			vin.TxInWitness = append(vin.TxInWitness, hex.EncodeToString(item))
+		}
+		blockTx.Vin = append(blockTx.Vin, vin)
+	}
+	for i, txOut := range tx.TxOut {
+		blockTx.Vout = append(blockTx.Vout, types.GetBlockVout{
+			Value: btcutil.Amount(txOut.Value).ToBTC(),
+			N:     i,
+			ScriptPubKey: types.GetBlockScriptPubKey{
+				Asm:     script.Disasm(txOut.PkScript),
+				Hex:     hex.EncodeToString(txOut.PkScript),
+				Address: ScriptAddress(txOut.PkScript),
+				Type:    script.Classify(txOut.PkScript).CoreType(),
+			},
+		})
+	}
+	return blockTx
+}
+
+// Difficulty converts compact bits into the difficulty relative to the minimum (bits 0x1d00ffff) target
+func Difficulty(bits uint32) float64 {
+	target := blockchain.CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+	maxTarget := blockchain.CompactToBig(0x1d00ffff)
+	difficulty, _ := new(big.Rat).SetFrac(maxTarget, target).Float64()
+	return difficulty
+}
+
+// BlockFilterResult renders a block's basic filter the way the filter command prints it, with its header chained
+// onto PrevFilterHeader
+func BlockFilterResult(block *wire.MsgBlock, filter *BlockFilter) types.BlockFilter {
+	return types.BlockFilter{
+		BlockHash:  block.BlockHash().String(),
+		FilterType: "basic",
+		Filter:     hex.EncodeToString(filter.Bytes()),
+		Header:     filter.Header(PrevFilterHeader).String(),
+		N:          filter.N,
+	}
+}
+
+// WriteBlockFiles writes everything needed to hand the mined block to other tooling: basePath.hex (raw block hex, for
+// submitblock), basePath.dat (the same bytes in binary), basePath.json (getblock verbosity 2 style),
+// basePath_summary.json and basePath_filter.json (its BIP158 basic filter). txData is as for SummarizeBlock
+func WriteBlockFiles(block *wire.MsgBlock, txData []types.TransactionData, basePath string) error {
+	blockBytes := SerializeBlock(block)
+	if err := os.WriteFile(basePath+".hex", []byte(hex.EncodeToString(blockBytes)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(basePath+".dat", blockBytes, 0644); err != nil {
+		return err
+	}
+	blockJSON, err := json.MarshalIndent(BlockToGetBlockResult(block, txData), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(basePath+".json", blockJSON, 0644); err != nil {
+		return err
+	}
+	summaryJSON, err := json.MarshalIndent(SummarizeBlock(block, txData), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(basePath+"_summary.json", summaryJSON, 0644); err != nil {
+		return err
+	}
+	filter, err := NewBasicFilter(block, txData)
+	if err != nil {
+		return err
+	}
+	filterJSON, err := json.MarshalIndent(BlockFilterResult(block, filter), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(basePath+"_filter.json", filterJSON, 0644)
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/blockchain"
+)
+
+var errSignatureFailed = errors.New("signature verification failed")
+
+// the built in transaction rules. these are the checks FullTxValidation has always done, split up so profiles can
+// pick and choose
+var (
+	StructureRule = NewRule("structure", ScopeTx, func(ctx *RuleContext) error {
+		if len(ctx.Tx.Vin) == 0 {
+			return errors.New("no inputs")
+		}
+		if len(ctx.Tx.Vout) == 0 {
+			return errors.New("no outputs")
+		}
+		return nil
+	})
+	TimelockRule = NewRule("timelock", ScopeTx, func(ctx *RuleContext) error {
+		if !ValidateTxTimeLock(*ctx.Tx) {
+			return fmt.Errorf("locktime %d is not final", ctx.Tx.Locktime)
+		}
+		return nil
+	})
+	HashesRule = NewRule("hashes", ScopeTx, func(ctx *RuleContext) error {
+		if !ValidateTxHashes(*ctx.Tx) {
+			return errors.New("a pubkey or script doesn't hash to what its prevout commits to")
+		}
+		return nil
+	})
+	SignaturesRule = NewRule("signatures", ScopeInput, func(ctx *RuleContext) error {
+		if ctx.deferSchnorr && InputType(ctx.Tx.Vin[ctx.InputIndex]) == script.P2TR {
+			sigs, err := TaprootSigs(*ctx.Tx, ctx.InputIndex, ctx.SigHashes())
+			if err != nil {
+				return err
+			}
+			ctx.deferred = append(ctx.deferred, sigs...)
+			return nil
+		}
+		if !VerifyTxInputSig(*ctx.Tx, ctx.InputIndex, ctx.SigHashes()) {
+			return errSignatureFailed
+		}
+		return nil
+	})
+	FeeRule = NewRule("fee", ScopeTx, func(ctx *RuleContext) error {
+		if fee := TxFee(*ctx.Tx); fee < 0 {
+			return fmt.Errorf("outputs spend %d more than the inputs", -fee)
+		}
+		return nil
+	})
+)
+
+// InputTypesRule is policy rather than consensus: it rejects transactions with any input spending an output type we
+// don't validate
+var InputTypesRule = NewRule("input-types", ScopeTx, func(ctx *RuleContext) error {
+	if len(ctx.Tx.Vin) == 0 {
+		return errors.New("no inputs")
+	}
+	for i, input := range ctx.Tx.Vin {
+		if inputType := InputType(input); !IsSupportedInputType(inputType) {
+			return fmt.Errorf("input %d %w: %s", i, ErrUnsupportedInputType, inputType)
+		}
+	}
+	return nil
+})
+
+// the json integrity rules, policy as well: validation only ever looks at the raw script hex, these reject a file
+// whose asm or declared script types lie about it
+var (
+	AsmRule = NewRule("asm", ScopeTx, func(ctx *RuleContext) error {
+		return CheckTxAsm(*ctx.Tx)
+	})
+	ScriptTypesRule = NewRule("script-types", ScopeTx, func(ctx *RuleContext) error {
+		return CheckTxScriptTypes(*ctx.Tx)
+	})
+)
+
+// the built in block rules, the checks CheckBlock runs on the block as a whole
+var (
+	CoinbaseRule = NewRule("coinbase", ScopeBlock, func(ctx *RuleContext) error {
+		if !blockchain.IsCoinBaseTx(ctx.Block.Transactions[0]) {
+			return errors.New("first transaction is not a coinbase")
+		}
+		for i, tx := range ctx.Block.Transactions[1:] {
+			if blockchain.IsCoinBaseTx(tx) {
+				return fmt.Errorf("tx %d (%s) is a second coinbase", i+1, tx.TxHash())
+			}
+		}
+		return nil
+	})
+	DoubleSpendRule = NewRule("block-double-spend", ScopeBlock, func(ctx *RuleContext) error {
+		spent := make(map[string]bool)
+		for i, tx := range ctx.Block.Transactions[1:] {
+			for _, txIn := range tx.TxIn {
+				outpoint := txIn.PreviousOutPoint.String()
+				if spent[outpoint] {
+					return fmt.Errorf("tx %d (%s) spends %s which is already spent in this block", i+1, tx.TxHash(), outpoint)
+				}
+				spent[outpoint] = true
+			}
+		}
+		return nil
+	})
+	MerkleRootRule = NewRule("merkle-root", ScopeBlock, func(ctx *RuleContext) error {
+		merkleRoot, mutated := TxIdMerkleRoot(ctx.Block.Transactions)
+		if mutated {
+			return ErrMutatedMerkleTree
+		}
+		if merkleRoot != ctx.Block.Header.MerkleRoot {
+			return fmt.Errorf("merkle root %s in header, computed %s", ctx.Block.Header.MerkleRoot, merkleRoot)
+		}
+		return nil
+	})
+	WitnessCommitmentRule = NewRule("witness-commitment", ScopeBlock, func(ctx *RuleContext) error {
+		return CheckWitnessCommitment(ctx.Block)
+	})
+	ProofOfWorkRule = NewRule("pow", ScopeBlock, func(ctx *RuleContext) error {
+		blockHash := ctx.Block.BlockHash()
+		if blockchain.HashToBig(&blockHash).Cmp(blockchain.CompactToBig(ctx.Block.Header.Bits)) > 0 {
+			return fmt.Errorf("block hash %s is above the target for bits %08x", blockHash, ctx.Block.Header.Bits)
+		}
+		return nil
+	})
+	BlockWeightRule = NewRule("block-weight", ScopeBlock, func(ctx *RuleContext) error {
+		weight := ctx.Block.SerializeSizeStripped()*3 + ctx.Block.SerializeSize()
+		if weight > MaxBlockWeight {
+			return fmt.Errorf("block weight %d is over %d", weight, MaxBlockWeight)
+		}
+		return nil
+	})
+	BlockSigOpsRule = NewRule("block-sigops", ScopeBlock, func(ctx *RuleContext) error {
+		sigOpCost := 0
+		for _, transaction := range ctx.BlockTxs {
+			sigOpCost += TxSigOpCost(transaction)
+		}
+		if sigOpCost > MaxBlockSigOpCost {
+			return fmt.Errorf("block sigop cost %d is over %d", sigOpCost, MaxBlockSigOpCost)
+		}
+		return nil
+	})
+	CoinbaseValueRule = NewRule("coinbase-value", ScopeBlock, func(ctx *RuleContext) error {
+		totalFees := 0
+		for _, transaction := range ctx.BlockTxs[1:] {
+			totalFees += TxFee(transaction)
+		}
+		coinbaseValue := 0
+		for _, txOut := range ctx.Block.Transactions[0].TxOut {
+			coinbaseValue += int(txOut.Value)
+		}
+		if coinbaseValue > BlockSubsidy()+totalFees {
+			return fmt.Errorf("coinbase pays %d, more than the subsidy %d plus fees %d", coinbaseValue, BlockSubsidy(), totalFees)
+		}
+		return nil
+	})
+)
+
+// the built in profiles. consensus is what a block has to satisfy, default is what we apply when picking
+// transactions for our own blocks
+var (
+	ConsensusProfile = NewProfile("consensus",
+		StructureRule, TimelockRule, HashesRule, SignaturesRule, FeeRule,
+		CoinbaseRule, DoubleSpendRule, MerkleRootRule, WitnessCommitmentRule,
+		ProofOfWorkRule, BlockWeightRule, BlockSigOpsRule, CoinbaseValueRule)
+	DefaultProfile = ConsensusProfile.With("default", InputTypesRule, AsmRule, ScriptTypesRule)
+)
+
+func init() {
+	for _, rule := range append(ConsensusProfile.Rules(), InputTypesRule, AsmRule, ScriptTypesRule) {
+		if err := RegisterRule(rule); err != nil {
+			panic(err)
+		}
+	}
+	for _, profile := range []*Profile{ConsensusProfile, DefaultProfile} {
+		if err := RegisterProfile(profile); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// NewExcludeAddressesRule returns a business rule rejecting any transaction that pays to or spends from one of the
+// given addresses. it isn't registered since it needs the addresses, add it to a profile with Profile.With
+func NewExcludeAddressesRule(addresses ...string) Rule {
+	excluded := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		if address != "" {
+			excluded[address] = true
+		}
+	}
+	// the address is always worked out from the script, a file's scriptpubkey_address could say anything
+	outputAddress := func(output types.TransactionVout) string {
+		scriptPubKey, _ := hex.DecodeString(output.ScriptPubKey)
+		return ScriptAddress(scriptPubKey)
+	}
+	return NewRule("exclude-addresses", ScopeTx, func(ctx *RuleContext) error {
+		for i, input := range ctx.Tx.Vin {
+			if address := outputAddress(input.Prevout); excluded[address] {
+				return fmt.Errorf("input %d spends from excluded address %s", i, address)
+			}
+		}
+		for i, output := range ctx.Tx.Vout {
+			if address := outputAddress(output); excluded[address] {
+				return fmt.Errorf("output %d pays to excluded address %s", i, address)
+			}
+		}
+		return nil
+	})
+}
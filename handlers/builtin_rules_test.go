@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+func TestExcludeAddressesRule(t *testing.T) {
+	transaction, _ := validSpend(t, script.P2WPKH)
+	scriptPubKey, _ := hex.DecodeString(transaction.Vout[0].ScriptPubKey)
+	address := ScriptAddress(scriptPubKey)
+	if address == "" {
+		t.Skipf("%s output 0 has no address", transaction.TxID)
+	}
+	profile := NewProfile("exclude", NewExcludeAddressesRule(address))
+	if err := profile.CheckTx(transaction); err == nil {
+		t.Errorf("paying to excluded %s passes", address)
+	}
+
+	// the json claiming some other address doesn't get the output past the rule
+	lying := transaction
+	lying.Vout = append([]types.TransactionVout(nil), transaction.Vout...)
+	lying.Vout[0].ScriptPubKeyAddress = "bc1qnotthisaddress"
+	if err := profile.CheckTx(lying); err == nil {
+		t.Errorf("paying to excluded %s passes when the json names another address", address)
+	}
+
+	if err := NewProfile("exclude", NewExcludeAddressesRule("bc1qnotthisaddress")).CheckTx(lying); err != nil {
+		t.Errorf("excluding only the address the json claims: %v", err)
+	}
+}
+
+func TestInputTypesRuleChecksEveryInput(t *testing.T) {
+	transaction, _ := validSpend(t, script.P2WPKH)
+	profile := NewProfile("input-types", InputTypesRule)
+	if err := profile.CheckTx(transaction); err != nil {
+		t.Fatalf("%s: %v", transaction.TxID, err)
+	}
+	// a bare multisig input after a supported first one
+	unsupported := transaction
+	unsupported.Vin = append(append([]types.TransactionVin(nil), transaction.Vin...), transaction.Vin[0])
+	last := len(unsupported.Vin) - 1
+	unsupported.Vin[last].Prevout.ScriptPubKey = "5121" + "02" + strings.Repeat("11", 32) + "51ae"
+	err := profile.CheckTx(unsupported)
+	if !errors.Is(err, ErrUnsupportedInputType) {
+		t.Fatalf("unsupported last input: %v", err)
+	}
+	if want := fmt.Sprintf("input %d ", last); !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q doesn't name input %d", err, last)
+	}
+}
+
+func TestJSONIntegrityRules(t *testing.T) {
+	transaction, _ := validSpend(t, script.P2WPKH)
+	if err := DefaultProfile.CheckTx(transaction); err != nil {
+		t.Fatalf("%s: %v", transaction.TxID, err)
+	}
+
+	lyingAsm := transaction
+	lyingAsm.Vout = append([]types.TransactionVout(nil), transaction.Vout...)
+	lyingAsm.Vout[0].ScriptPubKeyAsm = "OP_RETURN"
+	if err := DefaultProfile.CheckTx(lyingAsm); !errors.Is(err, ErrAsmMismatch) {
+		t.Errorf("output asm that doesn't match its script: %v", err)
+	}
+
+	lyingType := transaction
+	lyingType.Vin = append([]types.TransactionVin(nil), transaction.Vin...)
+	lyingType.Vin[0].Prevout.ScriptPubKeyType = "p2pkh"
+	if err := DefaultProfile.CheckTx(lyingType); !errors.Is(err, ErrScriptTypeMismatch) {
+		t.Errorf("prevout declared as the wrong type: %v", err)
+	}
+
+	// the consensus profile only looks at the scripts themselves
+	if err := ConsensusProfile.CheckTx(lyingAsm); err != nil {
+		t.Errorf("consensus profile rejects a lying asm field: %v", err)
+	}
+}
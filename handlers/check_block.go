@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// MaxBlockSigOpCost is the consensus limit on the weighted sigop cost of a block
+const MaxBlockSigOpCost = 80000
+
+// BlockSubsidy returns the block reward (without fees) for the height we are mining at
+func BlockSubsidy() int {
+	return int(blockchain.CalcBlockSubsidy(int32(BlockHeight), NetParams))
+}
+
+// CheckBlock checks a block against the consensus profile, see CheckBlockWithProfile
+func CheckBlock(block *wire.MsgBlock, utxos UTXOSet) []error {
+	return CheckBlockWithProfile(block, utxos, ConsensusProfile)
+}
+
+// CheckBlockWithProfile runs a profile's block rules against a block, and its tx and input rules against every non
+// coinbase transaction in it. utxos is the set the block connects to (see NewConfirmedUTXOSet) and is updated the way
+// connecting the block would: each transaction's prevouts are looked up and taken out, then its outputs put in, so a
+// transaction can only spend what's confirmed or created earlier in the block, and only once. it returns every
+// problem it finds rather than stopping at the first
+func CheckBlockWithProfile(block *wire.MsgBlock, utxos UTXOSet, profile *Profile) []error {
+	if len(block.Transactions) == 0 {
+		return []error{fmt.Errorf("block has no transactions")}
+	}
+	var errs []error
+	blockTxs := make([]types.TransactionData, len(block.Transactions))
+	resolved := make([]bool, len(block.Transactions))
+	blockTxs[0] = MsgTxToTransactionData(block.Transactions[0])
+	for i, tx := range block.Transactions[1:] {
+		transaction := MsgTxToTransactionData(tx)
+		err := utxos.ResolvePrevouts(&transaction)
+		if err == nil {
+			err = utxos.SpendInputs(transaction)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tx %d (%s): %v", i+1, transaction.TxID, err))
+		} else {
+			resolved[i+1] = true
+			utxos.AddTxOutputs(transaction)
+		}
+		blockTxs[i+1] = transaction
+	}
+	errs = append(errs, profile.CheckBlockRules(block, blockTxs)...)
+	var sigs []SchnorrSig
+	var sigTxs []int
+	for i, transaction := range blockTxs[1:] {
+		if !resolved[i+1] {
+			continue
+		}
+		if !BatchSchnorr {
+			if err := profile.CheckTx(transaction); err != nil {
+				errs = append(errs, fmt.Errorf("tx %d (%s): %v", i+1, transaction.TxID, err))
+			}
+			continue
+		}
+		txSigs, err := profile.CheckTxDeferred(transaction)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tx %d (%s): %v", i+1, transaction.TxID, err))
+			continue
+		}
+		for _, sig := range txSigs {
+			sigs = append(sigs, sig)
+			sigTxs = append(sigTxs, i+1)
+		}
+	}
+	// with BatchSchnorr the whole block's taproot signatures are checked together
+	for j, valid := range VerifySchnorrSigs(sigs, ValidationWorkers) {
+		if !valid {
+			err := &RuleError{Rule: SignaturesRule.Name(), Input: sigs[j].InputIndex, Err: errSignatureFailed}
+			errs = append(errs, fmt.Errorf("tx %d (%s): %v", sigTxs[j], blockTxs[sigTxs[j]].TxID, err))
+		}
+	}
+	return errs
+}
+
+// LoadBlockFile reads a full block, either raw binary (e.g the .dat WriteBlockFiles writes) or hex
+func LoadBlockFile(path string) (*wire.MsgBlock, error) {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if blockBytes, err := hex.DecodeString(strings.TrimSpace(string(fileBytes))); err == nil {
+		fileBytes = blockBytes
+	}
+	block := new(wire.MsgBlock)
+	if err := block.Deserialize(bytes.NewReader(fileBytes)); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return block, nil
+}
+
+// LoadOutputFile rebuilds a block from an output.txt (header, coinbase, then txids with the coinbase's first),
+// taking the transactions the txids refer to from the mempool
+func LoadOutputFile(path string, transactions []types.TransactionData) (*wire.MsgBlock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("%s: want a header, a coinbase and at least the coinbase txid, got %d lines", path, len(lines))
+	}
+
+	headerBytes, err := hex.DecodeString(lines[0])
+	if err != nil || len(headerBytes) != wire.MaxBlockHeaderPayload {
+		return nil, fmt.Errorf("%s: line 1 is not an 80 byte hex header", path)
+	}
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(headerBytes)); err != nil {
+		return nil, err
+	}
+	_, coinbaseTx, err := DecodeRawTx(lines[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: line 2 is not a transaction: %v", path, err)
+	}
+	if coinbaseTxId := coinbaseTx.TxHash(); coinbaseTxId.String() != lines[2] {
+		return nil, fmt.Errorf("%s: first txid %s is not the coinbase's %s", path, lines[2], coinbaseTxId)
+	}
+
+	mempoolTxs := make(map[string]types.TransactionData, len(transactions))
+	for _, transaction := range transactions {
+		mempoolTxs[transaction.TxID] = transaction
+	}
+	block := wire.NewMsgBlock(&header)
+	block.AddTransaction(coinbaseTx)
+	for _, txId := range lines[3:] {
+		transaction, ok := mempoolTxs[txId]
+		if !ok {
+			return nil, fmt.Errorf("%s: txid %s is not in the mempool", path, txId)
+		}
+		tx, err := TransactionDataToMsgTx(transaction)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", txId, err)
+		}
+		block.AddTransaction(tx)
+	}
+	return block, nil
+}
@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// CompactBlockVersion is the BIP152 version we speak, 2, where short ids are taken from wtxids
+const CompactBlockVersion = 2
+
+// shortIDSize is how many bytes of the siphash a short txid keeps
+const shortIDSize = 6
+
+// maxCompactBlockTxs bounds the transaction counts we read, so a bad message can't make us allocate without limit
+const maxCompactBlockTxs = wire.MaxBlockPayload / 10
+
+// CompactBlock is a BIP152 cmpctblock: the header, then a 6 byte short id for every transaction the receiver is
+// expected to have in its mempool and the full transactions it's not, the coinbase at least
+type CompactBlock struct {
+	Header    wire.BlockHeader
+	Nonce     uint64
+	ShortIDs  []uint64
+	Prefilled []PrefilledTx
+}
+
+// PrefilledTx is a transaction sent in full in a cmpctblock, with its index in the block
+type PrefilledTx struct {
+	Index int
+	Tx    *wire.MsgTx
+}
+
+// GetBlockTxn is a BIP152 getblocktxn, asking for the transactions at the given block indexes
+type GetBlockTxn struct {
+	BlockHash chainhash.Hash
+	Indexes   []int
+}
+
+// BlockTxn is a BIP152 blocktxn, the answer to a getblocktxn
+type BlockTxn struct {
+	BlockHash chainhash.Hash
+	Txs       []*wire.MsgTx
+}
+
+// NewCompactBlock encodes a block for relay, prefilling the coinbase (which no mempool has) and giving every other
+// transaction as a short id
+func NewCompactBlock(block *wire.MsgBlock, nonce uint64) *CompactBlock {
+	compact := &CompactBlock{
+		Header:    block.Header,
+		Nonce:     nonce,
+		Prefilled: []PrefilledTx{{Index: 0, Tx: block.Transactions[0]}},
+	}
+	k0, k1 := compact.sipKeys()
+	for _, tx := range block.Transactions[1:] {
+		compact.ShortIDs = append(compact.ShortIDs, shortTxID(k0, k1, tx.WitnessHash()))
+	}
+	return compact
+}
+
+// sipKeys derives the siphash key for the block's short ids from the single sha256 of the header and nonce
+func (c *CompactBlock) sipKeys() (uint64, uint64) {
+	var buf bytes.Buffer
+	c.Header.Serialize(&buf)
+	binary.Write(&buf, binary.LittleEndian, c.Nonce)
+	keyHash := sha256.Sum256(buf.Bytes())
+	return binary.LittleEndian.Uint64(keyHash[:8]), binary.LittleEndian.Uint64(keyHash[8:16])
+}
+
+// ShortTxID returns the short id a wtxid has in this compact block
+func (c *CompactBlock) ShortTxID(wtxid chainhash.Hash) uint64 {
+	k0, k1 := c.sipKeys()
+	return shortTxID(k0, k1, wtxid)
+}
+
+func shortTxID(k0, k1 uint64, wtxid chainhash.Hash) uint64 {
+	return SipHash24(k0, k1, wtxid[:]) & (1<<(8*shortIDSize) - 1)
+}
+
+// TxCount is the number of transactions in the block
+func (c *CompactBlock) TxCount() int {
+	return len(c.ShortIDs) + len(c.Prefilled)
+}
+
+// Serialize writes the cmpctblock payload. prefilled indexes go on the wire as the difference from the previous
+// one, less one
+func (c *CompactBlock) Serialize(w io.Writer) error {
+	if err := c.Header.Serialize(w); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, c.Nonce); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(len(c.ShortIDs))); err != nil {
+		return err
+	}
+	var shortID [8]byte
+	for _, id := range c.ShortIDs {
+		binary.LittleEndian.PutUint64(shortID[:], id)
+		if _, err := w.Write(shortID[:shortIDSize]); err != nil {
+			return err
+		}
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(len(c.Prefilled))); err != nil {
+		return err
+	}
+	last := -1
+	for _, prefilled := range c.Prefilled {
+		if err := wire.WriteVarInt(w, 0, uint64(prefilled.Index-last-1)); err != nil {
+			return err
+		}
+		last = prefilled.Index
+		if err := prefilled.Tx.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bytes returns the serialized cmpctblock payload
+func (c *CompactBlock) Bytes() []byte {
+	var buf bytes.Buffer
+	c.Serialize(&buf)
+	return buf.Bytes()
+}
+
+// Deserialize reads a cmpctblock payload
+func (c *CompactBlock) Deserialize(r io.Reader) error {
+	if err := c.Header.Deserialize(r); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &c.Nonce); err != nil {
+		return err
+	}
+	count, err := readCount(r)
+	if err != nil {
+		return fmt.Errorf("short id count: %v", err)
+	}
+	c.ShortIDs = make([]uint64, count)
+	var shortID [8]byte
+	for i := range c.ShortIDs {
+		if _, err := io.ReadFull(r, shortID[:shortIDSize]); err != nil {
+			return err
+		}
+		c.ShortIDs[i] = binary.LittleEndian.Uint64(shortID[:])
+	}
+	count, err = readCount(r)
+	if err != nil {
+		return fmt.Errorf("prefilled count: %v", err)
+	}
+	c.Prefilled = make([]PrefilledTx, count)
+	last := -1
+	for i := range c.Prefilled {
+		delta, err := readCount(r)
+		if err != nil {
+			return fmt.Errorf("prefilled tx %d index: %v", i, err)
+		}
+		index := last + 1 + delta
+		if index >= maxCompactBlockTxs {
+			return fmt.Errorf("prefilled tx %d index %d is out of range", i, index)
+		}
+		tx := new(wire.MsgTx)
+		if err := tx.Deserialize(r); err != nil {
+			return fmt.Errorf("prefilled tx %d: %v", i, err)
+		}
+		c.Prefilled[i] = PrefilledTx{Index: index, Tx: tx}
+		last = index
+	}
+	return nil
+}
+
+// readCount reads a compact size count, refusing anything no block could have
+func readCount(r io.Reader) (int, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return 0, err
+	}
+	if count > maxCompactBlockTxs {
+		return 0, fmt.Errorf("count %d is more than a block can have", count)
+	}
+	return int(count), nil
+}
+
+// Serialize writes the getblocktxn payload, the indexes as differences like prefilled ones
+func (g *GetBlockTxn) Serialize(w io.Writer) error {
+	if _, err := w.Write(g.BlockHash[:]); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(len(g.Indexes))); err != nil {
+		return err
+	}
+	last := -1
+	for _, index := range g.Indexes {
+		if err := wire.WriteVarInt(w, 0, uint64(index-last-1)); err != nil {
+			return err
+		}
+		last = index
+	}
+	return nil
+}
+
+// Deserialize reads a getblocktxn payload
+func (g *GetBlockTxn) Deserialize(r io.Reader) error {
+	if _, err := io.ReadFull(r, g.BlockHash[:]); err != nil {
+		return err
+	}
+	count, err := readCount(r)
+	if err != nil {
+		return err
+	}
+	g.Indexes = make([]int, count)
+	last := -1
+	for i := range g.Indexes {
+		delta, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		g.Indexes[i] = last + 1 + delta
+		last = g.Indexes[i]
+	}
+	return nil
+}
+
+// Serialize writes the blocktxn payload
+func (b *BlockTxn) Serialize(w io.Writer) error {
+	if _, err := w.Write(b.BlockHash[:]); err != nil {
+		return err
+	}
+	if err := wire.WriteVarInt(w, 0, uint64(len(b.Txs))); err != nil {
+		return err
+	}
+	for _, tx := range b.Txs {
+		if err := tx.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize reads a blocktxn payload
+func (b *BlockTxn) Deserialize(r io.Reader) error {
+	if _, err := io.ReadFull(r, b.BlockHash[:]); err != nil {
+		return err
+	}
+	count, err := readCount(r)
+	if err != nil {
+		return err
+	}
+	b.Txs = make([]*wire.MsgTx, count)
+	for i := range b.Txs {
+		b.Txs[i] = new(wire.MsgTx)
+		if err := b.Txs[i].Deserialize(r); err != nil {
+			return fmt.Errorf("tx %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// RespondBlockTxn answers a getblocktxn for a block we have
+func RespondBlockTxn(block *wire.MsgBlock, request *GetBlockTxn) (*BlockTxn, error) {
+	if request.BlockHash != block.BlockHash() {
+		return nil, fmt.Errorf("getblocktxn for block %s, we have %s", request.BlockHash, block.BlockHash())
+	}
+	response := &BlockTxn{BlockHash: request.BlockHash}
+	for _, index := range request.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			return nil, fmt.Errorf("getblocktxn index %d is out of range for %d txs", index, len(block.Transactions))
+		}
+		response.Txs = append(response.Txs, block.Transactions[index])
+	}
+	return response, nil
+}
+
+// ErrShortIDCollision is returned when two transactions of a compact block share a short id, which leaves the
+// receiver no way to tell them apart, so the full block has to be asked for instead
+var ErrShortIDCollision = errors.New("compact block has two transactions with the same short id")
+
+// PartialBlock is a compact block being reconstructed on the receiving side: the prefilled transactions and those
+// found in the mempool by short id are in place, and Missing says which ones have to be asked for
+type PartialBlock struct {
+	compact *CompactBlock
+	txs     []*wire.MsgTx
+	// FromMempool counts the transactions found in the mempool, Collisions the short ids that matched more than one
+	// mempool transaction, which are then asked for rather than guessed
+	FromMempool int
+	Collisions  int
+}
+
+// NewPartialBlock starts reconstructing a compact block from the transactions in a mempool
+func NewPartialBlock(compact *CompactBlock, mempool []*wire.MsgTx) (*PartialBlock, error) {
+	if compact.TxCount() == 0 || compact.TxCount() > maxCompactBlockTxs {
+		return nil, fmt.Errorf("compact block with %d txs", compact.TxCount())
+	}
+	partial := &PartialBlock{compact: compact, txs: make([]*wire.MsgTx, compact.TxCount())}
+	for _, prefilled := range compact.Prefilled {
+		if prefilled.Index >= len(partial.txs) {
+			return nil, fmt.Errorf("prefilled tx index %d is out of range for %d txs", prefilled.Index, len(partial.txs))
+		}
+		partial.txs[prefilled.Index] = prefilled.Tx
+	}
+	// the short ids are in block order over the slots the prefilled txs leave free
+	slots := make(map[uint64]int, len(compact.ShortIDs))
+	next := 0
+	for _, id := range compact.ShortIDs {
+		for partial.txs[next] != nil {
+			next++
+		}
+		if _, exists := slots[id]; exists {
+			return nil, ErrShortIDCollision
+		}
+		slots[id] = next
+		next++
+	}
+	k0, k1 := compact.sipKeys()
+	collided := map[int]bool{}
+	for _, tx := range mempool {
+		wtxid := tx.WitnessHash()
+		slot, ok := slots[shortTxID(k0, k1, wtxid)]
+		if !ok || collided[slot] {
+			continue
+		}
+		if partial.txs[slot] != nil {
+			if partial.txs[slot].WitnessHash() == wtxid {
+				continue
+			}
+			partial.txs[slot] = nil
+			collided[slot] = true
+			partial.FromMempool--
+			partial.Collisions++
+			continue
+		}
+		partial.txs[slot] = tx
+		partial.FromMempool++
+	}
+	return partial, nil
+}
+
+// Missing returns the getblocktxn asking for the transactions the mempool didn't have, nil if it had all of them
+func (p *PartialBlock) Missing() *GetBlockTxn {
+	var request *GetBlockTxn
+	for i, tx := range p.txs {
+		if tx != nil {
+			continue
+		}
+		if request == nil {
+			request = &GetBlockTxn{BlockHash: p.compact.Header.BlockHash()}
+		}
+		request.Indexes = append(request.Indexes, i)
+	}
+	return request
+}
+
+// Fill completes the block with the blocktxn answering Missing (nil if nothing was missing) and checks it against
+// the header's merkle root and the coinbase's witness commitment. a failure means a short id matched the wrong
+// mempool transaction, and the full block has to be asked for
+func (p *PartialBlock) Fill(response *BlockTxn) (*wire.MsgBlock, error) {
+	request := p.Missing()
+	if request != nil {
+		if response == nil || response.BlockHash != request.BlockHash {
+			return nil, errors.New("no blocktxn for the missing transactions")
+		}
+		if len(response.Txs) != len(request.Indexes) {
+			return nil, fmt.Errorf("blocktxn has %d txs, %d were asked for", len(response.Txs), len(request.Indexes))
+		}
+		for i, index := range request.Indexes {
+			p.txs[index] = response.Txs[i]
+		}
+	}
+	block := wire.NewMsgBlock(&p.compact.Header)
+	for _, tx := range p.txs {
+		block.AddTransaction(tx)
+	}
+	merkleRoot, mutated := TxIdMerkleRoot(block.Transactions)
+	if mutated {
+		return nil, ErrMutatedMerkleTree
+	}
+	if merkleRoot != block.Header.MerkleRoot {
+		return nil, fmt.Errorf("reconstructed block has merkle root %s, the header %s", merkleRoot, block.Header.MerkleRoot)
+	}
+	if err := CheckWitnessCommitment(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
@@ -11,12 +11,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 )
 
+// OutputFile is where WriteOutputToFile writes the mined block's header, coinbase and txids
+var OutputFile = "output.txt"
+
 func CreateBlockHeader(merkleRootHash *chainhash.Hash) *wire.BlockHeader {
-	prevBlockHash := GetHashFromStr("00000000000000000000a9c619c4af8c09f10c11a8262bcde576450e45a126ca")
+	prevBlockHash := GetHashFromStr(PrevBlockHash)
 	merkleRoot := merkleRootHash
 	target := "0000ffff00000000000000000000000000000000000000000000000000000000"
 	targetBytes, _ := hex.DecodeString(target)
@@ -82,76 +86,23 @@ func ParseBlock(txs []*wire.MsgTx, coinbaseTx *wire.MsgTx) *wire.MsgBlock {
 
 }
 
+// CreateMerkleTree returns the merkle root of coinbaseTx followed by txs, or of their wtxids (the coinbase's counting
+// as zero) if isWTxId is set. see MerkleRoot
 func CreateMerkleTree(txs []*wire.MsgTx, isWTxId bool, coinbaseTx *wire.MsgTx) (*chainhash.Hash, error) {
-	var coinbaseBy bytes.Buffer
-	coinbaseTx.Serialize(&coinbaseBy)
-	coinbaseTxHash := coinbaseTx.TxHash()
-	coinbaseWTxId := fmt.Sprintf("%016x", 0)
-	coinbaseWTxIdHash, _ := chainhash.NewHashFromStr(coinbaseWTxId)
-	var hashes []*chainhash.Hash
+	blockTxs := append([]*wire.MsgTx{coinbaseTx}, txs...)
 	if isWTxId {
-		hashes = append(hashes, coinbaseWTxIdHash)
-	} else {
-		hashes = append(hashes, &coinbaseTxHash)
-	}
-
-	for _, tx := range txs {
-		hash := tx.TxHash()
-		hashes = append(hashes, &hash)
-	}
-
-	// Construct the Merkle tree
-	for len(hashes) > 1 {
-		if len(hashes)%2 != 0 {
-			hashes = append(hashes, hashes[len(hashes)-1])
-		}
-
-		var newHashes []*chainhash.Hash
-		for i := 0; i < len(hashes); i += 2 {
-			// for some reason, when i change this to chainhash.DoubleHashH , it gives a different/wrong hash
-			merkleRootTxHash := chainhash.DoubleHashH(append(hashes[i][:], hashes[i+1][:]...))
-			newHashes = append(newHashes, &merkleRootTxHash)
-		}
-
-		hashes = newHashes
+		merkleRoot, _ := WitnessMerkleRoot(blockTxs)
+		fmt.Println("Witness Merkle Root: ", merkleRoot.String())
+		return &merkleRoot, nil
 	}
-	fmt.Println("Merkle Root: ", hashes[0].String())
-	return hashes[0], nil
+	merkleRoot, _ := TxIdMerkleRoot(blockTxs)
+	fmt.Println("Merkle Root: ", merkleRoot.String())
+	return &merkleRoot, nil
 }
 
+// CreateWitnessMerkleTree returns the wtxid merkle root of a block whose non coinbase transactions are txs
 func CreateWitnessMerkleTree(txs []*wire.MsgTx) (*chainhash.Hash, error) {
-	coinbaseWTxId := "0000000000000000000000000000000000000000000000000000000000000000"
-	coinbaseWTxIdHash, _ := chainhash.NewHashFromStr(coinbaseWTxId)
-	var hashes []*chainhash.Hash
-	hashes = append(hashes, coinbaseWTxIdHash)
-
-	for _, tx := range txs {
-		var txBytes bytes.Buffer
-		tx.Serialize(&txBytes)
-		hash := chainhash.DoubleHashB(txBytes.Bytes())
-		hashRev, revHashErr := chainhash.NewHashFromStr(ReverseBytesFromHexStr(hex.EncodeToString(hash)))
-		if revHashErr != nil {
-			fmt.Println("Error reversing hash: ", revHashErr)
-		}
-		hashes = append(hashes, hashRev)
-	}
-	// Construct the Merkle tree
-	for len(hashes) > 1 {
-		if len(hashes)%2 != 0 {
-			hashes = append(hashes, hashes[len(hashes)-1])
-		}
-
-		var newHashes []*chainhash.Hash
-		for i := 0; i < len(hashes); i += 2 {
-			hash := chainhash.DoubleHashH(append(hashes[i][:], hashes[i+1][:]...))
-			// hashHash, _ := chainhash.NewHashFromStr(hex.EncodeToString(hash))
-			newHashes = append(newHashes, &hash)
-		}
-
-		hashes = newHashes
-	}
-	fmt.Println("Witness Merkle Root: ", hashes[0].String())
-	return hashes[0], nil
+	return CreateMerkleTree(txs, true, nil)
 }
 
 func SerializedBlockTxs(validTxs []string) string {
@@ -167,61 +118,65 @@ func GetHashFromStr(s string) *chainhash.Hash {
 	return hash
 }
 
-func VerifyBlock(txs []*wire.MsgTx, updatedCoinbaseTx *wire.MsgTx, totalTxSizeWitWitnesses int) {
+// VerifyBlock mines the block (searches for a nonce that meets the target), writes output.txt and returns the mined block
+func VerifyBlock(txs []*wire.MsgTx, updatedCoinbaseTx *wire.MsgTx, totalTxSizeWitWitnesses int) *wire.MsgBlock {
 	block := ParseBlock(txs, updatedCoinbaseTx)
-	blockMined := false
-	nonceElapsed := false
-	var currNonce uint32
-	if currNonce < wire.MaxTxInSequenceNum {
-		currNonce++
-	} else {
-		nonceElapsed = true
-		currNonce = 0
+	if block == nil {
+		return nil
 	}
-	coinbaseTx := block.Transactions[0]
-	txIdsInBlock := make([]string, 0)
 	txTotalSize := 0
 	for _, tx := range block.Transactions {
-		txIdHash := tx.TxHash()
 		txTotalSize += tx.SerializeSize()
-		txIdsInBlock = append(txIdsInBlock, txIdHash.String())
 	}
 	blockWeightUnits := 320 + (txTotalSize * 3) + totalTxSizeWitWitnesses
 	fmt.Println("total tx size w/0 wit:", txTotalSize, "totoal tx size w wit: ", totalTxSizeWitWitnesses, "Full block weight units: ", blockWeightUnits)
-	for !blockMined {
-		var blockHeader *wire.BlockHeader
-		if nonceElapsed {
-			blockHeader = ModBlockHeaderForMining(&block.Header, currNonce, true)
-		} else {
-			blockHeader = ModBlockHeaderForMining(&block.Header, currNonce, false)
-		}
+	SolveBlock(block)
+	WriteBlockOutput(block)
+	return block
+}
 
-		headerHash := block.BlockHash()
-		headerHashBytes, _ := hex.DecodeString(headerHash.String())
-		hashInt := new(big.Int).SetBytes(headerHashBytes)
+// SolveBlock searches for a nonce that puts the block hash at or below the target in its bits. when every nonce has
+// been tried the timestamp is bumped and the search starts over, so it only returns once the block is mined
+func SolveBlock(block *wire.MsgBlock) {
+	SolveBlockUntil(block, nil)
+}
 
-		// Convert the target to its compact representation
-		compactTarget := blockHeader.Bits
-		serializedBlockHeader := SerializeWireBlockHeader(blockHeader)
-		compactHash := HexToCompactHex(hashInt)
-		var coinbaseBytesBuf bytes.Buffer
-		coinbaseTxSerializeErr := coinbaseTx.Serialize(&coinbaseBytesBuf)
-		if coinbaseTxSerializeErr != nil {
-			fmt.Println("Error serializing coinbase tx: ", coinbaseTxSerializeErr)
-			return
+// SolveBlockUntil is SolveBlock that gives up when stop is closed, e.g because a better template came along. it
+// reports whether the block was mined
+func SolveBlockUntil(block *wire.MsgBlock, stop <-chan struct{}) bool {
+	target := blockchain.CompactToBig(block.Header.Bits)
+	currNonce := uint32(1)
+	for {
+		// checking the channel every nonce would cost more than hashing
+		if stop != nil && currNonce&0xffff == 0 {
+			select {
+			case <-stop:
+				return false
+			default:
+			}
 		}
-		coinbaseTxSerialized := hex.EncodeToString(coinbaseBytesBuf.Bytes())
-		if compactHash <= compactTarget {
+		blockHeader := ModBlockHeaderForMining(&block.Header, currNonce, currNonce == 0)
+		headerHash := blockHeader.BlockHash()
+		if blockchain.HashToBig(&headerHash).Cmp(target) <= 0 {
 			fmt.Println("Block found with hash: ", headerHash.String())
-			fmt.Println("Block successfully mined! with hash:", compactHash, "nonce used: ", currNonce)
-			WriteOutputToFile(hex.EncodeToString(serializedBlockHeader), coinbaseTxSerialized, txIdsInBlock)
-			break
-		} else {
-			currNonce++
-			// fmt.Println("\\/\\/\\/Not mined. Cur Nonce: .", currNonce, "Target: ", blockHeader.Bits, "Hash: ", compactHash, "/\\/\\/\\")
+			fmt.Println("Block successfully mined! with hash:", HexToCompactHex(blockchain.HashToBig(&headerHash)), "nonce used: ", currNonce)
+			return true
 		}
+		// wraps around to 0 after MaxUint32, which is when the timestamp gets modified
+		currNonce++
 	}
+}
 
+// WriteBlockOutput writes a mined block to output.txt: the header, the coinbase and then the txids in block order
+func WriteBlockOutput(block *wire.MsgBlock) {
+	txIdsInBlock := make([]string, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		txIdHash := tx.TxHash()
+		txIdsInBlock = append(txIdsInBlock, txIdHash.String())
+	}
+	serializedBlockHeader := SerializeWireBlockHeader(&block.Header)
+	coinbaseTxSerialized := hex.EncodeToString(SerializeWireMsgTx(block.Transactions[0]))
+	WriteOutputToFile(hex.EncodeToString(serializedBlockHeader), coinbaseTxSerialized, txIdsInBlock)
 }
 
 func Uint32ToBigInt(value uint32) *big.Int {
@@ -269,7 +224,7 @@ func WriteOutputToFile(blockHeader string, serializedCoinbaseTx string, txIds []
 	}
 	data := []byte(val)
 
-	err := os.WriteFile("output.txt", data, 0644)
+	err := os.WriteFile(OutputFile, data, 0644)
 
 	if err != nil {
 		log.Fatal(err)
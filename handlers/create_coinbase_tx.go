@@ -31,38 +31,16 @@ func CreateCoinbaseTx() (*wire.MsgTx, types.TransactionData) {
 	txIn.Sequence = wire.MaxTxInSequenceNum
 	tx.AddTxIn(txIn)
 
-	outputAddr, _ := btcutil.DecodeAddress(Address, &chaincfg.MainNetParams)
-	output2ScriptPubKey, _ := txscript.PayToAddrScript(outputAddr)
+	// pay to the configured payout script, falling back to my own address
+	output2ScriptPubKey := PayoutScript
+	if output2ScriptPubKey == nil {
+		outputAddr, _ := btcutil.DecodeAddress(Address, &chaincfg.MainNetParams)
+		output2ScriptPubKey, _ = txscript.PayToAddrScript(outputAddr)
+	}
 	txOut := wire.NewTxOut(624000000, output2ScriptPubKey)
 	tx.AddTxOut(txOut)
-	hexEncoded := hex.EncodeToString(SerializeWireMsgTx(tx))
-	fileName := GetFileName(hexEncoded)
-	fileNameHex := hex.EncodeToString(fileName)
-	scriptPubKeyAsm, _ := txscript.DisasmString(output2ScriptPubKey)
-	transaction = types.TransactionData{
-		TxFilename: fileNameHex + ".json",
-		Version:    int(tx.Version),
-		Locktime:   int(tx.LockTime),
-		Vin: []types.TransactionVin{
-			{
-				TxID:         coinbaseVinTxid.String(),
-				Vout:         int(indexVal),
-				ScriptSig:    "",
-				ScriptSigAsm: "",
-				Sequence:     int(txIn.Sequence),
-				IsCoinbase:   true,
-			},
-		},
-		Vout: []types.TransactionVout{
-			{
-				ScriptPubKey:        hex.EncodeToString(output2ScriptPubKey),
-				ScriptPubKeyAsm:     scriptPubKeyAsm,
-				ScriptPubKeyType:    "p2pkh",
-				ScriptPubKeyAddress: Address,
-				Value:               int(txOut.Value),
-			},
-		},
-	}
+	// the TransactionData version is derived from the wire tx so the two can't drift apart
+	transaction = MsgTxToTransactionData(tx)
 	return tx, transaction
 }
 
@@ -72,6 +50,13 @@ func SerializeWireMsgTx(tx *wire.MsgTx) []byte {
 	return txBuf.Bytes()
 }
 
+// SerializeWireMsgTxNoWitness serializes a transaction in the legacy format, i.e what its txid commits to
+func SerializeWireMsgTxNoWitness(tx *wire.MsgTx) []byte {
+	var txBuf bytes.Buffer
+	tx.SerializeNoWitness(&txBuf)
+	return txBuf.Bytes()
+}
+
 func SerializeWireBlockHeader(tx *wire.BlockHeader) []byte {
 	var txBuf bytes.Buffer
 	tx.Serialize(&txBuf)
@@ -91,12 +76,9 @@ func PrintCoinbaseTx() ([]byte, string) {
 // create the coinbase commitment script
 func CreateCoinbaseCommittmentScript(txs []*wire.MsgTx) []byte {
 	witnessRootHash, _ := CreateWitnessMerkleTree(txs)
-	witnessRootHashRev, _ := chainhash.NewHashFromStr(ReverseBytesFromHexStr(witnessRootHash.String()))
 	witnessReservedValue := make([]byte, 32)
-	witnessRootHashBytes, _ := hex.DecodeString(witnessRootHashRev.String())
-	wTxIdCommitment := chainhash.DoubleHashH(append(witnessRootHashBytes, witnessReservedValue...))
-	wTxIdCommitmentRev := ReverseBytesFromHexStr(wTxIdCommitment.String())
-	wTxIdCommitmentHash, _ := hex.DecodeString(wTxIdCommitmentRev)
+	wTxIdCommitment := WitnessCommitmentHash(*witnessRootHash, witnessReservedValue)
+	wTxIdCommitmentHash := wTxIdCommitment[:]
 	prefixBytes, _ := hex.DecodeString("aa21a9ed")
 	commitmentScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData(append(prefixBytes, wTxIdCommitmentHash...)).Script()
 	if err != nil {
@@ -108,7 +90,7 @@ func CreateCoinbaseCommittmentScript(txs []*wire.MsgTx) []byte {
 // create the coinbase transaction signature script
 func createCoinbaseScriptSig() []byte {
 	// Convert block height to a byte slice
-	height := fmt.Sprintf("%06x", 838770)
+	height := fmt.Sprintf("%06x", BlockHeight)
 	heightBytes, _ := hex.DecodeString(height)
 	heightBytes = ReverseSlice(heightBytes)
 	scriptBuilder := txscript.NewScriptBuilder()
@@ -129,7 +111,9 @@ func CreateBtcAddress() string {
 }
 
 const (
-	Address = "17qdB4VXej7U4MWXF6HqoALVThA5Dsqy12"
-	PubKey  = "030b44daeef5e794cf44e4440a9a077fe27dc548fd1037cbf1408939bd84238275"
-	PrivKey = "f587103a6cdc2a2f60348d21513d1ba08b4970d29bb4af3ce5ad4c7e79bfa421"
+	BlockHeight   = 838770
+	PrevBlockHash = "00000000000000000000a9c619c4af8c09f10c11a8262bcde576450e45a126ca"
+	Address       = "17qdB4VXej7U4MWXF6HqoALVThA5Dsqy12"
+	PubKey        = "030b44daeef5e794cf44e4440a9a077fe27dc548fd1037cbf1408939bd84238275"
+	PrivKey       = "f587103a6cdc2a2f60348d21513d1ba08b4970d29bb4af3ce5ad4c7e79bfa421"
 )
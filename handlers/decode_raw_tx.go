@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// UTXOSet maps an outpoint ("txid:vout") to the output it refers to. it is what we resolve the prevouts of raw hex
+// transactions against, since unlike the json format raw transactions don't carry them
+type UTXOSet map[string]types.TransactionVout
+
+func outpointKey(txid string, vout int) string {
+	return fmt.Sprintf("%s:%d", txid, vout)
+}
+
+// NewUTXOSetFromMempool builds a UTXO set out of everything the json mempool tells us about outputs: the prevouts
+// embedded in each input, and the outputs each mempool transaction creates (so children of mempool txs resolve too)
+func NewUTXOSetFromMempool(transactions []types.TransactionData) UTXOSet {
+	utxos := UTXOSet{}
+	for _, transaction := range transactions {
+		for _, input := range transaction.Vin {
+			if !input.IsCoinbase {
+				utxos[outpointKey(input.TxID, input.Vout)] = input.Prevout
+			}
+		}
+		utxos.AddTxOutputs(transaction)
+	}
+	return utxos
+}
+
+// NewConfirmedUTXOSet builds the UTXO set a block of mempool transactions connects to: the prevouts embedded in
+// inputs whose transaction isn't in the mempool, i.e the confirmed outputs. outputs of mempool transactions aren't in
+// it, they only become spendable once the transaction creating them is connected, see CheckBlockWithProfile
+func NewConfirmedUTXOSet(transactions []types.TransactionData) UTXOSet {
+	inMempool := make(map[string]bool, len(transactions))
+	for _, transaction := range transactions {
+		inMempool[transaction.TxID] = true
+	}
+	utxos := UTXOSet{}
+	for _, transaction := range transactions {
+		for _, input := range transaction.Vin {
+			if !input.IsCoinbase && !inMempool[input.TxID] {
+				utxos[outpointKey(input.TxID, input.Vout)] = input.Prevout
+			}
+		}
+	}
+	return utxos
+}
+
+// SpendInputs takes the outputs a transaction spends out of the UTXO set. it fails on an output that isn't there,
+// which once the prevouts have been resolved means the transaction spends it twice
+func (utxos UTXOSet) SpendInputs(transaction types.TransactionData) error {
+	for i, input := range transaction.Vin {
+		if input.IsCoinbase {
+			continue
+		}
+		key := outpointKey(input.TxID, input.Vout)
+		if _, ok := utxos[key]; !ok {
+			return fmt.Errorf("input %d spends %s:%d, which is already spent", i, input.TxID, input.Vout)
+		}
+		delete(utxos, key)
+	}
+	return nil
+}
+
+// AddTxOutputs adds the outputs a transaction creates to the UTXO set
+func (utxos UTXOSet) AddTxOutputs(transaction types.TransactionData) {
+	if transaction.TxID == "" {
+		return
+	}
+	for i, output := range transaction.Vout {
+		utxos[outpointKey(transaction.TxID, i)] = output
+	}
+}
+
+// LoadPrevoutFile adds the outputs listed in a prevout file to the UTXO set. the file is a json array of
+// types.UTXOSetEntry, e.g [{"txid": "...", "index": 0, "value": 1000, "scriptPubKey": "0014..."}]
+func (utxos UTXOSet) LoadPrevoutFile(path string) error {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []types.UTXOSetEntry
+	if err := json.Unmarshal(fileBytes, &entries); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, entry := range entries {
+		utxos[outpointKey(entry.TxID, int(entry.Index))] = NewTransactionVout(entry.ScriptPubKey, int(entry.Value))
+	}
+	return nil
+}
+
+// ResolvePrevouts fills in the prevout of every input from the UTXO set, failing on the first one it can't find
+func (utxos UTXOSet) ResolvePrevouts(transaction *types.TransactionData) error {
+	for i := range transaction.Vin {
+		input := &transaction.Vin[i]
+		if input.IsCoinbase {
+			continue
+		}
+		prevout, ok := utxos[outpointKey(input.TxID, input.Vout)]
+		if !ok {
+			return fmt.Errorf("prevout %s:%d of input %d is not in the utxo set", input.TxID, input.Vout, i)
+		}
+		input.Prevout = prevout
+	}
+	return nil
+}
+
+// NewTransactionVout builds a TransactionVout from a scriptpubkey, filling in everything esplora computes for an
+// output (asm, type and address) from the script bytes
+func NewTransactionVout(scriptPubKeyHex string, value int) types.TransactionVout {
+	scriptPubKey, _ := hex.DecodeString(scriptPubKeyHex)
+	return types.TransactionVout{
+		ScriptPubKey:        scriptPubKeyHex,
+		ScriptPubKeyAsm:     script.Disasm(scriptPubKey),
+		ScriptPubKeyType:    script.Classify(scriptPubKey).EsploraType(),
+		ScriptPubKeyAddress: ScriptAddress(scriptPubKey),
+		Value:               value,
+	}
+}
+
+// DecodeRawTx decodes a raw hex transaction (as returned by getrawtransaction) into our transaction model. prevouts
+// are left empty since the raw format doesn't carry them, see UTXOSet.ResolvePrevouts
+func DecodeRawTx(rawTxHex string) (types.TransactionData, *wire.MsgTx, error) {
+	var transaction types.TransactionData
+	rawTxBytes, err := hex.DecodeString(strings.TrimSpace(rawTxHex))
+	if err != nil {
+		return transaction, nil, err
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(rawTxBytes)); err != nil {
+		return transaction, nil, err
+	}
+	transaction = MsgTxToTransactionData(tx)
+	return transaction, tx, nil
+}
+
+// MsgTxToTransactionData converts a wire.MsgTx into our transaction model, leaving the prevouts empty
+func MsgTxToTransactionData(tx *wire.MsgTx) types.TransactionData {
+	transaction := types.TransactionData{
+		Version:  int(tx.Version),
+		Locktime: int(tx.LockTime),
+	}
+	isCoinbase := len(tx.TxIn) == 1 && tx.TxIn[0].PreviousOutPoint.Index == wire.MaxPrevOutIndex &&
+		tx.TxIn[0].PreviousOutPoint.Hash == (wire.OutPoint{}).Hash
+	for _, txIn := range tx.TxIn {
+		input := types.TransactionVin{
+			TxID:         txIn.PreviousOutPoint.Hash.String(),
+			Vout:         int(txIn.PreviousOutPoint.Index),
+			ScriptSig:    hex.EncodeToString(txIn.SignatureScript),
+			ScriptSigAsm: script.Disasm(txIn.SignatureScript),
+			IsCoinbase:   isCoinbase,
+			Sequence:     int(txIn.Sequence),
+		}
+		if len(txIn.Witness) > 0 {
+			input.Witness = make([]string, len(txIn.Witness))
+			for i, item := range txIn.Witness {
+				input.Witness[i] = hex.EncodeToString(item)
+			}
+		}
+		transaction.Vin = append(transaction.Vin, input)
+	}
+	for _, txOut := range tx.TxOut {
+		transaction.Vout = append(transaction.Vout, NewTransactionVout(hex.EncodeToString(txOut.PkScript), int(txOut.Value)))
+	}
+	txHash := tx.TxHash()
+	transaction.TxID = txHash.String()
+	wTxHash := tx.WitnessHash()
+	transaction.WTxID = wTxHash.String()
+	// name it the way the mempool directory would, so it can be written out next to the json files
+	transaction.TxFilename = hex.EncodeToString(GetFileName(hex.EncodeToString(SerializeWireMsgTxNoWitness(tx)))) + ".json"
+	return transaction
+}
+
+// LoadRawTxFile reads a file of raw hex transactions, one per line (a file with a single transaction is just a one
+// line file). blank lines and lines starting with # are skipped. prevouts are resolved against the UTXO set, and
+// transactions whose prevouts can't be found are reported and left out
+func LoadRawTxFile(path string, utxos UTXOSet) ([]types.TransactionData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadRawTxs(file, path, utxos)
+}
+
+// LoadRawTxs is LoadRawTxFile for raw hex transactions read from anywhere, e.g a member of a mempool archive. name
+// is only used in messages
+func LoadRawTxs(reader io.Reader, name string, utxos UTXOSet) ([]types.TransactionData, error) {
+	var transactions []types.TransactionData
+	scanner := bufio.NewScanner(reader)
+	// a single standard transaction can be up to 400kB, so 800k hex characters
+	scanner.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		transaction, _, decodeErr := DecodeRawTx(line)
+		if decodeErr != nil {
+			fmt.Println("Error decoding raw tx: ", name, "line", lineNum, decodeErr)
+			continue
+		}
+		if resolveErr := utxos.ResolvePrevouts(&transaction); resolveErr != nil {
+			fmt.Println("Error resolving prevouts: ", transaction.TxID, resolveErr)
+			continue
+		}
+		// later lines may spend this transaction's outputs
+		utxos.AddTxOutputs(transaction)
+		transactions = append(transactions, transaction)
+	}
+	return transactions, scanner.Err()
+}
+
+// IsRawTxFile reports whether a file in the mempool directory holds raw hex transactions rather than json
+func IsRawTxFile(fileName string) bool {
+	return strings.HasSuffix(fileName, ".hex") || strings.HasSuffix(fileName, ".txt")
+}
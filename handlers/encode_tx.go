@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// NetParams is the network addresses are encoded for
+var NetParams = &chaincfg.MainNetParams
+
+// TransactionDataToMsgTx converts our transaction model into a wire.MsgTx (witnesses included). unlike SerializeATx
+// it fails on bad hex instead of silently dropping it
+func TransactionDataToMsgTx(transaction types.TransactionData) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx(int32(transaction.Version))
+	for i, input := range transaction.Vin {
+		prevOutHash, err := chainhash.NewHashFromStr(input.TxID)
+		if err != nil {
+			return nil, fmt.Errorf("input %d txid: %v", i, err)
+		}
+		scriptSig, err := hex.DecodeString(input.ScriptSig)
+		if err != nil {
+			return nil, fmt.Errorf("input %d scriptsig: %v", i, err)
+		}
+		var witness wire.TxWitness
+		for _, item := range input.Witness {
+			itemBytes, err := hex.DecodeString(item)
+			if err != nil {
+				return nil, fmt.Errorf("input %d witness: %v", i, err)
+			}
+			witness = append(witness, itemBytes)
+		}
+		txIn := wire.NewTxIn(wire.NewOutPoint(prevOutHash, uint32(input.Vout)), scriptSig, witness)
+		txIn.Sequence = uint32(input.Sequence)
+		tx.AddTxIn(txIn)
+	}
+	for i, output := range transaction.Vout {
+		scriptPubKey, err := hex.DecodeString(output.ScriptPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("output %d scriptpubkey: %v", i, err)
+		}
+		tx.AddTxOut(wire.NewTxOut(int64(output.Value), scriptPubKey))
+	}
+	tx.LockTime = uint32(transaction.Locktime)
+	return tx, nil
+}
+
+// EncodeRawTx serializes a transaction into raw hex, with witnesses if it has any (what sendrawtransaction expects)
+func EncodeRawTx(transaction types.TransactionData) (string, error) {
+	tx, err := TransactionDataToMsgTx(transaction)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(SerializeWireMsgTx(tx)), nil
+}
+
+// ScriptAddress returns the address a scriptpubkey pays to, or "" for scripts that have no address form
+func ScriptAddress(scriptPubKey []byte) string {
+	var address btcutil.Address
+	var err error
+	switch script.Classify(scriptPubKey) {
+	case script.P2PKH:
+		address, err = btcutil.NewAddressPubKeyHash(scriptPubKey[3:23], NetParams)
+	case script.P2SH:
+		address, err = btcutil.NewAddressScriptHashFromHash(scriptPubKey[2:22], NetParams)
+	case script.P2WPKH:
+		address, err = btcutil.NewAddressWitnessPubKeyHash(scriptPubKey[2:], NetParams)
+	case script.P2WSH:
+		address, err = btcutil.NewAddressWitnessScriptHash(scriptPubKey[2:], NetParams)
+	case script.P2TR:
+		address, err = btcutil.NewAddressTaproot(scriptPubKey[2:], NetParams)
+	default:
+		return ""
+	}
+	if err != nil {
+		return ""
+	}
+	return address.EncodeAddress()
+}
+
+// innerScripts works out the inner_redeemscript_asm and inner_witnessscript_asm esplora reports for an input
+func innerScripts(input types.TransactionVin) (string, string) {
+	var redeemScriptAsm, witnessScriptAsm string
+	inputType := InputType(input)
+	var redeemScript []byte
+	if inputType == script.P2SH {
+		scriptSig, _ := hex.DecodeString(input.ScriptSig)
+		redeemScript, _ = script.LastPush(scriptSig)
+		redeemScriptAsm = script.Disasm(redeemScript)
+	}
+	witness := input.Witness
+	switch {
+	case len(witness) == 0:
+	case inputType == script.P2WSH || (inputType == script.P2SH && script.Classify(redeemScript) == script.P2WSH):
+		witnessScriptAsm, _ = script.DisasmHex(witness[len(witness)-1])
+	case inputType == script.P2TR:
+		// a script path spend has the tapscript second to last, ahead of the control block (and an optional annex)
+		if len(witness) >= 2 && len(witness[len(witness)-1]) >= 2 && witness[len(witness)-1][:2] == "50" {
+			witness = witness[:len(witness)-1]
+		}
+		if len(witness) >= 2 {
+			witnessScriptAsm, _ = script.DisasmHex(witness[len(witness)-2])
+		}
+	}
+	return redeemScriptAsm, witnessScriptAsm
+}
+
+// TxFee returns the sum of the prevout values minus the sum of the output values. it is 0 for a coinbase tx
+func TxFee(transaction types.TransactionData) int {
+	fee := 0
+	for _, input := range transaction.Vin {
+		if input.IsCoinbase {
+			return 0
+		}
+		fee += input.Prevout.Value
+	}
+	for _, output := range transaction.Vout {
+		fee -= output.Value
+	}
+	return fee
+}
+
+// ToEsploraTx renders a transaction in the full esplora format. every derived field (asm, type, address, inner
+// scripts, txid, size, weight and fee) is recomputed from the hex rather than copied from the input
+func ToEsploraTx(transaction types.TransactionData) (types.EsploraTx, error) {
+	tx, err := TransactionDataToMsgTx(transaction)
+	if err != nil {
+		return types.EsploraTx{}, err
+	}
+	baseSize := tx.SerializeSizeStripped()
+	totalSize := tx.SerializeSize()
+	esploraTx := types.EsploraTx{
+		TxID:     tx.TxHash().String(),
+		Version:  transaction.Version,
+		Locktime: transaction.Locktime,
+		Size:     totalSize,
+		Weight:   baseSize*3 + totalSize,
+		Fee:      TxFee(transaction),
+	}
+	for _, input := range transaction.Vin {
+		scriptSig, _ := hex.DecodeString(input.ScriptSig)
+		esploraVin := types.EsploraVin{
+			TxID:         input.TxID,
+			Vout:         input.Vout,
+			ScriptSig:    input.ScriptSig,
+			ScriptSigAsm: script.Disasm(scriptSig),
+			Witness:      input.Witness,
+			IsCoinbase:   input.IsCoinbase,
+			Sequence:     input.Sequence,
+		}
+		if !input.IsCoinbase {
+			prevout := NewTransactionVout(input.Prevout.ScriptPubKey, input.Prevout.Value)
+			esploraVin.Prevout = &prevout
+			esploraVin.InnerRedeemScript, esploraVin.InnerWitnessScript = innerScripts(input)
+		}
+		esploraTx.Vin = append(esploraTx.Vin, esploraVin)
+	}
+	for _, output := range transaction.Vout {
+		esploraTx.Vout = append(esploraTx.Vout, NewTransactionVout(output.ScriptPubKey, output.Value))
+	}
+	return esploraTx, nil
+}
+
+// RoundTripTx encodes a transaction to raw hex, decodes it again, and checks that the esplora json regenerated from
+// the hex reproduces every field of the original, derived fields included. it returns the first difference found
+func RoundTripTx(transaction types.TransactionData) error {
+	rawTxHex, err := EncodeRawTx(transaction)
+	if err != nil {
+		return err
+	}
+	decodedTx, _, err := DecodeRawTx(rawTxHex)
+	if err != nil {
+		return err
+	}
+	if err := NewUTXOSetFromMempool([]types.TransactionData{transaction}).ResolvePrevouts(&decodedTx); err != nil {
+		return err
+	}
+	if decodedTx.TxID != transaction.TxID && transaction.TxID != "" {
+		return fmt.Errorf("txid changed from %s to %s", transaction.TxID, decodedTx.TxID)
+	}
+	esploraTx, err := ToEsploraTx(decodedTx)
+	if err != nil {
+		return err
+	}
+	// compare field by field against what the original json carried. keys the original doesn't have (txid, size and
+	// so on) are skipped, keys it has must match exactly
+	original, _ := json.Marshal(transaction)
+	regenerated, _ := json.Marshal(esploraTx)
+	var originalFields, regeneratedFields map[string]interface{}
+	json.Unmarshal(original, &originalFields)
+	json.Unmarshal(regenerated, &regeneratedFields)
+	for _, key := range []string{"version", "locktime", "vin", "vout"} {
+		if diff := jsonDiff(key, originalFields[key], regeneratedFields[key]); diff != nil {
+			return diff
+		}
+	}
+	return nil
+}
+
+// jsonDiff compares two decoded json values, only looking at the object keys present in the original
+func jsonDiff(path string, original interface{}, regenerated interface{}) error {
+	switch originalValue := original.(type) {
+	case map[string]interface{}:
+		regeneratedValue, ok := regenerated.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", path)
+		}
+		for key, value := range originalValue {
+			if err := jsonDiff(path+"."+key, value, regeneratedValue[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		regeneratedValue, ok := regenerated.([]interface{})
+		if !ok || len(regeneratedValue) != len(originalValue) {
+			return fmt.Errorf("%s: expected an array of %d items", path, len(originalValue))
+		}
+		for i := range originalValue {
+			if err := jsonDiff(fmt.Sprintf("%s[%d]", path, i), originalValue[i], regeneratedValue[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		originalJSON, _ := json.Marshal(original)
+		regeneratedJSON, _ := json.Marshal(regenerated)
+		if !bytes.Equal(originalJSON, regeneratedJSON) {
+			return errors.New(path + ": " + string(originalJSON) + " became " + string(regeneratedJSON))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestEncodeRawTxRoundTrip encodes every mempool transaction to raw hex, decodes it again and checks that the txid
+// and wtxid survive, that the txid is what the file is named after, and that re-encoding the decoded transaction
+// gives back the same hex
+func TestEncodeRawTxRoundTrip(t *testing.T) {
+	files, err := os.ReadDir(mempoolTestDir)
+	if err != nil {
+		t.Skip("no mempool directory:", err)
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		t.Run(strings.TrimSuffix(file.Name(), ".json"), func(t *testing.T) {
+			transaction, err := LoadTxFile(filepath.Join(mempoolTestDir, file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyTxFilename(transaction); err != nil {
+				t.Fatal(err)
+			}
+			rawTx, err := EncodeRawTx(transaction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, msgTx, err := DecodeRawTx(rawTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if txId := msgTx.TxHash().String(); txId != transaction.TxID {
+				t.Errorf("txid %s after decoding, %s before", txId, transaction.TxID)
+			}
+			if wTxId := msgTx.WitnessHash().String(); wTxId != transaction.WTxID {
+				t.Errorf("wtxid %s after decoding, %s before", wTxId, transaction.WTxID)
+			}
+			reencoded, err := EncodeRawTx(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reencoded != rawTx {
+				t.Errorf("re-encoding the decoded transaction gives different hex")
+			}
+		})
+	}
+}
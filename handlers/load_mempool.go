@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// MaxOrphanTxs caps how many transactions LoadMempool holds back at a time because they spend the outputs of ones that
+// haven't been read yet, and how many submitted transactions MempoolWatcher keeps waiting for their parents. core keeps
+// 100 orphans, but mempool files come in name order rather than the order they were relayed in, so children turn up
+// before their parents far more often: the sample mempool peaks at about 700
+var MaxOrphanTxs = 1000
+
+// the reasons a transaction held back for its parents is turned down
+var (
+	ErrOrphanPoolFull = errors.New("orphan pool full, the oldest orphan is dropped")
+	ErrParentMissing  = errors.New("spends an output of a transaction that is in the mempool but never came through")
+)
+
+// LoadMempool reads every transaction in a mempool directory or archive (see OpenMempool), streaming it rather than
+// reading it all in first. each json file's name has to match the txid of its contents (see GetFileName); files that
+// don't, or that aren't transactions at all, are rejected and, if quarantineDir is not empty and the mempool is a
+// directory, moved there so they don't get picked up again. raw hex files (see IsRawTxFile) are decoded after the
+// json files, with their prevouts resolved against the outputs of the mempool plus any prevout files given. the
+// transactions go through a BoundedMempool as they're read, so MaxMempoolBytes, RBFPolicy and MempoolLimits apply
+func LoadMempool(mempoolDir string, quarantineDir string, prevoutFiles ...string) []types.TransactionData {
+	return LoadBoundedMempool(mempoolDir, quarantineDir, prevoutFiles...).Transactions()
+}
+
+// LoadBoundedMempool is LoadMempool returning the mempool itself, which also knows what got replaced and the families
+// of its transactions. transactions are added as they're read, so only what the mempool keeps stays in memory. one
+// spending an output of a mempool transaction that hasn't been read yet waits in an orphan pool of at most
+// MaxOrphanTxs and is added right after its last parent, so transactions go in parents first. they aren't validated
+// yet when they're added, so a replacement only has to follow the policy to evict what it conflicts with
+func LoadBoundedMempool(mempoolDir string, quarantineDir string, prevoutFiles ...string) *BoundedMempool {
+	mempool := NewBoundedMempool(MaxMempoolBytes)
+	inMempool, err := mempoolTxIds(mempoolDir)
+	if err != nil {
+		fmt.Println("Error reading file: ", err)
+		return mempool
+	}
+	iterator, err := OpenMempool(mempoolDir)
+	if err != nil {
+		fmt.Println("Error reading file: ", err)
+		return mempool
+	}
+	defer iterator.Close()
+	loader := &mempoolLoader{
+		mempool:   mempool,
+		inMempool: inMempool,
+		orphans:   map[string]*orphanTx{},
+		waiting:   map[string][]string{},
+	}
+	var rawRecords []MempoolRecord
+	for iterator.Next() {
+		record := iterator.Record()
+		switch {
+		case record.Err != nil:
+			fmt.Println("Rejecting tx file: ", record.Err)
+			if quarantineDir != "" && iterator.IsDir() {
+				QuarantineFile(mempoolDir, quarantineDir, record.Source)
+			}
+		case record.Raw != nil:
+			rawRecords = append(rawRecords, record)
+		default:
+			loader.offer(record.Tx, int64(record.Size))
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		fmt.Println("Error reading file: ", err)
+	}
+	loader.dropOrphans(ErrParentMissing)
+	if len(rawRecords) > 0 {
+		utxos := NewUTXOSetFromMempool(mempool.Transactions())
+		for _, prevoutFile := range prevoutFiles {
+			if err := utxos.LoadPrevoutFile(prevoutFile); err != nil {
+				fmt.Println("Error reading prevout file: ", err)
+			}
+		}
+		for _, record := range rawRecords {
+			rawTxs, err := LoadRawTxs(bytes.NewReader(record.Raw), record.Source, utxos)
+			if err != nil {
+				fmt.Println("Error reading raw tx file: ", err)
+			}
+			for _, rawTx := range rawTxs {
+				loader.add(rawTx, TxMemoryUsage(rawTx))
+			}
+		}
+	}
+	if loader.evicted > 0 {
+		fmt.Println("Mempool is over", MaxMempoolBytes, "bytes, evicted", loader.evicted,
+			"transactions, lowest descendant score first")
+	}
+	return mempool
+}
+
+// mempoolTxIds tells whether a txid belongs to a transaction of the mempool, read or not, which is how a parent still
+// to come is told apart from a confirmed one. a directory's json files are named after hashes of their txids (see
+// GetFileName), so listing it is enough; an archive is read through once for its txids
+func mempoolTxIds(mempoolDir string) (func(txId string) bool, error) {
+	info, err := os.Stat(mempoolDir)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	if info.IsDir() {
+		files, err := os.ReadDir(mempoolDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if filepath.Ext(file.Name()) == ".json" {
+				names[strings.TrimSuffix(file.Name(), ".json")] = true
+			}
+		}
+		return func(txId string) bool {
+			txIdBytes, err := hex.DecodeString(txId)
+			return err == nil && names[hex.EncodeToString(chainhash.HashB(txIdBytes))]
+		}, nil
+	}
+	iterator, err := OpenMempool(mempoolDir)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+	for iterator.Next() {
+		if record := iterator.Record(); record.Err == nil && record.Raw == nil {
+			names[record.Tx.TxID] = true
+		}
+	}
+	return func(txId string) bool { return names[txId] }, iterator.Err()
+}
+
+// mempoolLoader adds transactions to a mempool as they're read, holding back the ones whose parents haven't been
+type mempoolLoader struct {
+	mempool   *BoundedMempool
+	inMempool func(txId string) bool
+	orphans   map[string]*orphanTx
+	waiting   map[string][]string // txids of the orphans waiting for a transaction, by its txid
+	nextSeq   int
+	evicted   int
+}
+
+type orphanTx struct {
+	tx    types.TransactionData
+	usage int64
+	seq   int
+}
+
+// offer adds a transaction, or holds it back if a parent of it hasn't been through the mempool yet
+func (l *mempoolLoader) offer(transaction types.TransactionData, usage int64) {
+	if _, ok := l.orphans[transaction.TxID]; ok {
+		return
+	}
+	missing := l.missingParents(transaction)
+	if len(missing) == 0 {
+		l.add(transaction, usage)
+		return
+	}
+	if len(l.orphans) >= MaxOrphanTxs {
+		l.dropOldestOrphan()
+	}
+	l.orphans[transaction.TxID] = &orphanTx{tx: transaction, usage: usage, seq: l.nextSeq}
+	l.nextSeq++
+	for _, parent := range missing {
+		l.waiting[parent] = append(l.waiting[parent], transaction.TxID)
+	}
+}
+
+// missingParents returns the txids of the transactions a transaction spends from that are in the mempool files but
+// haven't been added or turned down yet
+func (l *mempoolLoader) missingParents(transaction types.TransactionData) []string {
+	var missing []string
+	for _, input := range transaction.Vin {
+		parent := input.TxID
+		if input.IsCoinbase || slices.Contains(missing, parent) || !l.inMempool(parent) {
+			continue
+		}
+		if _, added := l.mempool.byTxId[parent]; !added && !l.mempool.gone[parent] {
+			missing = append(missing, parent)
+		}
+	}
+	return missing
+}
+
+// add puts a transaction in the mempool and then the orphans that were only waiting for it, or are turned down now
+// that it is
+func (l *mempoolLoader) add(transaction types.TransactionData, usage int64) {
+	evicted, err := l.mempool.Add(transaction, usage)
+	if err != nil {
+		fmt.Println("Rejecting tx: ", err)
+	}
+	l.evicted += len(evicted)
+	l.settled(transaction.TxID)
+}
+
+// settled offers the orphans waiting for a transaction again once it's been added or turned down
+func (l *mempoolLoader) settled(txId string) {
+	children := l.waiting[txId]
+	delete(l.waiting, txId)
+	for _, child := range children {
+		orphan, ok := l.orphans[child]
+		if !ok || len(l.missingParents(orphan.tx)) > 0 {
+			continue
+		}
+		delete(l.orphans, child)
+		l.add(orphan.tx, orphan.usage)
+	}
+}
+
+// dropOldestOrphan turns down the orphan that has waited longest to make room for another
+func (l *mempoolLoader) dropOldestOrphan() {
+	var oldest *orphanTx
+	for _, orphan := range l.orphans {
+		if oldest == nil || orphan.seq < oldest.seq {
+			oldest = orphan
+		}
+	}
+	l.drop(oldest, ErrOrphanPoolFull)
+}
+
+// dropOrphans turns down every orphan still waiting, oldest first, once there's nothing left for them to wait for
+func (l *mempoolLoader) dropOrphans(reason error) {
+	orphans := make([]*orphanTx, 0, len(l.orphans))
+	for _, orphan := range l.orphans {
+		orphans = append(orphans, orphan)
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].seq < orphans[j].seq })
+	for _, orphan := range orphans {
+		if _, ok := l.orphans[orphan.tx.TxID]; ok {
+			l.drop(orphan, reason)
+		}
+	}
+}
+
+// drop turns an orphan down for good, along with whatever is waiting for it
+func (l *mempoolLoader) drop(orphan *orphanTx, reason error) {
+	delete(l.orphans, orphan.tx.TxID)
+	l.mempool.gone[orphan.tx.TxID] = true
+	fmt.Println("Rejecting tx: ", fmt.Errorf("%s: %w", orphan.tx.TxID, reason))
+	l.settled(orphan.tx.TxID)
+}
+
+// PopulateTxIds computes the txid and wtxid of a transaction from its serialization and stores them on it. if the json
+// already carried a txid, the computed one replaces it, VerifyTxFilename is what catches a disagreement
+func PopulateTxIds(transaction *types.TransactionData) {
+	if transaction.TxID != "" {
+		transaction.DeclaredTxID = transaction.TxID
+	}
+	tx, wTx, _, _ := SerializeATx(*transaction)
+	if tx == nil {
+		return
+	}
+	txHash := tx.TxHash()
+	wTxHash := wTx.WitnessHash()
+	transaction.TxID = txHash.String()
+	transaction.WTxID = wTxHash.String()
+}
+
+// VerifyTxFilename checks that the txid computed from the transaction's contents hashes to the name of the file it
+// was read from, and that it agrees with any txid the file itself declares
+func VerifyTxFilename(transaction types.TransactionData) error {
+	if err := VerifyTxIds(transaction); err != nil {
+		return fmt.Errorf("%s: %v", transaction.TxFilename, err)
+	}
+	_, _, serializedTx, _ := SerializeATx(transaction)
+	expectedName := hex.EncodeToString(GetFileName(hex.EncodeToString(serializedTx)))
+	if strings.TrimSuffix(transaction.TxFilename, filepath.Ext(transaction.TxFilename)) != expectedName {
+		return fmt.Errorf("%s: contents hash to %s (txid %s)", transaction.TxFilename, expectedName, transaction.TxID)
+	}
+	return nil
+}
+
+// VerifyTxIds checks that a txid could be computed for the transaction and that it agrees with any txid the json
+// declares, the part of VerifyTxFilename that doesn't need a file name
+func VerifyTxIds(transaction types.TransactionData) error {
+	if transaction.TxID == "" {
+		return errors.New("transaction could not be serialized")
+	}
+	if transaction.DeclaredTxID != "" && transaction.DeclaredTxID != transaction.TxID {
+		return fmt.Errorf("declared txid %s but computed %s", transaction.DeclaredTxID, transaction.TxID)
+	}
+	return nil
+}
+
+// QuarantineFile moves a rejected mempool file into the quarantine directory
+func QuarantineFile(mempoolDir string, quarantineDir string, fileName string) {
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		fmt.Println("Error creating quarantine dir: ", err)
+		return
+	}
+	if err := os.Rename(filepath.Join(mempoolDir, fileName), filepath.Join(quarantineDir, fileName)); err != nil {
+		fmt.Println("Error quarantining file: ", err)
+	}
+}
+
+// LoadTxFile reads a single mempool json file, computing its txid and wtxid. unlike LoadMempool it doesn't insist
+// on the file being named after the tx, so it can be used on files from anywhere
+func LoadTxFile(path string) (types.TransactionData, error) {
+	var transaction types.TransactionData
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return transaction, err
+	}
+	if err := json.Unmarshal(fileBytes, &transaction); err != nil {
+		return transaction, fmt.Errorf("%s: %v", path, err)
+	}
+	transaction.TxFilename = filepath.Base(path)
+	PopulateTxIds(&transaction)
+	return transaction, nil
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// MaxMempoolBytes caps how much LoadMempool keeps, counting each transaction at the size of its json. when a new
+// transaction takes the mempool over the cap, the transactions with the lowest descendant score are evicted, each
+// with its descendants, until it fits again. 0 means no cap
+var MaxMempoolBytes int64 = 0
+
+// BoundedMempool holds transactions up to a memory cap, evicting the ones with the lowest descendant score along with
+// their descendants to make room, the same way bitcoin core trims its mempool to -maxmempool. a transaction spending
+// an output one already in the mempool spends either replaces it or is turned down, as RBFPolicy decides, and one
+// that would make a family of unconfirmed transactions go over MempoolLimits is turned down too. transactions come
+// back out in the order they were added
+type BoundedMempool struct {
+	maxBytes  int64
+	usage     int64
+	nextSeq   int
+	pool      pooledTxHeap
+	byTxId    map[string]*pooledTx
+	conflicts *ConflictIndex
+	replaced  []types.Replacement
+	gone      map[string]bool // txids turned down, replaced or evicted, nothing spending their outputs gets in
+}
+
+type pooledTx struct {
+	tx    types.TransactionData
+	score float64 // descendant score, see descendantScore
+	usage int64
+	seq   int
+	index int // position in the heap
+}
+
+// pooledTxHeap is a min heap on descendant score. between equal scores the newest transaction is on top, so it's
+// evicted first
+type pooledTxHeap []*pooledTx
+
+func (h pooledTxHeap) Len() int { return len(h) }
+func (h pooledTxHeap) Less(i, j int) bool {
+	if h[i].score != h[j].score {
+		return h[i].score < h[j].score
+	}
+	return h[i].seq > h[j].seq
+}
+func (h pooledTxHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *pooledTxHeap) Push(x interface{}) {
+	entry := x.(*pooledTx)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+func (h *pooledTxHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// NewBoundedMempool creates an empty mempool capped at maxBytes, 0 for no cap
+func NewBoundedMempool(maxBytes int64) *BoundedMempool {
+	return &BoundedMempool{maxBytes: maxBytes, byTxId: map[string]*pooledTx{}, conflicts: NewConflictIndex(), gone: map[string]bool{}}
+}
+
+// ErrParentGone is why a transaction spending an output of one that was turned down, replaced or evicted is turned
+// down
+var ErrParentGone = errors.New("spends an output of a transaction that was turned down, replaced or evicted")
+
+// Add puts a transaction in the mempool, usage being what it counts against the cap (see TxMemoryUsage), and returns
+// whatever had to be evicted to stay under it, parents before children. that can be the transaction just added, if
+// its package scores lowest. a transaction conflicting with ones in the mempool evicts them and their descendants if
+// RBFPolicy lets it replace them (see Replaced), and is turned down with the policy's error otherwise. a transaction
+// going over MempoolLimits is turned down as well, and so is anything spending the outputs of a transaction that was
+// turned down, replaced or evicted. children should be added after their parents, see ParentsFirst. one that's
+// already in is ignored
+func (m *BoundedMempool) Add(transaction types.TransactionData, usage int64) ([]types.TransactionData, error) {
+	if _, ok := m.byTxId[transaction.TxID]; ok {
+		return nil, nil
+	}
+	replaced, err := m.admit(transaction)
+	if err != nil {
+		m.gone[transaction.TxID] = true
+		return nil, fmt.Errorf("%s: %w", transaction.TxID, err)
+	}
+	replacedAncestors := m.ancestorsOf(replaced)
+	for _, txId := range replaced {
+		old := m.byTxId[txId]
+		m.replaced = append(m.replaced, types.Replacement{TxID: txId, ReplacedBy: transaction.TxID, Fee: TxFee(old.tx)})
+		m.gone[txId] = true
+		m.remove(old)
+	}
+	m.rescore(replacedAncestors)
+	entry := &pooledTx{tx: transaction, usage: usage, seq: m.nextSeq}
+	m.nextSeq++
+	heap.Push(&m.pool, entry)
+	m.byTxId[transaction.TxID] = entry
+	m.conflicts.Add(transaction)
+	m.usage += usage
+	m.rescore(append(m.conflicts.Ancestors(transaction), transaction.TxID))
+	var evicted []types.TransactionData
+	for m.maxBytes > 0 && m.usage > m.maxBytes && m.pool.Len() > 0 {
+		// like core, the lowest scoring transaction goes with everything spending its outputs
+		pkg := m.conflicts.Descendants([]string{m.pool[0].tx.TxID})
+		ancestors := m.ancestorsOf(pkg)
+		for _, txId := range pkg {
+			lowest := m.byTxId[txId]
+			m.gone[txId] = true
+			m.remove(lowest)
+			evicted = append(evicted, lowest.tx)
+		}
+		m.rescore(ancestors)
+	}
+	return evicted, nil
+}
+
+// descendantScore is what eviction ranks a transaction by, core's descendant score: the higher of its own feerate and
+// the feerate of it and its descendants together, so a parent isn't evicted ahead of a child paying for it
+func (m *BoundedMempool) descendantScore(txId string) float64 {
+	vsize, fee := m.conflicts.vsizeAndFee(txId)
+	packageVSize, packageFee := 0, 0
+	for _, descendant := range m.conflicts.Descendants([]string{txId}) {
+		descendantVSize, descendantFee := m.conflicts.vsizeAndFee(descendant)
+		packageVSize += descendantVSize
+		packageFee += descendantFee
+	}
+	if vsize == 0 || packageVSize == 0 {
+		return 0
+	}
+	return max(float64(fee)/float64(vsize), float64(packageFee)/float64(packageVSize))
+}
+
+// rescore works out the descendant scores of the transactions again after their descendants changed. scores only
+// matter for eviction, so without a cap nothing is serialized for them
+func (m *BoundedMempool) rescore(txIds []string) {
+	if m.maxBytes <= 0 {
+		return
+	}
+	for _, txId := range txIds {
+		if entry, ok := m.byTxId[txId]; ok {
+			entry.score = m.descendantScore(txId)
+			heap.Fix(&m.pool, entry.index)
+		}
+	}
+}
+
+// ancestorsOf returns the ancestors of the transactions that aren't among them, whose descendants change when the
+// transactions go
+func (m *BoundedMempool) ancestorsOf(txIds []string) []string {
+	if m.maxBytes <= 0 {
+		return nil
+	}
+	leaving := make(map[string]bool, len(txIds))
+	for _, txId := range txIds {
+		leaving[txId] = true
+	}
+	seen := map[string]bool{}
+	var ancestors []string
+	for _, txId := range txIds {
+		for _, ancestor := range m.conflicts.Ancestors(m.byTxId[txId].tx) {
+			if !leaving[ancestor] && !seen[ancestor] {
+				seen[ancestor] = true
+				ancestors = append(ancestors, ancestor)
+			}
+		}
+	}
+	return ancestors
+}
+
+// admit checks a transaction against the mempool's policies and returns the transactions it replaces
+func (m *BoundedMempool) admit(transaction types.TransactionData) ([]string, error) {
+	for _, input := range transaction.Vin {
+		if m.gone[input.TxID] {
+			return nil, fmt.Errorf("%w: %s", ErrParentGone, input.TxID)
+		}
+	}
+	replaced, err := RBFPolicy.Check(m.conflicts, transaction)
+	if err != nil {
+		return nil, err
+	}
+	return replaced, MempoolLimits.Check(m.conflicts, transaction, replaced)
+}
+
+func (m *BoundedMempool) remove(entry *pooledTx) {
+	heap.Remove(&m.pool, entry.index)
+	delete(m.byTxId, entry.tx.TxID)
+	m.conflicts.Remove(entry.tx.TxID)
+	m.usage -= entry.usage
+}
+
+// Replaced lists the transactions replaced by conflicting ones, in the order it happened. a replacement that got
+// replaced in turn is listed too
+func (m *BoundedMempool) Replaced() []types.Replacement {
+	return m.replaced
+}
+
+// Len is the number of transactions in the mempool
+func (m *BoundedMempool) Len() int {
+	return m.pool.Len()
+}
+
+// Usage is the total usage of the transactions in the mempool
+func (m *BoundedMempool) Usage() int64 {
+	return m.usage
+}
+
+// Transactions returns the transactions in the mempool in the order they were added
+func (m *BoundedMempool) Transactions() []types.TransactionData {
+	entries := make([]*pooledTx, len(m.pool))
+	copy(entries, m.pool)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	transactions := make([]types.TransactionData, len(entries))
+	for i, entry := range entries {
+		transactions[i] = entry.tx
+	}
+	return transactions
+}
+
+// Entries describes the transactions in the mempool in the order they were added, with their ancestor and
+// descendant aggregates
+func (m *BoundedMempool) Entries() []types.MempoolEntry {
+	transactions := m.Transactions()
+	entries := make([]types.MempoolEntry, len(transactions))
+	for i, transaction := range transactions {
+		entries[i] = m.conflicts.MempoolEntry(transaction.TxID)
+	}
+	return entries
+}
+
+// Entry describes one transaction in the mempool, see Entries
+func (m *BoundedMempool) Entry(txId string) (types.MempoolEntry, bool) {
+	if _, ok := m.byTxId[txId]; !ok {
+		return types.MempoolEntry{}, false
+	}
+	return m.conflicts.MempoolEntry(txId), true
+}
+
+// ParentsFirst returns an order to add transactions in where every transaction comes after the ones in the list whose
+// outputs it spends, and that otherwise keeps the list's order
+func ParentsFirst(transactions []types.TransactionData) []int {
+	positions := make(map[string]int, len(transactions))
+	for i, transaction := range transactions {
+		positions[transaction.TxID] = i
+	}
+	order := make([]int, 0, len(transactions))
+	visited := make([]bool, len(transactions))
+	var visit func(i int)
+	visit = func(i int) {
+		visited[i] = true
+		for _, input := range transactions[i].Vin {
+			if parent, ok := positions[input.TxID]; ok && !visited[parent] {
+				visit(parent)
+			}
+		}
+		order = append(order, i)
+	}
+	for i := range transactions {
+		if !visited[i] {
+			visit(i)
+		}
+	}
+	return order
+}
+
+// TxMemoryUsage estimates what holding a transaction costs as the size of its json, which is what a mempool file
+// spends on it too
+func TxMemoryUsage(transaction types.TransactionData) int64 {
+	encoded, err := json.Marshal(transaction)
+	if err != nil {
+		return 0
+	}
+	return int64(len(encoded))
+}
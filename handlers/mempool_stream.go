@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// ErrMalformedTx is wrapped by the error of a mempool record whose contents aren't a transaction at all, and by the
+// error of an entry whose validation panicked on it (see checkEntry)
+var ErrMalformedTx = errors.New("malformed transaction")
+
+// MempoolRecord is one item read from a mempool source: a decoded json transaction, the contents of a raw hex
+// transaction file (Raw, left for the caller to decode since raw transactions need prevouts), or the reason a file
+// couldn't be used. a record with Err set never carries a transaction
+type MempoolRecord struct {
+	Source string // file name inside the directory or archive, or "file:line" for json lines
+	Tx     types.TransactionData
+	Raw    []byte
+	Size   int // bytes the record took in the source
+	Err    error
+}
+
+// mempoolItem is a file (or line) as a source hands it over, before it's decoded
+type mempoolItem struct {
+	name  string
+	data  []byte
+	named bool  // the name is a file name the txid has to match, not a line number
+	err   error // the item couldn't be read
+}
+
+// mempoolSource hands out the items of a mempool one at a time, returning io.EOF after the last
+type mempoolSource interface {
+	next() (mempoolItem, error)
+	close() error
+}
+
+// MempoolIterator streams the transactions of a mempool directory or archive. only a batch of files is held at a
+// time, decoded on ValidationWorkers goroutines, so a mempool never has to fit in memory as raw files. usage:
+//
+//	it, err := OpenMempool("mempool")
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		record := it.Record()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+type MempoolIterator struct {
+	source  mempoolSource
+	isDir   bool
+	batch   []MempoolRecord
+	pos     int
+	record  MempoolRecord
+	err     error
+	drained bool
+}
+
+// OpenMempool opens a mempool for streaming. path is a directory of transaction files, a tar archive (optionally
+// gzipped), a zip archive or a json lines file with one transaction per line
+func OpenMempool(path string) (*MempoolIterator, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var source mempoolSource
+	switch {
+	case info.IsDir():
+		source, err = newDirSource(path)
+	case strings.HasSuffix(path, ".tar"):
+		source, err = newTarSource(path, false)
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		source, err = newTarSource(path, true)
+	case strings.HasSuffix(path, ".zip"):
+		source, err = newZipSource(path)
+	case strings.HasSuffix(path, ".jsonl"), strings.HasSuffix(path, ".ndjson"):
+		source, err = newJSONLinesSource(path)
+	default:
+		return nil, fmt.Errorf("%s: not a directory, .tar, .tar.gz, .tgz, .zip or .jsonl mempool", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &MempoolIterator{source: source, isDir: info.IsDir()}, nil
+}
+
+// IsMempoolArchive reports whether a path names a mempool archive OpenMempool can read
+func IsMempoolArchive(path string) bool {
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".zip", ".jsonl", ".ndjson"} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next moves to the next record, returning false once the mempool is exhausted or reading it failed (see Err)
+func (it *MempoolIterator) Next() bool {
+	if it.pos >= len(it.batch) {
+		if it.drained || it.err != nil {
+			return false
+		}
+		it.fill()
+		if len(it.batch) == 0 {
+			return false
+		}
+	}
+	it.record = it.batch[it.pos]
+	it.batch[it.pos] = MempoolRecord{}
+	it.pos++
+	return true
+}
+
+// Record returns the record Next moved to
+func (it *MempoolIterator) Record() MempoolRecord {
+	return it.record
+}
+
+// Err returns the error that stopped the iteration early, if any. errors in individual files don't stop it, they
+// come back as records
+func (it *MempoolIterator) Err() error {
+	return it.err
+}
+
+// IsDir reports whether the mempool is a directory, whose files can be quarantined, rather than an archive
+func (it *MempoolIterator) IsDir() bool {
+	return it.isDir
+}
+
+// Close releases the underlying files
+func (it *MempoolIterator) Close() error {
+	return it.source.close()
+}
+
+// fill reads the next batch of items from the source and decodes them in parallel
+func (it *MempoolIterator) fill() {
+	batchSize := 64 * max(ValidationWorkers, 1)
+	items := make([]mempoolItem, 0, batchSize)
+	for len(items) < batchSize {
+		item, err := it.source.next()
+		if err == io.EOF {
+			it.drained = true
+			break
+		}
+		if err != nil {
+			it.err = err
+			break
+		}
+		items = append(items, item)
+	}
+	it.batch = make([]MempoolRecord, len(items))
+	it.pos = 0
+	forEachParallel(len(items), ValidationWorkers, func(i int) {
+		it.batch[i] = decodeMempoolItem(items[i])
+	})
+}
+
+// decodeMempoolItem turns a file's contents into a record, checking the txid against the file name where there is one
+func decodeMempoolItem(item mempoolItem) MempoolRecord {
+	record := MempoolRecord{Source: item.name, Size: len(item.data)}
+	if item.err != nil {
+		record.Err = item.err
+		return record
+	}
+	if item.named && IsRawTxFile(item.name) {
+		record.Raw = item.data
+		return record
+	}
+	var transaction types.TransactionData
+	if err := json.Unmarshal(item.data, &transaction); err != nil {
+		record.Err = fmt.Errorf("%s: %w: %v", item.name, ErrMalformedTx, err)
+		return record
+	}
+	if len(transaction.Vin) == 0 && len(transaction.Vout) == 0 {
+		record.Err = fmt.Errorf("%s: %w: no inputs or outputs", item.name, ErrMalformedTx)
+		return record
+	}
+	if item.named {
+		transaction.TxFilename = filepath.Base(item.name)
+	}
+	PopulateTxIds(&transaction)
+	var err error
+	if item.named {
+		err = VerifyTxFilename(transaction)
+	} else {
+		err = VerifyTxIds(transaction)
+	}
+	if err != nil {
+		if !item.named {
+			err = fmt.Errorf("%s: %v", item.name, err)
+		}
+		record.Err = err
+		return record
+	}
+	record.Tx = transaction
+	return record
+}
+
+type dirSource struct {
+	dir   string
+	names []string
+}
+
+func newDirSource(dir string) (*dirSource, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	source := &dirSource{dir: dir}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			source.names = append(source.names, entry.Name())
+		}
+	}
+	return source, nil
+}
+
+func (s *dirSource) next() (mempoolItem, error) {
+	if len(s.names) == 0 {
+		return mempoolItem{}, io.EOF
+	}
+	name := s.names[0]
+	s.names = s.names[1:]
+	// an unreadable file is a bad record, not the end of the mempool
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	return mempoolItem{name: name, data: data, named: true, err: err}, nil
+}
+
+func (s *dirSource) close() error {
+	return nil
+}
+
+type tarSource struct {
+	file   *os.File
+	gzip   *gzip.Reader
+	reader *tar.Reader
+}
+
+func newTarSource(path string, gzipped bool) (*tarSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	source := &tarSource{file: file}
+	var reader io.Reader = file
+	if gzipped {
+		if source.gzip, err = gzip.NewReader(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		reader = source.gzip
+	}
+	source.reader = tar.NewReader(reader)
+	return source, nil
+}
+
+func (s *tarSource) next() (mempoolItem, error) {
+	for {
+		header, err := s.reader.Next()
+		if err != nil {
+			return mempoolItem{}, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(s.reader)
+		if err != nil {
+			return mempoolItem{}, err
+		}
+		return mempoolItem{name: header.Name, data: data, named: true}, nil
+	}
+}
+
+func (s *tarSource) close() error {
+	if s.gzip != nil {
+		s.gzip.Close()
+	}
+	return s.file.Close()
+}
+
+type zipSource struct {
+	reader *zip.ReadCloser
+	pos    int
+}
+
+func newZipSource(path string) (*zipSource, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	return &zipSource{reader: reader}, nil
+}
+
+func (s *zipSource) next() (mempoolItem, error) {
+	for s.pos < len(s.reader.File) {
+		file := s.reader.File[s.pos]
+		s.pos++
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		contents, err := file.Open()
+		if err != nil {
+			return mempoolItem{}, err
+		}
+		data, err := io.ReadAll(contents)
+		contents.Close()
+		if err != nil {
+			return mempoolItem{}, err
+		}
+		return mempoolItem{name: file.Name, data: data, named: true}, nil
+	}
+	return mempoolItem{}, io.EOF
+}
+
+func (s *zipSource) close() error {
+	return s.reader.Close()
+}
+
+type jsonLinesSource struct {
+	file    *os.File
+	name    string
+	scanner *bufio.Scanner
+	lineNum int
+}
+
+func newJSONLinesSource(path string) (*jsonLinesSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	// a json transaction spells out its prevouts too, so allow well over the 400kB a standard tx can take
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+	return &jsonLinesSource{file: file, name: filepath.Base(path), scanner: scanner}, nil
+}
+
+func (s *jsonLinesSource) next() (mempoolItem, error) {
+	for s.scanner.Scan() {
+		s.lineNum++
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" {
+			continue
+		}
+		return mempoolItem{name: fmt.Sprintf("%s:%d", s.name, s.lineNum), data: []byte(line)}, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return mempoolItem{}, err
+	}
+	return mempoolItem{}, io.EOF
+}
+
+func (s *jsonLinesSource) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrMutatedMerkleTree is returned for a block whose merkle tree has two identical hashes paired up. since a level
+// with an odd number of nodes pairs the last one with itself, appending copies of the last transactions (CVE-2012-2459)
+// gives a different block with the same merkle root, so such a block can't be trusted to be the one that was mined
+var ErrMutatedMerkleTree = errors.New("merkle tree is mutated, a pair of its nodes are the same hash")
+
+// MerkleRoot is the merkle tree every root in this package comes from. hashes are the leaves in internal byte order
+// (chainhash.Hash as it comes out of TxHash or WitnessHash, not the reversed hex string) and a level with an odd
+// number of nodes pairs its last node with itself. mutated reports whether any level paired two identical hashes,
+// which bitcoin core rejects as bad-txns-duplicate. the root of no leaves is the zero hash
+func MerkleRoot(hashes []chainhash.Hash) (root chainhash.Hash, mutated bool) {
+	if len(hashes) == 0 {
+		return chainhash.Hash{}, false
+	}
+	level := hashes
+	for len(level) > 1 {
+		var levelMutated bool
+		level, levelMutated = merkleLevel(level)
+		mutated = mutated || levelMutated
+	}
+	return level[0], mutated
+}
+
+// merkleLevel hashes a level of the tree into the one above it, reporting whether two identical hashes were paired
+func merkleLevel(level []chainhash.Hash) ([]chainhash.Hash, bool) {
+	mutated := false
+	next := make([]chainhash.Hash, (len(level)+1)/2)
+	for i := range next {
+		left, right := 2*i, min(2*i+1, len(level)-1)
+		if left != right && level[left] == level[right] {
+			mutated = true
+		}
+		next[i] = hashMerkleNodes(&level[left], &level[right])
+	}
+	return next, mutated
+}
+
+// TxIdMerkleRoot returns the merkle root of a block's transactions (coinbase included), the one in its header
+func TxIdMerkleRoot(txs []*wire.MsgTx) (chainhash.Hash, bool) {
+	leaves := make([]chainhash.Hash, len(txs))
+	for i, tx := range txs {
+		leaves[i] = tx.TxHash()
+	}
+	return MerkleRoot(leaves)
+}
+
+// WitnessMerkleRoot returns the merkle root of a block's wtxids (coinbase included), the one the coinbase's witness
+// commitment commits to. the coinbase's wtxid counts as zero
+func WitnessMerkleRoot(txs []*wire.MsgTx) (chainhash.Hash, bool) {
+	leaves := make([]chainhash.Hash, len(txs))
+	for i, tx := range txs {
+		if i > 0 {
+			leaves[i] = tx.WitnessHash()
+		}
+	}
+	return MerkleRoot(leaves)
+}
+
+// MerkleBranch returns the hashes needed to recompute the merkle root from the leaf at index: the sibling at each
+// level of the tree, bottom up. for the coinbase (index 0) the branch doesn't depend on the coinbase's own hash,
+// which is what lets stratum hand it out before the extranonce is chosen
+func MerkleBranch(leaves []chainhash.Hash, index int) []chainhash.Hash {
+	var branch []chainhash.Hash
+	level := leaves
+	for len(level) > 1 {
+		branch = append(branch, level[min(index^1, len(level)-1)])
+		level, _ = merkleLevel(level)
+		index /= 2
+	}
+	return branch
+}
+
+// MerkleRootFromBranch folds a branch (see MerkleBranch) into the leaf at index, giving the merkle root
+func MerkleRootFromBranch(leaf chainhash.Hash, branch []chainhash.Hash, index int) chainhash.Hash {
+	root := leaf
+	for _, sibling := range branch {
+		if index&1 == 0 {
+			root = hashMerkleNodes(&root, &sibling)
+		} else {
+			root = hashMerkleNodes(&sibling, &root)
+		}
+		index /= 2
+	}
+	return root
+}
+
+// hashMerkleNodes hashes two nodes of a merkle tree into their parent
+func hashMerkleNodes(left, right *chainhash.Hash) chainhash.Hash {
+	var buf [chainhash.HashSize * 2]byte
+	copy(buf[:chainhash.HashSize], left[:])
+	copy(buf[chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// BlockTxIds returns the txids of a block's transactions in block order, the leaves of its merkle tree
+func BlockTxIds(block *wire.MsgBlock) []chainhash.Hash {
+	txIds := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txIds[i] = tx.TxHash()
+	}
+	return txIds
+}
+
+// PartialMerkleTree is the BIP37 encoding of the part of a merkle tree needed to prove some of its leaves: the tree
+// is walked depth first, with a flag bit for every node visited saying whether a matched leaf is under it, and a hash
+// for every node that isn't descended into (and for matched leaves)
+type PartialMerkleTree struct {
+	Total  uint32
+	Hashes []chainhash.Hash
+	Flags  []byte
+}
+
+// NewPartialMerkleTree builds the partial tree proving the leaves with matches set
+func NewPartialMerkleTree(leaves []chainhash.Hash, matches []bool) *PartialMerkleTree {
+	tree := &PartialMerkleTree{Total: uint32(len(leaves))}
+	builder := partialTreeBuilder{leaves: leaves, matches: matches, tree: tree}
+	builder.traverse(tree.height(), 0)
+	return tree
+}
+
+// height is the number of levels above the leaves
+func (p *PartialMerkleTree) height() int {
+	height := 0
+	for p.width(height) > 1 {
+		height++
+	}
+	return height
+}
+
+// width is the number of nodes at a height of the tree
+func (p *PartialMerkleTree) width(height int) int {
+	return int((uint64(p.Total) + (1 << height) - 1) >> height)
+}
+
+type partialTreeBuilder struct {
+	leaves  []chainhash.Hash
+	matches []bool
+	tree    *PartialMerkleTree
+	bits    int
+}
+
+func (b *partialTreeBuilder) addBit(bit bool) {
+	if b.bits%8 == 0 {
+		b.tree.Flags = append(b.tree.Flags, 0)
+	}
+	if bit {
+		b.tree.Flags[b.bits/8] |= 1 << (b.bits % 8)
+	}
+	b.bits++
+}
+
+func (b *partialTreeBuilder) traverse(height, pos int) {
+	parentOfMatch := false
+	for i := pos << height; i < (pos+1)<<height && i < len(b.leaves); i++ {
+		parentOfMatch = parentOfMatch || b.matches[i]
+	}
+	b.addBit(parentOfMatch)
+	if height == 0 || !parentOfMatch {
+		b.tree.Hashes = append(b.tree.Hashes, b.hash(height, pos))
+		return
+	}
+	b.traverse(height-1, pos*2)
+	if pos*2+1 < b.tree.width(height-1) {
+		b.traverse(height-1, pos*2+1)
+	}
+}
+
+func (b *partialTreeBuilder) hash(height, pos int) chainhash.Hash {
+	if height == 0 {
+		return b.leaves[pos]
+	}
+	left := b.hash(height-1, pos*2)
+	right := left
+	if pos*2+1 < b.tree.width(height-1) {
+		right = b.hash(height-1, pos*2+1)
+	}
+	return hashMerkleNodes(&left, &right)
+}
+
+// Extract recomputes the merkle root from a partial tree, returning it with the matched leaves and their indexes. like
+// bitcoin core it rejects trees that don't use exactly their hashes and flag bytes, and trees where a node's two
+// children are the same hash, which is how a duplicated leaf (CVE-2012-2459) would sneak in
+func (p *PartialMerkleTree) Extract() (chainhash.Hash, []chainhash.Hash, []int, error) {
+	if p.Total == 0 {
+		return chainhash.Hash{}, nil, nil, errors.New("partial merkle tree with no transactions")
+	}
+	if p.Total > wire.MaxBlockPayload/60 {
+		return chainhash.Hash{}, nil, nil, fmt.Errorf("partial merkle tree with too many transactions (%d)", p.Total)
+	}
+	if len(p.Hashes) > int(p.Total) {
+		return chainhash.Hash{}, nil, nil, errors.New("partial merkle tree with more hashes than transactions")
+	}
+	if len(p.Flags)*8 < len(p.Hashes) {
+		return chainhash.Hash{}, nil, nil, errors.New("partial merkle tree with fewer flag bits than hashes")
+	}
+	extractor := partialTreeExtractor{tree: p}
+	root, err := extractor.traverse(p.height(), 0)
+	if err != nil {
+		return chainhash.Hash{}, nil, nil, err
+	}
+	if (extractor.bits+7)/8 != len(p.Flags) {
+		return chainhash.Hash{}, nil, nil, errors.New("partial merkle tree doesn't use all its flag bytes")
+	}
+	if extractor.hashes != len(p.Hashes) {
+		return chainhash.Hash{}, nil, nil, errors.New("partial merkle tree doesn't use all its hashes")
+	}
+	return root, extractor.matched, extractor.indexes, nil
+}
+
+type partialTreeExtractor struct {
+	tree    *PartialMerkleTree
+	bits    int
+	hashes  int
+	matched []chainhash.Hash
+	indexes []int
+}
+
+func (e *partialTreeExtractor) traverse(height, pos int) (chainhash.Hash, error) {
+	if e.bits >= len(e.tree.Flags)*8 {
+		return chainhash.Hash{}, errors.New("partial merkle tree runs out of flag bits")
+	}
+	parentOfMatch := e.tree.Flags[e.bits/8]&(1<<(e.bits%8)) != 0
+	e.bits++
+	if height == 0 || !parentOfMatch {
+		if e.hashes >= len(e.tree.Hashes) {
+			return chainhash.Hash{}, errors.New("partial merkle tree runs out of hashes")
+		}
+		hash := e.tree.Hashes[e.hashes]
+		e.hashes++
+		if height == 0 && parentOfMatch {
+			e.matched = append(e.matched, hash)
+			e.indexes = append(e.indexes, pos)
+		}
+		return hash, nil
+	}
+	left, err := e.traverse(height-1, pos*2)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	right := left
+	if pos*2+1 < e.tree.width(height-1) {
+		if right, err = e.traverse(height-1, pos*2+1); err != nil {
+			return chainhash.Hash{}, err
+		}
+		if right == left {
+			return chainhash.Hash{}, errors.New("partial merkle tree has a node with two identical children")
+		}
+	}
+	return hashMerkleNodes(&left, &right), nil
+}
+
+// NewMerkleBlock builds the merkleblock message (what gettxoutproof returns) proving that the txids are in block
+func NewMerkleBlock(block *wire.MsgBlock, txIds []chainhash.Hash) (*wire.MsgMerkleBlock, error) {
+	wanted := make(map[chainhash.Hash]bool, len(txIds))
+	for _, txId := range txIds {
+		wanted[txId] = true
+	}
+	leaves := BlockTxIds(block)
+	matches := make([]bool, len(leaves))
+	found := 0
+	for i, leaf := range leaves {
+		if wanted[leaf] {
+			matches[i] = true
+			found++
+			delete(wanted, leaf)
+		}
+	}
+	for txId := range wanted {
+		return nil, fmt.Errorf("transaction %s is not in block %s", txId, block.BlockHash())
+	}
+	if found == 0 {
+		return nil, errors.New("no transactions to prove")
+	}
+	tree := NewPartialMerkleTree(leaves, matches)
+	merkleBlock := &wire.MsgMerkleBlock{Header: block.Header, Transactions: tree.Total, Flags: tree.Flags}
+	for i := range tree.Hashes {
+		merkleBlock.Hashes = append(merkleBlock.Hashes, &tree.Hashes[i])
+	}
+	return merkleBlock, nil
+}
+
+// VerifyMerkleBlock checks a merkleblock's partial tree against the merkle root in its header and returns the txids
+// it proves, like verifytxoutproof. it doesn't check the header's proof of work or that the block is in any chain
+func VerifyMerkleBlock(merkleBlock *wire.MsgMerkleBlock) ([]chainhash.Hash, error) {
+	tree := &PartialMerkleTree{Total: merkleBlock.Transactions, Flags: merkleBlock.Flags}
+	for _, hash := range merkleBlock.Hashes {
+		tree.Hashes = append(tree.Hashes, *hash)
+	}
+	root, matched, _, err := tree.Extract()
+	if err != nil {
+		return nil, err
+	}
+	if root != merkleBlock.Header.MerkleRoot {
+		return nil, fmt.Errorf("partial merkle tree root %s doesn't match the header's %s", root, merkleBlock.Header.MerkleRoot)
+	}
+	return matched, nil
+}
+
+// SerializeMerkleBlock returns a merkleblock in the network encoding gettxoutproof returns as hex
+func SerializeMerkleBlock(merkleBlock *wire.MsgMerkleBlock) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := merkleBlock.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeserializeMerkleBlock parses a merkleblock, e.g from gettxoutproof or SerializeMerkleBlock
+func DeserializeMerkleBlock(proof []byte) (*wire.MsgMerkleBlock, error) {
+	merkleBlock := new(wire.MsgMerkleBlock)
+	reader := bytes.NewReader(proof)
+	if err := merkleBlock.BtcDecode(reader, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, err
+	}
+	if reader.Len() > 0 {
+		return nil, fmt.Errorf("%d bytes left over after the merkleblock", reader.Len())
+	}
+	return merkleBlock, nil
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testMerkleTxs makes n distinct transactions, told apart by their locktime
+func testMerkleTxs(n int) []*wire.MsgTx {
+	txs := make([]*wire.MsgTx, n)
+	for i := range txs {
+		txs[i] = wire.NewMsgTx(2)
+		txs[i].AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: uint32(i)}, nil, nil))
+		txs[i].AddTxOut(wire.NewTxOut(int64(i), []byte{0x51}))
+		txs[i].LockTime = uint32(i)
+	}
+	return txs
+}
+
+func testMerkleLeaves(n int) []chainhash.Hash {
+	leaves := make([]chainhash.Hash, n)
+	for i := range leaves {
+		leaves[i] = chainhash.HashH([]byte(fmt.Sprintf("leaf %d", i)))
+	}
+	return leaves
+}
+
+func TestMerkleRootAgainstBtcd(t *testing.T) {
+	for n := 1; n <= 33; n++ {
+		txs := testMerkleTxs(n)
+		utilTxs := make([]*btcutil.Tx, n)
+		for i, tx := range txs {
+			utilTxs[i] = btcutil.NewTx(tx)
+		}
+		root, mutated := TxIdMerkleRoot(txs)
+		if want := blockchain.CalcMerkleRoot(utilTxs, false); root != want {
+			t.Errorf("%d txs: root %s, btcd has %s", n, root, want)
+		}
+		if mutated {
+			t.Errorf("%d distinct txs: tree reported mutated", n)
+		}
+	}
+	genesis := chaincfg.MainNetParams.GenesisBlock
+	if root, _ := TxIdMerkleRoot(genesis.Transactions); root != genesis.Header.MerkleRoot {
+		t.Errorf("genesis merkle root %s, header has %s", root, genesis.Header.MerkleRoot)
+	}
+}
+
+// TestMerkleRootMutation checks CVE-2012-2459: duplicating the last transaction, or the last pair, of a level with
+// an odd count gives the same root, and the duplicated tree has to be reported as mutated
+func TestMerkleRootMutation(t *testing.T) {
+	leaves := testMerkleLeaves(6)
+	tests := []struct {
+		name     string
+		original []chainhash.Hash
+		mutated  []chainhash.Hash
+	}{
+		{"last leaf of three", leaves[:3], append(leaves[:3:3], leaves[2])},
+		{"last leaf of five", leaves[:5], append(leaves[:5:5], leaves[4])},
+		{"last pair of six", leaves, append(leaves[:6:6], leaves[4], leaves[5])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, mutated := MerkleRoot(test.original)
+			if mutated {
+				t.Fatal("original tree reported mutated")
+			}
+			mutatedRoot, mutated := MerkleRoot(test.mutated)
+			if mutatedRoot != root {
+				t.Fatalf("duplicating leaves changed the root, so it isn't the collision being tested")
+			}
+			if !mutated {
+				t.Error("tree with duplicated leaves not reported mutated")
+			}
+		})
+	}
+	if _, mutated := MerkleRoot(leaves[:1]); mutated {
+		t.Error("a single leaf paired with itself reported mutated")
+	}
+	if root, mutated := MerkleRoot(nil); root != (chainhash.Hash{}) || mutated {
+		t.Errorf("no leaves: root %s, mutated %v", root, mutated)
+	}
+}
+
+func TestMerkleBranch(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := testMerkleLeaves(n)
+		root, _ := MerkleRoot(leaves)
+		for i, leaf := range leaves {
+			branch := MerkleBranch(leaves, i)
+			if got := MerkleRootFromBranch(leaf, branch, i); got != root {
+				t.Errorf("%d leaves, leaf %d: branch folds to %s, root is %s", n, i, got, root)
+			}
+			if n > 1 {
+				if got := MerkleRootFromBranch(leaves[(i+1)%n], branch, i); got == root {
+					t.Errorf("%d leaves, leaf %d: branch proves another leaf too", n, i)
+				}
+			}
+		}
+	}
+}
+
+func TestPartialMerkleTree(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 7, 8, 9, 16, 31, 100} {
+		leaves := testMerkleLeaves(n)
+		root, _ := MerkleRoot(leaves)
+		patterns := map[string]func(i int) bool{
+			"first":     func(i int) bool { return i == 0 },
+			"last":      func(i int) bool { return i == n-1 },
+			"every 3rd": func(i int) bool { return i%3 == 1 },
+			"all":       func(i int) bool { return true },
+			"none":      func(i int) bool { return false },
+		}
+		for name, pattern := range patterns {
+			matches := make([]bool, n)
+			var want []int
+			for i := range matches {
+				if matches[i] = pattern(i); matches[i] {
+					want = append(want, i)
+				}
+			}
+			tree := NewPartialMerkleTree(leaves, matches)
+			gotRoot, matched, indexes, err := tree.Extract()
+			if err != nil {
+				t.Fatalf("%d leaves, %s: %v", n, name, err)
+			}
+			if gotRoot != root {
+				t.Errorf("%d leaves, %s: root %s, want %s", n, name, gotRoot, root)
+			}
+			if fmt.Sprint(indexes) != fmt.Sprint(want) {
+				t.Errorf("%d leaves, %s: matched %v, want %v", n, name, indexes, want)
+			}
+			for j, index := range indexes {
+				if matched[j] != leaves[index] {
+					t.Errorf("%d leaves, %s: leaf %d extracted as %s", n, name, index, matched[j])
+				}
+			}
+		}
+	}
+}
+
+func TestPartialMerkleTreeTampered(t *testing.T) {
+	leaves := testMerkleLeaves(9)
+	root, _ := MerkleRoot(leaves)
+	matches := make([]bool, len(leaves))
+	matches[4] = true
+	build := func() *PartialMerkleTree { return NewPartialMerkleTree(leaves, matches) }
+
+	tampered := build()
+	tampered.Hashes[1][0] ^= 1
+	if gotRoot, _, _, err := tampered.Extract(); err == nil && gotRoot == root {
+		t.Error("tree with a changed hash still gives the root")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(tree *PartialMerkleTree)
+	}{
+		{"hash missing", func(tree *PartialMerkleTree) { tree.Hashes = tree.Hashes[:len(tree.Hashes)-1] }},
+		{"hash added", func(tree *PartialMerkleTree) { tree.Hashes = append(tree.Hashes, leaves[0]) }},
+		{"flag byte added", func(tree *PartialMerkleTree) { tree.Flags = append(tree.Flags, 0) }},
+		{"flags missing", func(tree *PartialMerkleTree) { tree.Flags = nil }},
+		{"no transactions", func(tree *PartialMerkleTree) { tree.Total = 0 }},
+		{"more hashes than transactions", func(tree *PartialMerkleTree) { tree.Total = 1 }},
+	}
+	for _, test := range tests {
+		tree := build()
+		test.tamper(tree)
+		if _, _, _, err := tree.Extract(); err == nil {
+			t.Errorf("%s: extracted without an error", test.name)
+		}
+	}
+
+	// proving a duplicated leaf of a mutated tree has two identical children right where the leaves are
+	mutated := append(leaves[:9:9], leaves[8])
+	duplicateMatches := make([]bool, len(mutated))
+	duplicateMatches[8], duplicateMatches[9] = true, true
+	if _, _, _, err := NewPartialMerkleTree(mutated, duplicateMatches).Extract(); err == nil {
+		t.Error("tree proving a duplicated leaf extracted without an error")
+	}
+}
+
+func TestMerkleBlockRoundTrip(t *testing.T) {
+	txs := testMerkleTxs(11)
+	root, _ := TxIdMerkleRoot(txs)
+	block := wire.NewMsgBlock(wire.NewBlockHeader(4, &chainhash.Hash{}, &root, 0, 0))
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	for i, tx := range txs {
+		txId := tx.TxHash()
+		merkleBlock, err := NewMerkleBlock(block, []chainhash.Hash{txId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := SerializeMerkleBlock(merkleBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DeserializeMerkleBlock(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proven, err := VerifyMerkleBlock(decoded)
+		if err != nil {
+			t.Fatalf("tx %d: %v", i, err)
+		}
+		if len(proven) != 1 || proven[0] != txId {
+			t.Errorf("tx %d: proof proves %v", i, proven)
+		}
+
+		decoded.Header.MerkleRoot[0] ^= 1
+		if _, err := VerifyMerkleBlock(decoded); err == nil {
+			t.Errorf("tx %d: proof verifies against another merkle root", i)
+		}
+	}
+	if _, err := NewMerkleBlock(block, []chainhash.Hash{{1}}); err == nil {
+		t.Error("proof of a transaction not in the block")
+	}
+}
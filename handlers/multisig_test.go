@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+)
+
+func TestVerifyCheckMultiSig(t *testing.T) {
+	// a 2-of-3 over three keys, each signature over a hash that depends on its hash type
+	var keys []*btcec.PrivateKey
+	multisigScript := []byte{script.OP_PUSHNUM_1 + 1}
+	for i := 0; i < 3; i++ {
+		seed := sha256.Sum256([]byte(fmt.Sprintf("multisig key %d", i)))
+		key, pubKey := btcec.PrivKeyFromBytes(seed[:])
+		keys = append(keys, key)
+		multisigScript = append(append(multisigScript, script.OP_PUSHBYTES_33), pubKey.SerializeCompressed()...)
+	}
+	multisigScript = append(multisigScript, script.OP_PUSHNUM_1+2, script.OP_CHECKMULTISIG)
+	sigHash := func(hashType uint32) []byte {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("sighash %d", hashType)))
+		return hash[:]
+	}
+	sign := func(key int, hashType uint32) []byte {
+		return append(ecdsa.Sign(keys[key], sigHash(hashType)).Serialize(), byte(hashType))
+	}
+	withHashType := func(sig []byte, hashType uint32) []byte {
+		return append(sig[:len(sig)-1:len(sig)-1], byte(hashType))
+	}
+
+	tests := []struct {
+		name  string
+		items [][]byte
+		valid bool
+	}{
+		{"keys 1 and 2", [][]byte{{}, sign(0, SigHashAll), sign(1, SigHashAll)}, true},
+		{"keys 1 and 3", [][]byte{{}, sign(0, SigHashAll), sign(2, SigHashAll)}, true},
+		{"keys 2 and 3", [][]byte{{}, sign(1, SigHashAll), sign(2, SigHashAll)}, true},
+		{"hash types of their own", [][]byte{{}, sign(0, SigHashAll), sign(2, SigHashSingle)}, true},
+		{"out of order", [][]byte{{}, sign(1, SigHashAll), sign(0, SigHashAll)}, false},
+		{"out of order, last and first", [][]byte{{}, sign(2, SigHashAll), sign(0, SigHashAll)}, false},
+		{"one key twice", [][]byte{{}, sign(0, SigHashAll), sign(0, SigHashAll)}, false},
+		{"dummy not empty", [][]byte{{0x00}, sign(0, SigHashAll), sign(1, SigHashAll)}, false},
+		{"no dummy", [][]byte{sign(0, SigHashAll), sign(1, SigHashAll)}, false},
+		{"too few signatures", [][]byte{{}, sign(0, SigHashAll)}, false},
+		{"too many signatures", [][]byte{{}, sign(0, SigHashAll), sign(1, SigHashAll), sign(2, SigHashAll)}, false},
+		{"empty signature", [][]byte{{}, sign(0, SigHashAll), {}}, false},
+		{"hash type byte changed", [][]byte{{}, sign(0, SigHashAll), withHashType(sign(1, SigHashAll), SigHashNone)}, false},
+		{"nothing", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := VerifyCheckMultiSig(sigHash, test.items, multisigScript); valid != test.valid {
+				t.Errorf("valid %v, want %v", valid, test.valid)
+			}
+		})
+	}
+	if VerifyCheckMultiSig(sigHash, [][]byte{{}, sign(0, SigHashAll), sign(1, SigHashAll)}, multisigScript[:len(multisigScript)-1]) {
+		t.Error("signatures verify against a script that isn't a multisig")
+	}
+}
+
+// TestMultisigSpendOutOfOrder swaps the signatures of a mempool multisig spend, which has to fail even though each
+// signature on its own is good
+func TestMultisigSpendOutOfOrder(t *testing.T) {
+	files, err := os.ReadDir(mempoolTestDir)
+	if err != nil {
+		t.Skip("no mempool directory:", err)
+	}
+	for _, file := range files {
+		transaction, err := LoadTxFile(filepath.Join(mempoolTestDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		for i, input := range transaction.Vin {
+			witness := input.Witness
+			if InputType(input) != script.P2WSH || len(witness) < 4 || witness[0] != "" {
+				continue
+			}
+			witnessScript, _ := hex.DecodeString(witness[len(witness)-1])
+			if required, _, err := script.ParseMultisig(witnessScript); err != nil || required < 2 || !VerifyTxSig(transaction, i) {
+				continue
+			}
+			swapped := transaction
+			swapped.Vin = append([]types.TransactionVin(nil), transaction.Vin...)
+			swapped.Vin[i].Witness = append([]string{"", witness[2], witness[1]}, witness[3:]...)
+			if VerifyTxSig(swapped, i) {
+				t.Errorf("%s input %d: multisig passes with its signatures swapped", transaction.TxID, i)
+			}
+			return
+		}
+	}
+	t.Skip("no multisig spend in the mempool")
+}
@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	pingTimeout      = 30 * time.Second
+	p2pUserAgentName = "sob-miner"
+	p2pUserAgentVer  = "0.1.0"
+	// maxInventory caps how many transactions and blocks a node keeps around to answer getdata with
+	maxInventory = 50000
+)
+
+// P2PNode speaks just enough of the bitcoin p2p protocol to relay blocks and transactions the way a node does: the
+// version/verack handshake, inv and getdata, tx, block and ping/pong. it keeps what it has announced or received so
+// it can answer getdata for it, and asks its peers for anything they announce that it doesn't have. everything else a
+// peer sends (addr, headers, sendcmpct, ...) is ignored. it works against a local regtest bitcoind as well as against
+// another P2PNode standing in for one
+type P2PNode struct {
+	// OnTx and OnBlock are called, from the peer's goroutine, with every transaction and block a peer sends us
+	OnTx    func(peer *Peer, tx *wire.MsgTx)
+	OnBlock func(peer *Peer, block *wire.MsgBlock)
+	// OnPeer is called with every peer once the handshake is done, before any of its messages are handled
+	OnPeer func(peer *Peer)
+	// StartHeight is the height we tell peers our best block is at
+	StartHeight int32
+
+	nonce uint64 // sent in our version messages, to notice connecting to ourselves
+
+	mu     sync.Mutex
+	peers  map[*Peer]bool
+	txs    map[chainhash.Hash]*wire.MsgTx // by txid
+	blocks map[chainhash.Hash]*wire.MsgBlock
+	order  []wire.InvVect // inventory in the order it was added, for evicting the oldest
+}
+
+// NewP2PNode creates a node with no peers and nothing in its inventory
+func NewP2PNode() *P2PNode {
+	return &P2PNode{
+		nonce:  rand.Uint64(),
+		peers:  map[*Peer]bool{},
+		txs:    map[chainhash.Hash]*wire.MsgTx{},
+		blocks: map[chainhash.Hash]*wire.MsgBlock{},
+	}
+}
+
+// Peer is a connection to another node, after the handshake
+type Peer struct {
+	node    *P2PNode
+	conn    net.Conn
+	inbound bool
+	// Version is the version message the peer sent
+	Version *wire.MsgVersion
+
+	writeMu sync.Mutex
+	pingMu  sync.Mutex
+	pongs   map[uint64]chan struct{}
+}
+
+// String is the peer's address, with its user agent once known
+func (p *Peer) String() string {
+	if p.Version != nil {
+		return p.conn.RemoteAddr().String() + " " + p.Version.UserAgent
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// Connect dials a peer, does the handshake and starts reading from it
+func (n *P2PNode) Connect(addr string) (*Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := n.handshake(conn, false)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s: %v", addr, err)
+	}
+	go n.run(peer)
+	return peer, nil
+}
+
+// ListenAndServe accepts peers on addr until the listener fails
+func (n *P2PNode) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return n.Serve(listener)
+}
+
+// Serve accepts peers on a listener until it fails
+func (n *P2PNode) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			peer, err := n.handshake(conn, true)
+			if err != nil {
+				fmt.Println("Rejecting peer", conn.RemoteAddr(), ":", err)
+				conn.Close()
+				return
+			}
+			n.run(peer)
+		}()
+	}
+}
+
+// Peers returns the connected peers
+func (n *P2PNode) Peers() []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peers := make([]*Peer, 0, len(n.peers))
+	for peer := range n.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// versionMessage is our side of the handshake. we relay witness blocks and transactions, so we say we do
+func (n *P2PNode) versionMessage(conn net.Conn) *wire.MsgVersion {
+	netAddress := func(addr net.Addr) *wire.NetAddress {
+		host, portStr, _ := net.SplitHostPort(addr.String())
+		port, _ := strconv.ParseUint(portStr, 10, 16)
+		return wire.NewNetAddressIPPort(net.ParseIP(host), uint16(port), 0)
+	}
+	version := wire.NewMsgVersion(netAddress(conn.LocalAddr()), netAddress(conn.RemoteAddr()), n.nonce, n.StartHeight)
+	version.Services = wire.SFNodeWitness
+	version.AddrMe.Services = wire.SFNodeWitness
+	version.AddUserAgent(p2pUserAgentName, p2pUserAgentVer)
+	return version
+}
+
+// handshake exchanges version and verack. we send our version first when we dialled, and after theirs when they did
+func (n *P2PNode) handshake(conn net.Conn, inbound bool) (*Peer, error) {
+	peer := &Peer{node: n, conn: conn, inbound: inbound, pongs: map[uint64]chan struct{}{}}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if !inbound {
+		if err := peer.send(n.versionMessage(conn)); err != nil {
+			return nil, err
+		}
+	}
+	for gotVerack := false; peer.Version == nil || !gotVerack; {
+		msg, err := peer.read()
+		if errors.Is(err, wire.ErrUnknownMessage) {
+			// e.g wtxidrelay or sendaddrv2, which come between version and verack
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *wire.MsgVersion:
+			if peer.Version != nil {
+				return nil, errors.New("duplicate version message")
+			}
+			if msg.Nonce == n.nonce {
+				return nil, errors.New("connected to ourselves")
+			}
+			if msg.ProtocolVersion < int32(wire.SendHeadersVersion) {
+				return nil, fmt.Errorf("protocol version %d is too old", msg.ProtocolVersion)
+			}
+			peer.Version = msg
+			if inbound {
+				if err := peer.send(n.versionMessage(conn)); err != nil {
+					return nil, err
+				}
+			}
+			if err := peer.send(wire.NewMsgVerAck()); err != nil {
+				return nil, err
+			}
+		case *wire.MsgVerAck:
+			if peer.Version == nil {
+				return nil, errors.New("verack before version")
+			}
+			gotVerack = true
+		}
+	}
+	return peer, nil
+}
+
+// send writes a message to the peer. it's safe to call from several goroutines
+func (p *Peer) send(msg wire.Message) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	_, err := wire.WriteMessageWithEncodingN(p.conn, msg, wire.ProtocolVersion, NetParams.Net, wire.WitnessEncoding)
+	return err
+}
+
+func (p *Peer) read() (wire.Message, error) {
+	_, msg, _, err := wire.ReadMessageWithEncodingN(p.conn, wire.ProtocolVersion, NetParams.Net, wire.WitnessEncoding)
+	return msg, err
+}
+
+// run handles a peer's messages until the connection goes
+func (n *P2PNode) run(peer *Peer) {
+	n.mu.Lock()
+	n.peers[peer] = true
+	n.mu.Unlock()
+	if n.OnPeer != nil {
+		n.OnPeer(peer)
+	}
+	defer func() {
+		n.mu.Lock()
+		delete(n.peers, peer)
+		n.mu.Unlock()
+		peer.conn.Close()
+	}()
+	for {
+		msg, err := peer.read()
+		var messageErr *wire.MessageError
+		if errors.Is(err, wire.ErrUnknownMessage) || errors.As(err, &messageErr) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if err := n.handle(peer, msg); err != nil {
+			fmt.Println("Disconnecting peer", peer, ":", err)
+			return
+		}
+	}
+}
+
+func (n *P2PNode) handle(peer *Peer, msg wire.Message) error {
+	switch msg := msg.(type) {
+	case *wire.MsgPing:
+		return peer.send(wire.NewMsgPong(msg.Nonce))
+	case *wire.MsgPong:
+		peer.pingMu.Lock()
+		if done, ok := peer.pongs[msg.Nonce]; ok {
+			close(done)
+			delete(peer.pongs, msg.Nonce)
+		}
+		peer.pingMu.Unlock()
+	case *wire.MsgInv:
+		// ask for whatever we don't have, with witnesses
+		request := wire.NewMsgGetData()
+		for _, inv := range msg.InvList {
+			if n.has(inv) {
+				continue
+			}
+			switch inv.Type {
+			case wire.InvTypeTx, wire.InvTypeWitnessTx:
+				request.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessTx, &inv.Hash))
+			case wire.InvTypeBlock, wire.InvTypeWitnessBlock:
+				request.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &inv.Hash))
+			}
+		}
+		if len(request.InvList) > 0 {
+			return peer.send(request)
+		}
+	case *wire.MsgGetData:
+		notFound := wire.NewMsgNotFound()
+		for _, inv := range msg.InvList {
+			if reply := n.lookup(inv); reply != nil {
+				if err := peer.send(reply); err != nil {
+					return err
+				}
+			} else {
+				notFound.AddInvVect(inv)
+			}
+		}
+		if len(notFound.InvList) > 0 {
+			return peer.send(notFound)
+		}
+	case *wire.MsgTx:
+		txHash := msg.TxHash()
+		if n.add(wire.NewInvVect(wire.InvTypeTx, &txHash), msg, nil) && n.OnTx != nil {
+			n.OnTx(peer, msg)
+		}
+	case *wire.MsgBlock:
+		blockHash := msg.BlockHash()
+		if n.add(wire.NewInvVect(wire.InvTypeBlock, &blockHash), nil, msg) && n.OnBlock != nil {
+			n.OnBlock(peer, msg)
+		}
+	}
+	return nil
+}
+
+// has reports whether an inventory item is already known
+func (n *P2PNode) has(inv *wire.InvVect) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch inv.Type {
+	case wire.InvTypeTx, wire.InvTypeWitnessTx:
+		return n.txs[inv.Hash] != nil
+	case wire.InvTypeBlock, wire.InvTypeWitnessBlock:
+		return n.blocks[inv.Hash] != nil
+	}
+	return true
+}
+
+// lookup returns the message answering a getdata for an inventory item, nil if we don't have it. a plain tx or block
+// request gets it without witnesses
+func (n *P2PNode) lookup(inv *wire.InvVect) wire.Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch inv.Type {
+	case wire.InvTypeWitnessTx:
+		if tx := n.txs[inv.Hash]; tx != nil {
+			return tx
+		}
+	case wire.InvTypeTx:
+		if tx := n.txs[inv.Hash]; tx != nil {
+			return stripWitnesses(tx)
+		}
+	case wire.InvTypeWitnessBlock:
+		if block := n.blocks[inv.Hash]; block != nil {
+			return block
+		}
+	case wire.InvTypeBlock:
+		if block := n.blocks[inv.Hash]; block != nil {
+			stripped := wire.NewMsgBlock(&block.Header)
+			for _, tx := range block.Transactions {
+				stripped.AddTransaction(stripWitnesses(tx))
+			}
+			return stripped
+		}
+	}
+	return nil
+}
+
+func stripWitnesses(tx *wire.MsgTx) *wire.MsgTx {
+	if !tx.HasWitness() {
+		return tx
+	}
+	stripped := tx.Copy()
+	for _, txIn := range stripped.TxIn {
+		txIn.Witness = nil
+	}
+	return stripped
+}
+
+// add puts a transaction or block in the inventory, reporting false if it was already there
+func (n *P2PNode) add(inv *wire.InvVect, tx *wire.MsgTx, block *wire.MsgBlock) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if tx != nil {
+		if n.txs[inv.Hash] != nil {
+			return false
+		}
+		n.txs[inv.Hash] = tx
+	} else {
+		if n.blocks[inv.Hash] != nil {
+			return false
+		}
+		n.blocks[inv.Hash] = block
+	}
+	n.order = append(n.order, *inv)
+	if len(n.order) > maxInventory {
+		oldest := n.order[0]
+		n.order = n.order[1:]
+		delete(n.txs, oldest.Hash)
+		delete(n.blocks, oldest.Hash)
+	}
+	return true
+}
+
+// AnnounceBlock adds a block to the inventory and sends an inv for it to every peer, who'll getdata it
+func (n *P2PNode) AnnounceBlock(block *wire.MsgBlock) {
+	blockHash := block.BlockHash()
+	inv := wire.NewInvVect(wire.InvTypeBlock, &blockHash)
+	n.add(inv, nil, block)
+	n.announce(inv)
+}
+
+// AnnounceTxs adds transactions to the inventory and sends every peer an inv for them
+func (n *P2PNode) AnnounceTxs(txs []*wire.MsgTx) {
+	invs := make([]*wire.InvVect, 0, len(txs))
+	for _, tx := range txs {
+		txHash := tx.TxHash()
+		inv := wire.NewInvVect(wire.InvTypeTx, &txHash)
+		n.add(inv, tx, nil)
+		invs = append(invs, inv)
+	}
+	n.announce(invs...)
+}
+
+func (n *P2PNode) announce(invs ...*wire.InvVect) {
+	for _, peer := range n.Peers() {
+		for start := 0; start < len(invs); start += wire.MaxInvPerMsg {
+			msg := wire.NewMsgInvSizeHint(uint(min(len(invs)-start, wire.MaxInvPerMsg)))
+			for _, inv := range invs[start:min(start+wire.MaxInvPerMsg, len(invs))] {
+				msg.AddInvVect(inv)
+			}
+			if err := peer.send(msg); err != nil {
+				fmt.Println("Announcing to", peer, "failed:", err)
+				break
+			}
+		}
+	}
+}
+
+// Ping sends a ping and waits for the pong, returning the round trip time
+func (p *Peer) Ping() (time.Duration, error) {
+	nonce := rand.Uint64()
+	done := make(chan struct{})
+	p.pingMu.Lock()
+	p.pongs[nonce] = done
+	p.pingMu.Unlock()
+	start := time.Now()
+	if err := p.send(wire.NewMsgPing(nonce)); err != nil {
+		return 0, err
+	}
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-time.After(pingTimeout):
+		p.pingMu.Lock()
+		delete(p.pongs, nonce)
+		p.pingMu.Unlock()
+		return 0, fmt.Errorf("no pong from %s", p)
+	}
+}
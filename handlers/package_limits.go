@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// carveOutSize is how big (in vbytes) a transaction with a single unconfirmed ancestor can be and still get in over
+// that ancestor's descendant limits, core's CPFP carve out: one more descendant and this much more size
+const carveOutSize = 10000
+
+// PackageLimits caps the families transactions form in the mempool, counting the transaction itself, like core's
+// -limitancestorcount, -limitancestorsize, -limitdescendantcount and -limitdescendantsize. sizes are in vbytes
+type PackageLimits struct {
+	AncestorCount   int
+	AncestorSize    int
+	DescendantCount int
+	DescendantSize  int
+}
+
+// DefaultPackageLimits are bitcoin core's: 25 transactions and 101 kvB either way
+var DefaultPackageLimits = PackageLimits{AncestorCount: 25, AncestorSize: 101000, DescendantCount: 25, DescendantSize: 101000}
+
+// MempoolLimits are the limits LoadMempool and MempoolWatcher admit transactions with
+var MempoolLimits = DefaultPackageLimits
+
+// the limits a transaction can go over, told apart like bitcoind's reject reasons for them
+var (
+	ErrTooManyAncestors   = errors.New("too many unconfirmed ancestors")
+	ErrAncestorSize       = errors.New("unconfirmed ancestors too large")
+	ErrTooManyDescendants = errors.New("too many descendants")
+	ErrDescendantSize     = errors.New("descendants too large")
+)
+
+// PackageStats are a mempool transaction's ancestors and descendants taken together, both counting the transaction
+// itself, as getmempoolentry reports them
+type PackageStats struct {
+	AncestorCount   int
+	AncestorSize    int
+	AncestorFees    int
+	DescendantCount int
+	DescendantSize  int
+	DescendantFees  int
+}
+
+// Ancestors returns the txids of the transactions in the index whose outputs the transaction spends, directly or
+// not. the transaction doesn't have to be in the index itself
+func (c *ConflictIndex) Ancestors(transaction types.TransactionData) []string {
+	seen := map[string]bool{transaction.TxID: true}
+	var ancestors []string
+	queue := []types.TransactionData{transaction}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, input := range current.Vin {
+			parent, ok := c.txs[input.TxID]
+			if !ok || seen[input.TxID] {
+				continue
+			}
+			seen[input.TxID] = true
+			ancestors = append(ancestors, input.TxID)
+			queue = append(queue, parent)
+		}
+	}
+	return ancestors
+}
+
+// Package works out the ancestor and descendant aggregates of a transaction in the index
+func (c *ConflictIndex) Package(txId string) PackageStats {
+	var stats PackageStats
+	for _, ancestor := range append([]string{txId}, c.Ancestors(c.txs[txId])...) {
+		vsize, fee := c.vsizeAndFee(ancestor)
+		stats.AncestorCount++
+		stats.AncestorSize += vsize
+		stats.AncestorFees += fee
+	}
+	for _, descendant := range c.Descendants([]string{txId}) {
+		vsize, fee := c.vsizeAndFee(descendant)
+		stats.DescendantCount++
+		stats.DescendantSize += vsize
+		stats.DescendantFees += fee
+	}
+	return stats
+}
+
+// MempoolEntry describes a transaction in the index the way getmempoolentry does
+func (c *ConflictIndex) MempoolEntry(txId string) types.MempoolEntry {
+	transaction := c.txs[txId]
+	vsize, fee := c.vsizeAndFee(txId)
+	stats := c.Package(txId)
+	entry := types.MempoolEntry{
+		TxID:              txId,
+		WTxID:             transaction.WTxID,
+		VSize:             vsize,
+		Fee:               fee,
+		AncestorCount:     stats.AncestorCount,
+		AncestorSize:      stats.AncestorSize,
+		AncestorFees:      stats.AncestorFees,
+		DescendantCount:   stats.DescendantCount,
+		DescendantSize:    stats.DescendantSize,
+		DescendantFees:    stats.DescendantFees,
+		Depends:           []string{},
+		SpentBy:           []string{},
+		BIP125Replaceable: c.replaceable(txId),
+	}
+	seen := map[string]bool{}
+	for _, input := range transaction.Vin {
+		if c.Has(input.TxID) && !seen[input.TxID] {
+			seen[input.TxID] = true
+			entry.Depends = append(entry.Depends, input.TxID)
+		}
+	}
+	for i := range transaction.Vout {
+		if spender, ok := c.spenders[outpointKey(txId, i)]; ok && !seen[spender] {
+			seen[spender] = true
+			entry.SpentBy = append(entry.SpentBy, spender)
+		}
+	}
+	return entry
+}
+
+// Check decides whether a transaction can join the mempool the index describes, once the transactions it replaces
+// (see ReplacementPolicy.Check) are gone, without it or any family it joins going over the limits: its own
+// ancestors, the descendants of each of its ancestors, and the ancestors of anything spending its outputs that got
+// in before it. a small transaction with a single unconfirmed ancestor gets the CPFP carve out. the index is left as
+// it was
+func (l PackageLimits) Check(index *ConflictIndex, transaction types.TransactionData, replaced []string) error {
+	// try it out: take out what it replaces, put it in and look at every family it's in, then undo that
+	removed := make([]types.TransactionData, 0, len(replaced))
+	for _, txId := range replaced {
+		removed = append(removed, index.txs[txId])
+		index.Remove(txId)
+	}
+	index.Add(transaction)
+	defer func() {
+		index.Remove(transaction.TxID)
+		for _, old := range removed {
+			index.Add(old)
+		}
+	}()
+
+	stats := index.Package(transaction.TxID)
+	if err := l.checkAncestors(transaction.TxID, stats); err != nil {
+		return err
+	}
+	if err := l.checkDescendants(transaction.TxID, stats, l.DescendantCount, l.DescendantSize); err != nil {
+		return err
+	}
+	ancestors := index.Ancestors(transaction)
+	descendantCount, descendantSize := l.DescendantCount, l.DescendantSize
+	if vsize, _ := index.vsizeAndFee(transaction.TxID); len(ancestors) == 1 && vsize <= carveOutSize {
+		descendantCount++
+		descendantSize += carveOutSize
+	}
+	for _, ancestor := range ancestors {
+		if err := l.checkDescendants(ancestor, index.Package(ancestor), descendantCount, descendantSize); err != nil {
+			return err
+		}
+	}
+	for _, descendant := range index.Descendants([]string{transaction.TxID})[1:] {
+		if err := l.checkAncestors(descendant, index.Package(descendant)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l PackageLimits) checkAncestors(txId string, stats PackageStats) error {
+	if stats.AncestorCount > l.AncestorCount {
+		return fmt.Errorf("%w: %s would have %d, the limit is %d", ErrTooManyAncestors, txId, stats.AncestorCount, l.AncestorCount)
+	}
+	if stats.AncestorSize > l.AncestorSize {
+		return fmt.Errorf("%w: %s would have %d vB, the limit is %d", ErrAncestorSize, txId, stats.AncestorSize, l.AncestorSize)
+	}
+	return nil
+}
+
+func (l PackageLimits) checkDescendants(txId string, stats PackageStats, count, size int) error {
+	if stats.DescendantCount > count {
+		return fmt.Errorf("%w: %s would have %d, the limit is %d", ErrTooManyDescendants, txId, stats.DescendantCount, count)
+	}
+	if stats.DescendantSize > size {
+		return fmt.Errorf("%w: %s would have %d vB, the limit is %d", ErrDescendantSize, txId, stats.DescendantSize, size)
+	}
+	return nil
+}
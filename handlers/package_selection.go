@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// packageSelector keeps track of which entries are in the block so far and scores every other one together with the
+// ancestors of it that aren't in yet (its ancestor package), like the modified entries core's block assembler keeps.
+// entries are linked to each other through the outputs they spend
+type packageSelector struct {
+	entries  []*TxEntry
+	strategy string
+	parents  [][]int // indexes of the entries whose outputs an entry spends
+	children [][]int
+	inBlock  []bool
+	failed   []bool // invalid, a descendant of an invalid entry, or a duplicate, so never selectable
+	version  []int  // bumped when an entry is scored again, so its older scores in the queue are ignored
+	queue    packageHeap
+}
+
+// packageScore is an entry's ancestor package as it was when the entry was scored
+type packageScore struct {
+	entry   int
+	fee     int
+	weight  int
+	version int
+}
+
+// packageHeap is a max heap on the strategy's score of each package, see packageSelector.better
+type packageHeap struct {
+	items  []packageScore
+	better func(a, b packageScore) bool
+}
+
+func (h packageHeap) Len() int            { return len(h.items) }
+func (h packageHeap) Less(i, j int) bool  { return h.better(h.items[i], h.items[j]) }
+func (h packageHeap) Swap(i, j int)       { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *packageHeap) Push(x interface{}) { h.items = append(h.items, x.(packageScore)) }
+func (h *packageHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+func newPackageSelector(entries []*TxEntry, strategy string) *packageSelector {
+	s := &packageSelector{
+		entries:  entries,
+		strategy: strategy,
+		parents:  make([][]int, len(entries)),
+		children: make([][]int, len(entries)),
+		inBlock:  make([]bool, len(entries)),
+		failed:   make([]bool, len(entries)),
+		version:  make([]int, len(entries)),
+	}
+	s.queue.better = s.better
+	positions := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		if _, ok := positions[entry.Tx.TxID]; ok {
+			s.failed[i] = true
+			continue
+		}
+		positions[entry.Tx.TxID] = i
+	}
+	for i, entry := range entries {
+		if s.failed[i] {
+			continue
+		}
+		seen := map[int]bool{}
+		for _, input := range entry.Tx.Vin {
+			if parent, ok := positions[input.TxID]; ok && parent != i && !seen[parent] {
+				seen[parent] = true
+				s.parents[i] = append(s.parents[i], parent)
+				s.children[parent] = append(s.children[parent], i)
+			}
+		}
+	}
+	for i := range entries {
+		if !s.failed[i] {
+			s.queue.items = append(s.queue.items, s.score(i))
+		}
+	}
+	heap.Init(&s.queue)
+	return s
+}
+
+// better reports whether package a goes before package b: by feerate, by fee, or for StrategyNone by where the entry
+// itself is in the list. ties go to the entry earlier in the list
+func (s *packageSelector) better(a, b packageScore) bool {
+	switch s.strategy {
+	case StrategyFeeRate, "":
+		// a.fee / a.weight > b.fee / b.weight, without dividing
+		if a.fee*b.weight != b.fee*a.weight {
+			return a.fee*b.weight > b.fee*a.weight
+		}
+	case StrategyFee:
+		if a.fee != b.fee {
+			return a.fee > b.fee
+		}
+	}
+	return a.entry < b.entry
+}
+
+// ancestorPackage returns an entry with its ancestors that aren't in the block yet, parents before children, and
+// their total fee and weight
+func (s *packageSelector) ancestorPackage(i int) ([]int, int, int) {
+	var pkg []int
+	visited := map[int]bool{}
+	var visit func(j int)
+	visit = func(j int) {
+		visited[j] = true
+		for _, parent := range s.parents[j] {
+			if !s.inBlock[parent] && !visited[parent] {
+				visit(parent)
+			}
+		}
+		pkg = append(pkg, j)
+	}
+	visit(i)
+	fee, weight := 0, 0
+	for _, j := range pkg {
+		fee += s.entries[j].Fee
+		weight += s.entries[j].Weight
+	}
+	return pkg, fee, weight
+}
+
+func (s *packageSelector) score(i int) packageScore {
+	_, fee, weight := s.ancestorPackage(i)
+	return packageScore{entry: i, fee: fee, weight: weight, version: s.version[i]}
+}
+
+// order returns the selectable entries best package first, as they're scored right now
+func (s *packageSelector) order() []int {
+	items := append([]packageScore(nil), s.queue.items...)
+	sort.Slice(items, func(i, j int) bool { return s.better(items[i], items[j]) })
+	order := make([]int, len(items))
+	for i, item := range items {
+		order[i] = item.entry
+	}
+	return order
+}
+
+// next returns the entry with the best package, or false once none is left to try
+func (s *packageSelector) next() (int, bool) {
+	for s.queue.Len() > 0 {
+		item := heap.Pop(&s.queue).(packageScore)
+		if item.version == s.version[item.entry] && !s.inBlock[item.entry] && !s.failed[item.entry] {
+			return item.entry, true
+		}
+	}
+	return 0, false
+}
+
+// include marks a package as in the block, and scores the descendants of its entries again now that their packages
+// got smaller
+func (s *packageSelector) include(pkg []int) {
+	for _, i := range pkg {
+		s.inBlock[i] = true
+	}
+	for _, i := range s.descendants(pkg) {
+		if !s.inBlock[i] && !s.failed[i] {
+			s.version[i]++
+			heap.Push(&s.queue, s.score(i))
+		}
+	}
+}
+
+// fail rules out an entry and everything spending its outputs
+func (s *packageSelector) fail(i int) {
+	for _, j := range s.descendants([]int{i}) {
+		s.failed[j] = true
+	}
+}
+
+// descendants returns the entries along with every entry spending their outputs, directly or not
+func (s *packageSelector) descendants(entries []int) []int {
+	seen := map[int]bool{}
+	var descendants []int
+	queue := append([]int(nil), entries...)
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		descendants = append(descendants, i)
+		queue = append(queue, s.children[i]...)
+	}
+	return descendants
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// PayoutScript is the scriptpubkey the coinbase pays the block reward to. when nil the coinbase pays to Address
+var PayoutScript []byte
+
+// SetNetwork switches the network addresses are encoded and decoded for
+func SetNetwork(name string) error {
+	switch name {
+	case "mainnet", "main", "":
+		NetParams = &chaincfg.MainNetParams
+	case "testnet", "testnet3", "test":
+		NetParams = &chaincfg.TestNet3Params
+	case "regtest":
+		NetParams = &chaincfg.RegressionNetParams
+	case "signet":
+		NetParams = &chaincfg.SigNetParams
+	default:
+		return fmt.Errorf("unknown network %q", name)
+	}
+	return nil
+}
+
+// SetPayoutDescriptor points the coinbase payout at the script described by desc, see ParsePayoutDescriptor
+func SetPayoutDescriptor(desc string) error {
+	payoutScript, err := ParsePayoutDescriptor(desc)
+	if err != nil {
+		return err
+	}
+	PayoutScript = payoutScript
+	return nil
+}
+
+// ParsePayoutDescriptor turns an output descriptor into the scriptpubkey it describes. the supported forms are
+// addr(ADDRESS), raw(HEX), pk(KEY), pkh(KEY), wpkh(KEY), sh(wpkh(KEY)) and tr(KEY), plus a bare address. a trailing
+// #checksum is accepted but not checked
+func ParsePayoutDescriptor(desc string) ([]byte, error) {
+	desc = strings.TrimSpace(desc)
+	if checksumStart := strings.LastIndex(desc, "#"); checksumStart >= 0 {
+		desc = desc[:checksumStart]
+	}
+	function, arg, isFunction := splitDescriptor(desc)
+	if !isFunction {
+		return AddressScript(desc)
+	}
+	switch function {
+	case "addr":
+		return AddressScript(arg)
+	case "raw":
+		return hex.DecodeString(arg)
+	case "pk", "pkh", "wpkh":
+		pubKey, err := descriptorPubKey(arg)
+		if err != nil {
+			return nil, err
+		}
+		switch function {
+		case "pk":
+			return script.PayToPubKey(pubKey.SerializeCompressed()), nil
+		case "pkh":
+			return script.PayToPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed())), nil
+		default:
+			return script.PayToWitness(0, btcutil.Hash160(pubKey.SerializeCompressed())), nil
+		}
+	case "sh":
+		innerScript, err := ParsePayoutDescriptor(arg)
+		if err != nil {
+			return nil, err
+		}
+		return script.PayToScriptHash(btcutil.Hash160(innerScript)), nil
+	case "tr":
+		internalKey, err := descriptorPubKey(arg)
+		if err != nil {
+			return nil, err
+		}
+		// key path only, so the output key is the internal key tweaked with an empty script tree
+		outputKey := txscript.ComputeTaprootKeyNoScript(internalKey)
+		return script.PayToWitness(1, schnorr.SerializePubKey(outputKey)), nil
+	}
+	return nil, fmt.Errorf("unsupported descriptor %q", desc)
+}
+
+// splitDescriptor splits "func(arg)" into its function name and argument
+func splitDescriptor(desc string) (string, string, bool) {
+	open := strings.Index(desc, "(")
+	if open <= 0 || !strings.HasSuffix(desc, ")") {
+		return "", "", false
+	}
+	return desc[:open], desc[open+1 : len(desc)-1], true
+}
+
+// descriptorPubKey parses a hex pubkey in a descriptor, which may be compressed, uncompressed or x-only
+func descriptorPubKey(keyHex string) (*btcec.PublicKey, error) {
+	keyBytes, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) == 32 {
+		return schnorr.ParsePubKey(keyBytes)
+	}
+	return btcec.ParsePubKey(keyBytes)
+}
+
+// AddressScript decodes an address for the current network into its scriptpubkey
+func AddressScript(address string) ([]byte, error) {
+	decoded, err := btcutil.DecodeAddress(address, NetParams)
+	if err != nil {
+		return nil, err
+	}
+	if !decoded.IsForNet(NetParams) {
+		return nil, fmt.Errorf("address %s is not for %s", address, NetParams.Name)
+	}
+	return txscript.PayToAddrScript(decoded)
+}
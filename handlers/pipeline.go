@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ValidationWorkers is how many goroutines the validation pipeline uses, one per core by default
+var ValidationWorkers = runtime.NumCPU()
+
+// TxEntry wraps a transaction with everything selection needs to know about it, worked out once: its two
+// serializations, sizes, weight, fee and feerate, and (after ValidateTxs) the result of validating it
+type TxEntry struct {
+	Tx          types.TransactionData
+	Stripped    *wire.MsgTx // without witnesses, what the block's merkle root commits to
+	WithWitness *wire.MsgTx
+	BaseSize    int // serialized size without witnesses
+	Size        int // serialized size with witnesses
+	Weight      int
+	Fee         int
+	FeeRate     float64 // sats per weight unit
+	Validated   bool
+	Err         error // why validation failed, nil if the tx is valid
+}
+
+// NewTxEntry serializes a transaction and caches its sizes, weight and fee
+func NewTxEntry(transaction types.TransactionData) *TxEntry {
+	stripped, withWitness, strippedBytes, witnessBytes := SerializeATx(transaction)
+	entry := &TxEntry{
+		Tx:          transaction,
+		Stripped:    stripped,
+		WithWitness: withWitness,
+		BaseSize:    len(strippedBytes),
+		Size:        len(witnessBytes),
+		Fee:         TxFee(transaction),
+	}
+	entry.Weight = entry.BaseSize*3 + entry.Size
+	if entry.Weight > 0 {
+		entry.FeeRate = float64(entry.Fee) / float64(entry.Weight)
+	}
+	return entry
+}
+
+// Valid reports whether the entry has been validated and passed
+func (e *TxEntry) Valid() bool {
+	return e.Validated && e.Err == nil
+}
+
+// VSize is the virtual size, weight / 4 rounded up
+func (e *TxEntry) VSize() int {
+	return (e.Weight + 3) / 4
+}
+
+// forEachParallel calls fn for every index in [0, n) on at most workers goroutines and waits for them all. fn writes
+// its result into a slot for its index, which keeps results in input order however the work gets scheduled
+func forEachParallel(n int, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// NewTxEntries wraps transactions in entries without validating them, on ValidationWorkers goroutines
+func NewTxEntries(transactions []types.TransactionData) []*TxEntry {
+	entries := make([]*TxEntry, len(transactions))
+	forEachParallel(len(transactions), ValidationWorkers, func(i int) {
+		entries[i] = NewTxEntry(transactions[i])
+	})
+	return entries
+}
+
+// ValidateTxs wraps every transaction in an entry and checks it against the profile, spreading the work over a pool
+// of workers goroutines. the entries come back in the same order as the transactions
+func ValidateTxs(transactions []types.TransactionData, profile *Profile, workers int) []*TxEntry {
+	entries := make([]*TxEntry, len(transactions))
+	if BatchSchnorr {
+		forEachParallel(len(transactions), workers, func(i int) {
+			entries[i] = NewTxEntry(transactions[i])
+		})
+		ValidateEntries(entries, profile, workers)
+		return entries
+	}
+	forEachParallel(len(transactions), workers, func(i int) {
+		entries[i] = NewTxEntry(transactions[i])
+		ValidateEntry(entries[i], profile)
+	})
+	return entries
+}
+
+// ValidateEntries checks the entries that haven't been validated yet against the profile, on a pool of workers
+// goroutines. with BatchSchnorr set the taproot signatures of all of them are verified together at the end
+func ValidateEntries(entries []*TxEntry, profile *Profile, workers int) {
+	if BatchSchnorr {
+		validateEntriesBatched(entries, profile, workers)
+		return
+	}
+	forEachParallel(len(entries), workers, func(i int) {
+		if !entries[i].Validated {
+			ValidateEntry(entries[i], profile)
+		}
+	})
+}
+
+// ValidateEntry checks an entry against the profile and records the result on it
+func ValidateEntry(entry *TxEntry, profile *Profile) {
+	checkEntry(entry, func() error {
+		return profile.CheckTx(entry.Tx)
+	})
+}
+
+// checkEntry runs a check of an entry and records its result on it. a check panicking on a malformed transaction
+// fails the entry with ErrMalformedTx instead of taking down the worker, and with it the whole run
+func checkEntry(entry *TxEntry, check func() error) {
+	defer func() {
+		if r := recover(); r != nil {
+			entry.Err = fmt.Errorf("%w: validating it panicked: %v", ErrMalformedTx, r)
+		}
+		entry.Validated = true
+	}()
+	entry.Err = check()
+}
+
+// validateEntriesBatched runs the profile against the entries with their BIP340 signatures deferred, then verifies
+// the signatures of every entry that passed everything else in one go. an entry with a bad signature fails the
+// signatures rule at the input the signature belongs to
+func validateEntriesBatched(entries []*TxEntry, profile *Profile, workers int) {
+	deferred := make([][]SchnorrSig, len(entries))
+	forEachParallel(len(entries), workers, func(i int) {
+		if entries[i].Validated {
+			return
+		}
+		checkEntry(entries[i], func() error {
+			var err error
+			deferred[i], err = profile.CheckTxDeferred(entries[i].Tx)
+			return err
+		})
+	})
+	var sigs []SchnorrSig
+	var owners []*TxEntry
+	for i, entrySigs := range deferred {
+		for _, sig := range entrySigs {
+			sigs = append(sigs, sig)
+			owners = append(owners, entries[i])
+		}
+	}
+	for i, valid := range VerifySchnorrSigs(sigs, workers) {
+		if !valid && owners[i].Err == nil {
+			owners[i].Err = &RuleError{Rule: SignaturesRule.Name(), Input: sigs[i].InputIndex, Err: errSignatureFailed}
+		}
+	}
+}
+
+// VerifySchnorrSigs verifies signatures in batches, one batch per worker goroutine, see VerifySchnorrBatch
+func VerifySchnorrSigs(sigs []SchnorrSig, workers int) []bool {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]bool, len(sigs))
+	chunk := (len(sigs) + workers - 1) / workers
+	if chunk == 0 {
+		return results
+	}
+	forEachParallel((len(sigs)+chunk-1)/chunk, workers, func(c int) {
+		start := c * chunk
+		end := min(start+chunk, len(sigs))
+		copy(results[start:end], VerifySchnorrBatch(sigs[start:end]))
+	})
+	return results
+}
+
+// SortEntries orders entries according to a selection strategy, using the cached fees and weights
+func SortEntries(entries []*TxEntry, strategy string) error {
+	switch strategy {
+	case StrategyFeeRate, "":
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].FeeRate > entries[j].FeeRate
+		})
+	case StrategyFee:
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Fee > entries[j].Fee
+		})
+	case StrategyNone:
+	default:
+		return errUnknownStrategy(strategy)
+	}
+	return nil
+}
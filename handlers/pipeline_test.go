@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// TestValidateTxsRecoversPanics checks that a check panicking on one transaction fails that entry with
+// ErrMalformedTx and leaves the others alone, batched or not
+func TestValidateTxsRecoversPanics(t *testing.T) {
+	panicky := NewProfile("panicky", NewRule("panics-on-locktime", ScopeTx, func(ctx *RuleContext) error {
+		if ctx.Tx.Locktime == 1 {
+			var witness []string
+			_ = witness[1]
+		}
+		return nil
+	}))
+	transactions := []types.TransactionData{{Locktime: 0}, {Locktime: 1}, {Locktime: 2}}
+	batched := BatchSchnorr
+	t.Cleanup(func() { BatchSchnorr = batched })
+	for _, batch := range []bool{false, true} {
+		BatchSchnorr = batch
+		entries := ValidateTxs(transactions, panicky, 2)
+		for i, entry := range entries {
+			if !entry.Validated {
+				t.Errorf("batched %v: entry %d not validated", batch, i)
+			}
+			if panicked := errors.Is(entry.Err, ErrMalformedTx); panicked != (i == 1) {
+				t.Errorf("batched %v: entry %d failed with %v", batch, i, entry.Err)
+			}
+		}
+	}
+}
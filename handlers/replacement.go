@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// MaxBIP125RBFSequence is the highest input sequence that signals a transaction can be replaced (BIP125)
+const MaxBIP125RBFSequence = 0xfffffffd
+
+// ReplacementPolicy decides whether a transaction spending the same outputs as transactions already in the mempool
+// replaces them, following bitcoin core's version of BIP125
+type ReplacementPolicy struct {
+	// FullRBF lets any transaction be replaced, whether it signals or not, like core's -mempoolfullrbf
+	FullRBF bool
+	// IncrementalRelayFee is what a replacement has to pay on top of the fees it evicts for its own relay, in sats
+	// per 1000 vbytes
+	IncrementalRelayFee int
+	// MaxEvictions caps how many transactions, the conflicting ones and their descendants, one replacement evicts
+	MaxEvictions int
+}
+
+// DefaultReplacementPolicy is bitcoin core's: opt-in signaling, 1 sat/vB incremental relay fee and 100 evictions
+var DefaultReplacementPolicy = ReplacementPolicy{IncrementalRelayFee: 1000, MaxEvictions: 100}
+
+// RBFPolicy is the policy LoadMempool and MempoolWatcher settle conflicts with
+var RBFPolicy = DefaultReplacementPolicy
+
+// the reasons a replacement is turned down, told apart like bitcoind's reject reasons for them
+var (
+	ErrTxNotReplaceable             = errors.New("conflicts with a transaction that doesn't signal replaceability")
+	ErrReplacementSpendsConflicting = errors.New("spends an output of a transaction it would replace")
+	ErrReplacementAddsUnconfirmed   = errors.New("spends an unconfirmed output none of the replaced transactions spend")
+	ErrReplacementFeeRate           = errors.New("feerate isn't higher than the feerate of a transaction it replaces")
+	ErrReplacementFee               = errors.New("fee is less than the fees of the transactions it replaces")
+	ErrReplacementRelayFee          = errors.New("doesn't pay for its own relay on top of the fees it replaces")
+	ErrTooManyReplacements          = errors.New("would evict too many transactions")
+)
+
+// SignalsRBF reports whether a transaction opts in to replacement itself, with an input sequence at or below
+// MaxBIP125RBFSequence
+func SignalsRBF(transaction types.TransactionData) bool {
+	for _, input := range transaction.Vin {
+		if input.Sequence <= MaxBIP125RBFSequence {
+			return true
+		}
+	}
+	return false
+}
+
+// ConflictIndex keeps track of which mempool transaction spends each output, to find the transactions a new one
+// conflicts with and the ancestors and descendants of any of them. it only needs the inputs and outputs, so
+// transactions don't have to be validated to go in, and are only serialized when their size is asked for
+type ConflictIndex struct {
+	txs      map[string]types.TransactionData // by txid
+	spenders map[string]string                // txid of the spender, by outpoint
+	sizes    map[string]indexedSize           // by txid, filled in as they're needed
+}
+
+type indexedSize struct {
+	vsize int
+	fee   int
+}
+
+// NewConflictIndex creates an empty index
+func NewConflictIndex() *ConflictIndex {
+	return &ConflictIndex{txs: map[string]types.TransactionData{}, spenders: map[string]string{}, sizes: map[string]indexedSize{}}
+}
+
+// Add puts a transaction in the index. it doesn't check for conflicts, an output spent twice is taken to be spent by
+// the transaction added last
+func (c *ConflictIndex) Add(transaction types.TransactionData) {
+	c.txs[transaction.TxID] = transaction
+	for _, input := range transaction.Vin {
+		if !input.IsCoinbase {
+			c.spenders[outpointKey(input.TxID, input.Vout)] = transaction.TxID
+		}
+	}
+}
+
+// Remove takes a transaction out of the index. its descendants stay, see Descendants
+func (c *ConflictIndex) Remove(txId string) {
+	transaction, ok := c.txs[txId]
+	if !ok {
+		return
+	}
+	delete(c.txs, txId)
+	delete(c.sizes, txId)
+	for _, input := range transaction.Vin {
+		key := outpointKey(input.TxID, input.Vout)
+		if c.spenders[key] == txId {
+			delete(c.spenders, key)
+		}
+	}
+}
+
+// Has reports whether the transaction is in the index
+func (c *ConflictIndex) Has(txId string) bool {
+	_, ok := c.txs[txId]
+	return ok
+}
+
+// Conflicts returns the txids of the transactions in the index spending an output the transaction spends too, each
+// once, in input order
+func (c *ConflictIndex) Conflicts(transaction types.TransactionData) []string {
+	seen := map[string]bool{}
+	var conflicts []string
+	for _, input := range transaction.Vin {
+		spender, ok := c.spenders[outpointKey(input.TxID, input.Vout)]
+		if ok && spender != transaction.TxID && !seen[spender] {
+			seen[spender] = true
+			conflicts = append(conflicts, spender)
+		}
+	}
+	return conflicts
+}
+
+// Descendants returns the txids along with every transaction in the index spending their outputs, directly or not,
+// parents before children: a transaction comes after every one of the others it spends, even when it spends two of
+// them at different depths
+func (c *ConflictIndex) Descendants(txIds []string) []string {
+	found := map[string]bool{}
+	var reached []string
+	queue := append([]string(nil), txIds...)
+	for len(queue) > 0 {
+		txId := queue[0]
+		queue = queue[1:]
+		if found[txId] {
+			continue
+		}
+		found[txId] = true
+		reached = append(reached, txId)
+		for i := range c.txs[txId].Vout {
+			if spender, ok := c.spenders[outpointKey(txId, i)]; ok {
+				queue = append(queue, spender)
+			}
+		}
+	}
+	// the walk above goes breadth first, so a child can turn up before a parent deeper down. put every transaction
+	// after the ones it spends from
+	descendants := make([]string, 0, len(reached))
+	placed := map[string]bool{}
+	var place func(txId string)
+	place = func(txId string) {
+		placed[txId] = true
+		for _, input := range c.txs[txId].Vin {
+			if found[input.TxID] && !placed[input.TxID] {
+				place(input.TxID)
+			}
+		}
+		descendants = append(descendants, txId)
+	}
+	for _, txId := range reached {
+		if !placed[txId] {
+			place(txId)
+		}
+	}
+	return descendants
+}
+
+// vsizeAndFee returns the virtual size and fee of a transaction in the index, serializing it the first time
+func (c *ConflictIndex) vsizeAndFee(txId string) (int, int) {
+	if size, ok := c.sizes[txId]; ok {
+		return size.vsize, size.fee
+	}
+	transaction := c.txs[txId]
+	size := indexedSize{vsize: (TxWeight(transaction) + 3) / 4, fee: TxFee(transaction)}
+	c.sizes[txId] = size
+	return size.vsize, size.fee
+}
+
+// replaceable reports whether a transaction signals replaceability itself or inherits it from an unconfirmed
+// ancestor that does. that's BIP125's inherited signaling, which core only reports (bip125-replaceable in
+// getmempoolentry) and never acts on, so Check doesn't use it
+func (c *ConflictIndex) replaceable(txId string) bool {
+	seen := map[string]bool{}
+	queue := []string{txId}
+	for len(queue) > 0 {
+		transaction, ok := c.txs[queue[0]]
+		queue = queue[1:]
+		if !ok || seen[transaction.TxID] {
+			continue
+		}
+		seen[transaction.TxID] = true
+		if SignalsRBF(transaction) {
+			return true
+		}
+		for _, input := range transaction.Vin {
+			queue = append(queue, input.TxID)
+		}
+	}
+	return false
+}
+
+// Check decides whether a transaction may go into the mempool the index describes. a transaction without conflicts
+// always may. one with conflicts has to follow the BIP125 rules as core applies them: every transaction it conflicts
+// with signals itself, an ancestor signaling doesn't count (unless FullRBF), it spends no unconfirmed output the
+// conflicting ones don't, it pays a higher feerate than each of them and at least the fees of everything it evicts plus
+// IncrementalRelayFee for its own size, and it evicts at most MaxEvictions transactions. it returns the txids of the
+// transactions that have to go, parents first
+func (p ReplacementPolicy) Check(index *ConflictIndex, transaction types.TransactionData) ([]string, error) {
+	conflicts := index.Conflicts(transaction)
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+	if !p.FullRBF {
+		for _, txId := range conflicts {
+			if !SignalsRBF(index.txs[txId]) {
+				return nil, fmt.Errorf("%w: %s", ErrTxNotReplaceable, txId)
+			}
+		}
+	}
+	evicted := index.Descendants(conflicts)
+	if len(evicted) > p.MaxEvictions {
+		return nil, fmt.Errorf("%w: %d, the limit is %d", ErrTooManyReplacements, len(evicted), p.MaxEvictions)
+	}
+	evicting := make(map[string]bool, len(evicted))
+	for _, txId := range evicted {
+		evicting[txId] = true
+	}
+	conflictParents := map[string]bool{}
+	for _, txId := range conflicts {
+		for _, input := range index.txs[txId].Vin {
+			conflictParents[input.TxID] = true
+		}
+	}
+	for _, input := range transaction.Vin {
+		if evicting[input.TxID] {
+			return nil, fmt.Errorf("%w: %s", ErrReplacementSpendsConflicting, input.TxID)
+		}
+		if index.Has(input.TxID) && !conflictParents[input.TxID] {
+			return nil, fmt.Errorf("%w: %s:%d", ErrReplacementAddsUnconfirmed, input.TxID, input.Vout)
+		}
+	}
+
+	fee := TxFee(transaction)
+	vsize := (TxWeight(transaction) + 3) / 4
+	for _, txId := range conflicts {
+		conflictVSize, conflictFee := index.vsizeAndFee(txId)
+		// fee / vsize <= conflictFee / conflictVSize, without dividing
+		if fee*conflictVSize <= conflictFee*vsize {
+			return nil, fmt.Errorf("%w: %d sats in %d vB against %s's %d sats in %d vB", ErrReplacementFeeRate,
+				fee, vsize, txId, conflictFee, conflictVSize)
+		}
+	}
+	evictedFees := 0
+	for _, txId := range evicted {
+		_, evictedFee := index.vsizeAndFee(txId)
+		evictedFees += evictedFee
+	}
+	if fee < evictedFees {
+		return nil, fmt.Errorf("%w: %d sats against %d", ErrReplacementFee, fee, evictedFees)
+	}
+	if relayFee := p.IncrementalRelayFee * vsize / 1000; fee-evictedFees < relayFee {
+		return nil, fmt.Errorf("%w: pays %d sats more, needs %d", ErrReplacementRelayFee, fee-evictedFees, relayFee)
+	}
+	return evicted, nil
+}
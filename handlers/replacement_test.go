@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// testTxId gives a test transaction a txid from its name
+func testTxId(name string) string {
+	return chainhash.HashH([]byte(name)).String()
+}
+
+// testIndexTx makes a transaction with two outputs spending the given "name:vout" outpoints, all with the sequence
+func testIndexTx(name string, sequence int, spends ...string) types.TransactionData {
+	transaction := types.TransactionData{TxID: testTxId(name), Version: 2}
+	for _, outpoint := range spends {
+		parent, vout, _ := strings.Cut(outpoint, ":")
+		index, _ := strconv.Atoi(vout)
+		transaction.Vin = append(transaction.Vin, types.TransactionVin{
+			TxID: testTxId(parent), Vout: index, Sequence: sequence, Prevout: types.TransactionVout{Value: 10000},
+		})
+	}
+	transaction.Vout = []types.TransactionVout{{Value: 1000}, {Value: 1000}}
+	return transaction
+}
+
+func TestDescendantsParentsFirst(t *testing.T) {
+	// a diamond with sides of different depths: d spends a directly and through b and c, so a breadth first walk
+	// reaches d from a before it reaches c
+	index := NewConflictIndex()
+	for _, transaction := range []types.TransactionData{
+		testIndexTx("d", 0xffffffff, "a:1", "c:0"),
+		testIndexTx("c", 0xffffffff, "b:0"),
+		testIndexTx("b", 0xffffffff, "a:0"),
+		testIndexTx("a", 0xffffffff, "confirmed:0"),
+		testIndexTx("e", 0xffffffff, "d:0", "b:1"),
+	} {
+		index.Add(transaction)
+	}
+	names := map[string]string{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		names[testTxId(name)] = name
+	}
+	var descendants []string
+	for _, txId := range index.Descendants([]string{testTxId("a")}) {
+		descendants = append(descendants, names[txId])
+	}
+	if len(descendants) != 5 {
+		t.Fatalf("descendants %v, want all five", descendants)
+	}
+	position := map[string]int{}
+	for i, name := range descendants {
+		position[name] = i
+	}
+	for child, parents := range map[string][]string{"b": {"a"}, "c": {"b"}, "d": {"a", "c"}, "e": {"d", "b"}} {
+		for _, parent := range parents {
+			if position[parent] > position[child] {
+				t.Errorf("%s comes before its parent %s in %v", child, parent, descendants)
+			}
+		}
+	}
+	var got []string
+	for _, txId := range index.Descendants([]string{testTxId("c")}) {
+		got = append(got, names[txId])
+	}
+	if strings.Join(got, ",") != "c,d,e" {
+		t.Errorf("descendants of c %v, want c,d,e", got)
+	}
+}
+
+func TestReplacementNeedsOwnSignal(t *testing.T) {
+	index := NewConflictIndex()
+	index.Add(testIndexTx("parent", MaxBIP125RBFSequence, "confirmed:0"))
+	index.Add(testIndexTx("child", 0xffffffff, "parent:0"))
+	if entry := index.MempoolEntry(testTxId("child")); !entry.BIP125Replaceable {
+		t.Error("child of a signaling parent not reported bip125-replaceable")
+	}
+
+	replacement := testIndexTx("replacement", MaxBIP125RBFSequence, "parent:0")
+	if _, err := DefaultReplacementPolicy.Check(index, replacement); !errors.Is(err, ErrTxNotReplaceable) {
+		t.Errorf("replacing a child that only inherits signaling: %v", err)
+	}
+	fullRBF := DefaultReplacementPolicy
+	fullRBF.FullRBF = true
+	if _, err := fullRBF.Check(index, replacement); errors.Is(err, ErrTxNotReplaceable) {
+		t.Errorf("full rbf: %v", err)
+	}
+
+	index.Add(testIndexTx("signaling-child", MaxBIP125RBFSequence, "parent:1"))
+	if _, err := DefaultReplacementPolicy.Check(index, testIndexTx("other", 0xffffffff, "parent:1")); errors.Is(err, ErrTxNotReplaceable) {
+		t.Errorf("replacing a child that signals itself: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// RPCClient makes json-rpc calls to a bitcoind style server, ours (RPCServer) or a real node
+type RPCClient struct {
+	URL      string
+	User     string
+	Password string
+	Client   *http.Client
+}
+
+// Call calls a method and decodes its result into result, which may be nil to ignore it
+func (c *RPCClient) Call(method string, params []interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "1.0", "id": method, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.User != "" || c.Password != "" {
+		request.SetBasicAuth(c.User, c.Password)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResponse, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%s: unauthorized", c.URL)
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s: %v (http %s)", method, err, httpResponse.Status)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s: %s (code %d)", method, response.Error.Message, response.Error.Code)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// GetBlockTemplate asks for a segwit block template
+func (c *RPCClient) GetBlockTemplate() (types.BlockTemplate, error) {
+	var template types.BlockTemplate
+	err := c.Call("getblocktemplate", []interface{}{map[string]interface{}{"rules": []string{"segwit"}}}, &template)
+	return template, err
+}
+
+// SubmitBlock submits a block, returning the reject reason if it wasn't accepted
+func (c *RPCClient) SubmitBlock(block *wire.MsgBlock) (string, error) {
+	var blockBytes bytes.Buffer
+	if err := block.Serialize(&blockBytes); err != nil {
+		return "", err
+	}
+	var reason *string
+	if err := c.Call("submitblock", []interface{}{hex.EncodeToString(blockBytes.Bytes())}, &reason); err != nil {
+		return "", err
+	}
+	if reason != nil {
+		return *reason, nil
+	}
+	return "", nil
+}
+
+// BlockFromTemplate assembles an unmined block from a getblocktemplate result: a coinbase paying coinbasevalue to
+// our payout and carrying the default witness commitment, then the template's transactions in order. a template
+// where a transaction depends on, or spends an output of, one that doesn't come before it is turned down with
+// ErrTemplateOrder, since the block would be invalid
+func BlockFromTemplate(template types.BlockTemplate) (*wire.MsgBlock, error) {
+	txs := make([]*wire.MsgTx, len(template.Transactions))
+	positions := make(map[chainhash.Hash]int, len(template.Transactions))
+	for i, templateTx := range template.Transactions {
+		_, tx, err := DecodeRawTx(templateTx.Data)
+		if err != nil {
+			return nil, fmt.Errorf("template tx %d: %v", i, err)
+		}
+		txs[i] = tx
+		positions[tx.TxHash()] = i + 1
+	}
+	for i, templateTx := range template.Transactions {
+		for _, parent := range templateTx.Depends {
+			if parent < 1 || parent > i {
+				return nil, fmt.Errorf("%w: template tx %d depends on %d", ErrTemplateOrder, i+1, parent)
+			}
+		}
+		for _, txIn := range txs[i].TxIn {
+			if parent, ok := positions[txIn.PreviousOutPoint.Hash]; ok && parent > i {
+				return nil, fmt.Errorf("%w: template tx %d spends tx %d", ErrTemplateOrder, i+1, parent)
+			}
+		}
+	}
+	commitmentScript, err := hex.DecodeString(template.DefaultWitnessCommitment)
+	if err != nil {
+		return nil, fmt.Errorf("default_witness_commitment: %v", err)
+	}
+	coinbaseTx := CreateAndModCoinbaseTxWithSecondOutput(commitmentScript)
+	coinbaseTx.TxOut[0].Value = int64(template.CoinbaseValue)
+
+	prevBlock, err := chainhash.NewHashFromStr(template.PreviousBlockHash)
+	if err != nil {
+		return nil, fmt.Errorf("previousblockhash: %v", err)
+	}
+	bits, err := strconv.ParseUint(template.Bits, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bits: %v", err)
+	}
+	merkleRoot, err := CreateMerkleTree(txs, false, coinbaseTx)
+	if err != nil {
+		return nil, err
+	}
+	header := wire.NewBlockHeader(template.Version, prevBlock, merkleRoot, uint32(bits), 0)
+	header.Timestamp = time.Unix(template.CurTime, 0)
+	block := wire.NewMsgBlock(header)
+	block.AddTransaction(coinbaseTx)
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	return block, nil
+}
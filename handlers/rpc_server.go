@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// the error codes bitcoind's json-rpc uses for the errors the server can return
+const (
+	rpcParseError        = -32700
+	rpcInvalidRequest    = -32600
+	rpcMethodNotFound    = -32601
+	rpcInvalidParams     = -32602
+	rpcMiscError         = -1
+	rpcInvalidParameter  = -8
+	rpcDeserializeError  = -22
+	longPollTimeout      = 60 * time.Second
+	maxRPCRequestSize    = 32 * 1024 * 1024
+	defaultRejectReason  = "rejected"
+	submitBlockDuplicate = "duplicate"
+)
+
+// rejectReasons maps the block rules to the BIP22 reasons bitcoind gives for the same failures
+var rejectReasons = map[string]string{
+	"coinbase":           "bad-cb-missing",
+	"block-double-spend": "bad-txns-inputs-missingorspent",
+	"merkle-root":        "bad-txnmrklroot",
+	"pow":                "high-hash",
+	"block-weight":       "bad-blk-weight",
+	"block-sigops":       "bad-blk-sigops",
+	"coinbase-value":     "bad-cb-amount",
+}
+
+// rejectErrorReasons gives the BIP22 reasons for failures bitcoind tells apart within one of our rules
+var rejectErrorReasons = map[error]string{
+	ErrMutatedMerkleTree:     "bad-txns-duplicate",
+	ErrBadWitnessNonceSize:   "bad-witness-nonce-size",
+	ErrBadWitnessMerkleMatch: "bad-witness-merkle-match",
+	ErrUnexpectedWitness:     "unexpected-witness",
+}
+
+// RPCServer serves block templates over bitcoind compatible json-rpc, so mining software can work from our block
+// assembly: getblocktemplate (BIP22/BIP23, with long polling and proposals) and submitblock. a submitted block is
+// checked with CheckBlock against the mempool the templates were built from
+type RPCServer struct {
+	// User and Password, when set, are required as http basic auth, like bitcoind's rpcuser and rpcpassword
+	User     string
+	Password string
+	// OnBlock is called with every block submitted that passes the checks
+	OnBlock func(block *wire.MsgBlock)
+
+	mu        sync.Mutex
+	builder   *BlockBuilder
+	template  *types.BlockTemplate
+	updates   chan struct{} // closed and replaced whenever the builder changes, waking long polls
+	generated int           // how many builders there have been, part of the long poll id
+	submitted map[chainhash.Hash]bool
+}
+
+// NewRPCServer creates a server handing out templates from the builder
+func NewRPCServer(builder *BlockBuilder) *RPCServer {
+	server := &RPCServer{updates: make(chan struct{}), submitted: map[chainhash.Hash]bool{}}
+	server.SetBuilder(builder)
+	return server
+}
+
+// SetBuilder replaces the builder templates come from, e.g after the mempool changed, and answers pending long polls
+func (s *RPCServer) SetBuilder(builder *BlockBuilder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.builder = builder
+	s.template = nil
+	s.generated++
+	close(s.updates)
+	s.updates = make(chan struct{})
+}
+
+// currentTemplate returns the template for the current builder, building it the first time, along with its long
+// poll id and the channel that's closed when it's replaced
+func (s *RPCServer) currentTemplate() (types.BlockTemplate, chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.template == nil {
+		template, err := s.builder.Template()
+		if err != nil {
+			return types.BlockTemplate{}, nil, err
+		}
+		template.LongPollID = fmt.Sprintf("%s%d", template.PreviousBlockHash, s.generated)
+		s.template = &template
+	}
+	template := *s.template
+	template.CurTime = time.Now().Unix()
+	return template, s.updates, nil
+}
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc,omitempty"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	Result interface{}     `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// templateRequest is the optional argument of getblocktemplate
+type templateRequest struct {
+	Mode         string   `json:"mode"`
+	Capabilities []string `json:"capabilities"`
+	Rules        []string `json:"rules"`
+	LongPollID   string   `json:"longpollid"`
+	Data         string   `json:"data"`
+}
+
+// ServeHTTP handles a json-rpc request, or a batch of them
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "json-rpc requests have to be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.User != "" || s.Password != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, maxRPCRequestSize)); err != nil {
+		writeRPCJSON(w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+		return
+	}
+	trimmed := bytes.TrimSpace(body.Bytes())
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var requests []rpcRequest
+		if err := json.Unmarshal(trimmed, &requests); err != nil {
+			writeRPCJSON(w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			return
+		}
+		responses := make([]rpcResponse, len(requests))
+		for i, request := range requests {
+			responses[i] = s.handle(r, request)
+		}
+		writeRPCJSON(w, responses)
+		return
+	}
+	var request rpcRequest
+	if err := json.Unmarshal(trimmed, &request); err != nil {
+		writeRPCJSON(w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+		return
+	}
+	writeRPCJSON(w, s.handle(r, request))
+}
+
+func writeRPCJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handle runs one json-rpc call
+func (s *RPCServer) handle(r *http.Request, request rpcRequest) rpcResponse {
+	response := rpcResponse{ID: request.ID}
+	var result interface{}
+	var err error
+	switch request.Method {
+	case "getblocktemplate":
+		result, err = s.getBlockTemplate(r, request.Params)
+	case "submitblock":
+		result, err = s.submitBlock(request.Params)
+	case "":
+		err = &rpcError{Code: rpcInvalidRequest, Message: "missing method"}
+	default:
+		err = &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+	}
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: rpcMiscError, Message: err.Error()}
+		}
+		response.Error = rpcErr
+		return response
+	}
+	response.Result = result
+	return response
+}
+
+// getBlockTemplate implements getblocktemplate. like bitcoind it insists on the client supporting segwit, answers
+// proposals with the reason a block would be rejected (or null), and holds a long poll until the template changes
+func (s *RPCServer) getBlockTemplate(r *http.Request, params []json.RawMessage) (interface{}, error) {
+	var request templateRequest
+	if len(params) > 0 {
+		if err := json.Unmarshal(params[0], &request); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "template request: " + err.Error()}
+		}
+	}
+	switch request.Mode {
+	case "", "template":
+	case "proposal":
+		if request.Data == "" {
+			return nil, &rpcError{Code: rpcInvalidParameter, Message: "Missing data String key for proposal"}
+		}
+		block, err := decodeBlockHex(request.Data)
+		if err != nil {
+			return nil, err
+		}
+		return s.checkSubmittedBlock(block, false), nil
+	default:
+		return nil, &rpcError{Code: rpcInvalidParameter, Message: "Invalid mode"}
+	}
+	segwit := false
+	for _, rule := range request.Rules {
+		segwit = segwit || rule == "segwit"
+	}
+	if !segwit {
+		return nil, &rpcError{Code: rpcInvalidParameter, Message: "getblocktemplate must be called with the segwit rule set (call with {\"rules\": [\"segwit\"]})"}
+	}
+
+	template, updates, err := s.currentTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if request.LongPollID != "" && request.LongPollID == template.LongPollID {
+		select {
+		case <-updates:
+		case <-time.After(longPollTimeout):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		if template, _, err = s.currentTemplate(); err != nil {
+			return nil, err
+		}
+	}
+	return template, nil
+}
+
+// submitBlock implements submitblock: null when the block is accepted, otherwise a BIP22 reject reason
+func (s *RPCServer) submitBlock(params []json.RawMessage) (interface{}, error) {
+	if len(params) == 0 {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "submitblock takes the block as hex"}
+	}
+	var blockHex string
+	if err := json.Unmarshal(params[0], &blockHex); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "block hex: " + err.Error()}
+	}
+	block, err := decodeBlockHex(blockHex)
+	if err != nil {
+		return nil, err
+	}
+	if reason := s.checkSubmittedBlock(block, true); reason != nil {
+		return *reason, nil
+	}
+	return nil, nil
+}
+
+func decodeBlockHex(blockHex string) (*wire.MsgBlock, error) {
+	blockBytes, err := hex.DecodeString(strings.TrimSpace(blockHex))
+	if err != nil {
+		return nil, &rpcError{Code: rpcDeserializeError, Message: "Block decode failed"}
+	}
+	block := new(wire.MsgBlock)
+	if err := block.Deserialize(bytes.NewReader(blockBytes)); err != nil {
+		return nil, &rpcError{Code: rpcDeserializeError, Message: "Block decode failed"}
+	}
+	return block, nil
+}
+
+// checkSubmittedBlock checks a block built on one of our templates, returning nil if it's fine or the reason it
+// isn't. with accept set a good block is remembered, so it's a duplicate if it comes again, and passed to OnBlock
+func (s *RPCServer) checkSubmittedBlock(block *wire.MsgBlock, accept bool) *string {
+	reason := func(r string) *string { return &r }
+	blockHash := block.BlockHash()
+	s.mu.Lock()
+	duplicate := s.submitted[blockHash]
+	builder := s.builder
+	s.mu.Unlock()
+	if duplicate {
+		return reason(submitBlockDuplicate)
+	}
+	if block.Header.PrevBlock.String() != PrevBlockHash {
+		return reason("bad-prevblk")
+	}
+	if len(block.Transactions) == 0 {
+		return reason("bad-blk-length")
+	}
+	if errs := CheckBlock(block, NewConfirmedUTXOSet(builder.Candidates())); len(errs) > 0 {
+		fmt.Println("Rejecting submitted block", blockHash, ":", errs[0])
+		var ruleErr *RuleError
+		if errors.As(errs[0], &ruleErr) {
+			for ruleFailure, r := range rejectErrorReasons {
+				if errors.Is(ruleErr, ruleFailure) {
+					return reason(r)
+				}
+			}
+			if r, ok := rejectReasons[ruleErr.Rule]; ok {
+				return reason(r)
+			}
+			return reason(defaultRejectReason)
+		}
+		// everything else is about one of the transactions
+		return reason("bad-txns")
+	}
+	if !accept {
+		return nil
+	}
+	s.mu.Lock()
+	s.submitted[blockHash] = true
+	s.mu.Unlock()
+	if s.OnBlock != nil {
+		s.OnBlock(block)
+	}
+	return nil
+}
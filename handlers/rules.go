@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// RuleScope says what a rule looks at, and so when a profile runs it
+type RuleScope string
+
+const (
+	ScopeTx    RuleScope = "tx"    // run once per transaction
+	ScopeInput RuleScope = "input" // run once per input of a transaction
+	ScopeBlock RuleScope = "block" // run once per block
+)
+
+// RuleContext is what a rule gets to check. which fields are set depends on the rule's scope: Tx for tx rules, Tx
+// and InputIndex for input rules, and Block and BlockTxs for block rules
+type RuleContext struct {
+	Tx         *types.TransactionData
+	InputIndex int
+	Block      *wire.MsgBlock
+	BlockTxs   []types.TransactionData // every tx in the block in block order, coinbase first, with prevouts resolved
+
+	sigHashes *TxSigHashes
+	// deferSchnorr is set when the caller batch verifies BIP340 signatures afterwards, see Profile.CheckTxDeferred.
+	// input rules then collect taproot signatures into deferred instead of verifying them
+	deferSchnorr bool
+	deferred     []SchnorrSig
+}
+
+// SigHashes returns the sighash midstates of Tx, computing them the first time they're asked for so every input rule
+// run against the transaction shares them
+func (ctx *RuleContext) SigHashes() *TxSigHashes {
+	if ctx.sigHashes == nil {
+		ctx.sigHashes = NewTxSigHashes(*ctx.Tx)
+	}
+	return ctx.sigHashes
+}
+
+// Rule is a single validation check. consensus rules, policy rules and our own business rules all implement it, and
+// profiles compose them into a validator
+type Rule interface {
+	Name() string
+	Scope() RuleScope
+	Check(ctx *RuleContext) error
+}
+
+// RuleError says which rule rejected a transaction or block, and for input rules which input
+type RuleError struct {
+	Rule  string
+	Input int // -1 unless the rule is an input rule
+	Err   error
+}
+
+func (e *RuleError) Error() string {
+	if e.Input >= 0 {
+		return fmt.Sprintf("rule %s (input %d): %v", e.Rule, e.Input, e.Err)
+	}
+	return fmt.Sprintf("rule %s: %v", e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// funcRule is a Rule made from a plain function
+type funcRule struct {
+	name  string
+	scope RuleScope
+	check func(ctx *RuleContext) error
+}
+
+func (r *funcRule) Name() string                 { return r.name }
+func (r *funcRule) Scope() RuleScope             { return r.scope }
+func (r *funcRule) Check(ctx *RuleContext) error { return r.check(ctx) }
+
+// NewRule makes a Rule out of a check function
+func NewRule(name string, scope RuleScope, check func(ctx *RuleContext) error) Rule {
+	return &funcRule{name: name, scope: scope, check: check}
+}
+
+var registeredRules = map[string]Rule{}
+
+// RegisterRule makes a rule available by name, e.g for the -rules flag. names have to be unique
+func RegisterRule(rule Rule) error {
+	if _, exists := registeredRules[rule.Name()]; exists {
+		return fmt.Errorf("rule %q is already registered", rule.Name())
+	}
+	registeredRules[rule.Name()] = rule
+	return nil
+}
+
+// GetRule looks up a registered rule by name
+func GetRule(name string) (Rule, error) {
+	rule, ok := registeredRules[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rule %q (registered: %s)", name, strings.Join(RegisteredRules(), ", "))
+	}
+	return rule, nil
+}
+
+// RegisteredRules returns the names of every registered rule, sorted
+func RegisteredRules() []string {
+	names := make([]string, 0, len(registeredRules))
+	for name := range registeredRules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile is an ordered set of rules that together decide whether a transaction or block is valid. rules run in the
+// order they were added and a transaction is rejected by the first rule that fails
+type Profile struct {
+	Name  string
+	rules []Rule
+}
+
+// NewProfile creates a profile out of rules
+func NewProfile(name string, rules ...Rule) *Profile {
+	return &Profile{Name: name, rules: rules}
+}
+
+// NewProfileFromNames creates a profile out of registered rules
+func NewProfileFromNames(name string, ruleNames ...string) (*Profile, error) {
+	profile := NewProfile(name)
+	for _, ruleName := range ruleNames {
+		rule, err := GetRule(ruleName)
+		if err != nil {
+			return nil, err
+		}
+		profile.rules = append(profile.rules, rule)
+	}
+	return profile, nil
+}
+
+// With returns a copy of the profile with extra rules appended, leaving the original as it was
+func (p *Profile) With(name string, rules ...Rule) *Profile {
+	combined := make([]Rule, 0, len(p.rules)+len(rules))
+	combined = append(combined, p.rules...)
+	return NewProfile(name, append(combined, rules...)...)
+}
+
+// Rules returns the profile's rules in the order they run
+func (p *Profile) Rules() []Rule {
+	return p.rules
+}
+
+// CheckTx runs the profile's tx and input rules against a transaction, returning the first failure as a *RuleError
+func (p *Profile) CheckTx(transaction types.TransactionData) error {
+	return p.checkTx(&RuleContext{Tx: &transaction})
+}
+
+// CheckTxDeferred is CheckTx with the BIP340 signatures of taproot inputs left unverified. they're returned instead,
+// for the caller to verify in a batch together with other transactions' (see VerifySchnorrBatch); the transaction is
+// only valid if the error is nil and all of them verify
+func (p *Profile) CheckTxDeferred(transaction types.TransactionData) ([]SchnorrSig, error) {
+	ctx := &RuleContext{Tx: &transaction, deferSchnorr: true}
+	if err := p.checkTx(ctx); err != nil {
+		return nil, err
+	}
+	return ctx.deferred, nil
+}
+
+func (p *Profile) checkTx(ctx *RuleContext) error {
+	for _, rule := range p.rules {
+		switch rule.Scope() {
+		case ScopeTx:
+			if err := rule.Check(ctx); err != nil {
+				return &RuleError{Rule: rule.Name(), Input: -1, Err: err}
+			}
+		case ScopeInput:
+			for i := range ctx.Tx.Vin {
+				ctx.InputIndex = i
+				if err := rule.Check(ctx); err != nil {
+					return &RuleError{Rule: rule.Name(), Input: i, Err: err}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckBlockRules runs the profile's block rules. unlike CheckTx it runs all of them and returns every failure
+func (p *Profile) CheckBlockRules(block *wire.MsgBlock, blockTxs []types.TransactionData) []error {
+	var errs []error
+	ctx := &RuleContext{Block: block, BlockTxs: blockTxs}
+	for _, rule := range p.rules {
+		if rule.Scope() != ScopeBlock {
+			continue
+		}
+		if err := rule.Check(ctx); err != nil {
+			errs = append(errs, &RuleError{Rule: rule.Name(), Input: -1, Err: err})
+		}
+	}
+	return errs
+}
+
+var registeredProfiles = map[string]*Profile{}
+
+// RegisterProfile makes a profile available by name, e.g for the -profile flag
+func RegisterProfile(profile *Profile) error {
+	if _, exists := registeredProfiles[profile.Name]; exists {
+		return fmt.Errorf("profile %q is already registered", profile.Name)
+	}
+	registeredProfiles[profile.Name] = profile
+	return nil
+}
+
+// GetProfile looks up a registered profile by name
+func GetProfile(name string) (*Profile, error) {
+	profile, ok := registeredProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(registeredProfiles))
+		for profileName := range registeredProfiles {
+			names = append(names, profileName)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q (registered: %s)", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// ErrUnsupportedInputType is what the input-types policy rule rejects transactions with
+var ErrUnsupportedInputType = errors.New("spends an output type we don't validate")
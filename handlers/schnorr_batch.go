@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// BatchSchnorr makes the validation pipeline collect the BIP340 signatures of taproot inputs and verify them in
+// batches instead of one at a time. the results are the same either way, batching is just faster on big mempools
+var BatchSchnorr = false
+
+// minSchnorrBatch is the size below which batch verification isn't worth it and signatures are checked one by one.
+// it's also where bisecting a failed batch stops
+const minSchnorrBatch = 4
+
+var bip340ChallengeTag = []byte("BIP0340/challenge")
+
+// VerifySchnorrBatch verifies a set of BIP340 signatures and reports for each one whether it's valid. the whole set is
+// checked with a single batch equation first; if that fails the set is split in half and each half checked again,
+// down to individual verification, so the signatures at fault get pinpointed without giving up the speedup for the
+// rest. signatures already in SignatureCache aren't checked again and the ones that verify are added to it
+func VerifySchnorrBatch(sigs []SchnorrSig) []bool {
+	results := make([]bool, len(sigs))
+	var pending []int
+	for i, sig := range sigs {
+		if SignatureCache.Exists(sig.Msg, sig.PubKey, sig.Sig) {
+			results[i] = true
+			continue
+		}
+		pending = append(pending, i)
+	}
+	verifySchnorrIndexes(sigs, pending, results)
+	return results
+}
+
+func verifySchnorrIndexes(sigs []SchnorrSig, indexes []int, results []bool) {
+	if len(indexes) < minSchnorrBatch {
+		for _, i := range indexes {
+			results[i] = VerifySchnorrSig(sigs[i])
+		}
+		return
+	}
+	batch := make([]SchnorrSig, len(indexes))
+	for j, i := range indexes {
+		batch[j] = sigs[i]
+	}
+	if BatchVerifySchnorr(batch) {
+		for _, i := range indexes {
+			results[i] = true
+			SignatureCache.Add(sigs[i].Msg, sigs[i].PubKey, sigs[i].Sig)
+		}
+		return
+	}
+	half := len(indexes) / 2
+	verifySchnorrIndexes(sigs, indexes[:half], results)
+	verifySchnorrIndexes(sigs, indexes[half:], results)
+}
+
+// BatchVerifySchnorr reports whether every signature in sigs is valid, using the BIP340 batch verification equation
+//
+//	(a_1*s_1 + ... + a_u*s_u)*G = a_1*R_1 + ... + a_u*R_u + a_1*e_1*P_1 + ... + a_u*e_u*P_u
+//
+// with a_1 = 1 and the other a_i random, so a bad signature can't be cancelled out by another one. the right hand
+// side is one multi-scalar multiplication, which is where the saving over u separate verifications comes from. a
+// false result doesn't say which signature is bad, see VerifySchnorrBatch for that
+func BatchVerifySchnorr(sigs []SchnorrSig) bool {
+	if len(sigs) == 0 {
+		return true
+	}
+	points := make([]btcec.JacobianPoint, 0, 2*len(sigs))
+	scalars := make([]btcec.ModNScalar, 0, 2*len(sigs))
+	var sSum btcec.ModNScalar
+	for i, sig := range sigs {
+		if len(sig.Sig) != 64 || len(sig.Msg) != 32 {
+			return false
+		}
+		// R has to be the point with x coordinate r and an even y, which is exactly how an x-only key is lifted
+		rKey, err := schnorr.ParsePubKey(sig.Sig[:32])
+		if err != nil {
+			return false
+		}
+		pubKey, err := schnorr.ParsePubKey(sig.PubKey)
+		if err != nil {
+			return false
+		}
+		var s btcec.ModNScalar
+		if overflow := s.SetByteSlice(sig.Sig[32:]); overflow {
+			return false
+		}
+		var e btcec.ModNScalar
+		e.SetByteSlice(chainhash.TaggedHash(bip340ChallengeTag, sig.Sig[:32], sig.PubKey, sig.Msg)[:])
+
+		var a btcec.ModNScalar
+		if i == 0 {
+			a.SetInt(1)
+		} else if !randomScalar(&a) {
+			return false
+		}
+
+		var r, p btcec.JacobianPoint
+		rKey.AsJacobian(&r)
+		pubKey.AsJacobian(&p)
+		points = append(points, r, p)
+		scalars = append(scalars, a, *new(btcec.ModNScalar).Mul2(&a, &e))
+		sSum.Add(s.Mul(&a))
+	}
+
+	var lhs, rhs, sum btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(sSum.Negate(), &lhs)
+	multiScalarMult(points, scalars, &rhs)
+	btcec.AddNonConst(&lhs, &rhs, &sum)
+	return isInfinity(&sum)
+}
+
+// randomScalar sets a to a random non zero 128 bit number, plenty to make forging a batch as hard as forging a
+// signature
+func randomScalar(a *btcec.ModNScalar) bool {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return false
+	}
+	a.SetByteSlice(buf[:])
+	return !a.IsZero()
+}
+
+func isInfinity(p *btcec.JacobianPoint) bool {
+	return (p.X.IsZero() && p.Y.IsZero()) || p.Z.IsZero()
+}
+
+// multiScalarMult computes k_1*P_1 + ... + k_n*P_n with Pippenger's bucket method: the scalars are cut into windows
+// of c bits, and for each window the points are dropped into a bucket by the window's digit, so every point costs one
+// addition per window whatever its digit is. the buckets are then summed so that bucket d counts d times
+func multiScalarMult(points []btcec.JacobianPoint, scalars []btcec.ModNScalar, result *btcec.JacobianPoint) {
+	c := pippengerWindow(len(points))
+	scalarBytes := make([][32]byte, len(scalars))
+	for i := range scalars {
+		scalarBytes[i] = scalars[i].Bytes()
+	}
+	buckets := make([]btcec.JacobianPoint, (1<<c)-1)
+	var acc, tmp btcec.JacobianPoint
+	for start := ((256 + c - 1) / c) * c; start > 0; {
+		start -= c
+		for i := 0; i < c && !isInfinity(&acc); i++ {
+			btcec.DoubleNonConst(&acc, &tmp)
+			acc.Set(&tmp)
+		}
+		for i := range buckets {
+			buckets[i] = btcec.JacobianPoint{}
+		}
+		for i := range points {
+			if digit := scalarWindow(&scalarBytes[i], start, c); digit != 0 {
+				btcec.AddNonConst(&buckets[digit-1], &points[i], &tmp)
+				buckets[digit-1].Set(&tmp)
+			}
+		}
+		// running sum from the top bucket down: after bucket d has been added, running holds buckets d and up, and
+		// adding running into windowSum at every step counts bucket d exactly d times
+		var running, windowSum btcec.JacobianPoint
+		for d := len(buckets) - 1; d >= 0; d-- {
+			btcec.AddNonConst(&running, &buckets[d], &tmp)
+			running.Set(&tmp)
+			btcec.AddNonConst(&windowSum, &running, &tmp)
+			windowSum.Set(&tmp)
+		}
+		btcec.AddNonConst(&acc, &windowSum, &tmp)
+		acc.Set(&tmp)
+	}
+	result.Set(&acc)
+}
+
+// pippengerWindow picks the window size for n points, roughly log2(n) which balances the per point additions against
+// the per bucket ones
+func pippengerWindow(n int) int {
+	c := bits.Len(uint(n)) - 2
+	if c < 2 {
+		return 2
+	}
+	if c > 16 {
+		return 16
+	}
+	return c
+}
+
+// scalarWindow returns bits [start, start+c) of a big endian 256 bit scalar, bit 0 being the least significant
+func scalarWindow(scalar *[32]byte, start int, c int) int {
+	digit := 0
+	for i := c - 1; i >= 0; i-- {
+		digit <<= 1
+		bit := start + i
+		if bit < 256 && scalar[31-bit/8]>>(bit%8)&1 == 1 {
+			digit |= 1
+		}
+	}
+	return digit
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// testSchnorrSigs makes n valid BIP340 signatures, each by its own key over its own message, deterministically
+func testSchnorrSigs(t testing.TB, n int) []SchnorrSig {
+	sigs := make([]SchnorrSig, n)
+	for i := range sigs {
+		seed := sha256.Sum256([]byte(fmt.Sprintf("key %d", i)))
+		privKey, _ := btcec.PrivKeyFromBytes(seed[:])
+		msg := sha256.Sum256([]byte(fmt.Sprintf("msg %d", i)))
+		signature, err := schnorr.Sign(privKey, msg[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs[i] = SchnorrSig{Sig: signature.Serialize(), PubKey: schnorr.SerializePubKey(privKey.PubKey()), Msg: msg[:], InputIndex: i}
+	}
+	return sigs
+}
+
+// withoutSigCache turns the signature cache off for a test, so every signature really gets verified
+func withoutSigCache(t testing.TB) {
+	cache := SignatureCache
+	SignatureCache = nil
+	t.Cleanup(func() { SignatureCache = cache })
+}
+
+// corrupt returns a copy of sig whose s value is off by one, still well formed but not valid
+func corrupt(sig SchnorrSig) SchnorrSig {
+	bad := append([]byte(nil), sig.Sig...)
+	bad[63] ^= 1
+	sig.Sig = bad
+	return sig
+}
+
+func TestMultiScalarMult(t *testing.T) {
+	// enough sizes to go through several window widths, including ones where the top window is partial
+	for _, n := range []int{1, 2, 3, 7, 16, 33, 100, 300} {
+		points := make([]btcec.JacobianPoint, n)
+		scalars := make([]btcec.ModNScalar, n)
+		var want btcec.JacobianPoint
+		for i := 0; i < n; i++ {
+			var k btcec.ModNScalar
+			seed := sha256.Sum256([]byte(fmt.Sprintf("point %d %d", n, i)))
+			k.SetByteSlice(seed[:])
+			btcec.ScalarBaseMultNonConst(&k, &points[i])
+			scalar := sha256.Sum256([]byte(fmt.Sprintf("scalar %d %d", n, i)))
+			scalars[i].SetByteSlice(scalar[:])
+			if i%5 == 4 {
+				// small and zero scalars leave most windows empty
+				scalars[i].SetInt(uint32(i % 3))
+			}
+
+			var term, sum btcec.JacobianPoint
+			btcec.ScalarMultNonConst(&scalars[i], &points[i], &term)
+			btcec.AddNonConst(&want, &term, &sum)
+			want.Set(&sum)
+		}
+
+		var got btcec.JacobianPoint
+		multiScalarMult(points, scalars, &got)
+		got.ToAffine()
+		want.ToAffine()
+		if isInfinity(&got) != isInfinity(&want) || (!isInfinity(&want) && (!got.X.Equals(&want.X) || !got.Y.Equals(&want.Y))) {
+			t.Errorf("%d points: pippenger and one by one multiplication disagree", n)
+		}
+	}
+}
+
+func TestScalarWindow(t *testing.T) {
+	var scalar [32]byte
+	scalar[31] = 0b10110110
+	scalar[30] = 0b00000001
+	tests := []struct {
+		start, c, want int
+	}{
+		{0, 4, 0b0110},
+		{4, 4, 0b1011},
+		{6, 4, 0b0110},
+		{8, 2, 0b01},
+		{254, 4, 0}, // past the top bit reads as zeros
+	}
+	for _, test := range tests {
+		if got := scalarWindow(&scalar, test.start, test.c); got != test.want {
+			t.Errorf("scalarWindow(start %d, c %d) = %b, want %b", test.start, test.c, got, test.want)
+		}
+	}
+}
+
+func TestBatchVerifySchnorr(t *testing.T) {
+	sigs := testSchnorrSigs(t, 20)
+	if !BatchVerifySchnorr(sigs) {
+		t.Fatal("batch of valid signatures doesn't verify")
+	}
+	for _, bad := range []int{0, 7, 19} {
+		batch := append([]SchnorrSig(nil), sigs...)
+		batch[bad] = corrupt(batch[bad])
+		if BatchVerifySchnorr(batch) {
+			t.Errorf("batch with signature %d bad verifies", bad)
+		}
+	}
+	// a signature over another message, with everything else valid
+	batch := append([]SchnorrSig(nil), sigs...)
+	batch[3].Msg = batch[4].Msg
+	if BatchVerifySchnorr(batch) {
+		t.Error("batch with a signature over the wrong message verifies")
+	}
+}
+
+func TestVerifySchnorrBatch(t *testing.T) {
+	withoutSigCache(t)
+	sigs := testSchnorrSigs(t, 64)
+	for _, bad := range [][]int{nil, {0}, {37}, {63}, {5, 6, 40}} {
+		batch := append([]SchnorrSig(nil), sigs...)
+		isBad := map[int]bool{}
+		for _, i := range bad {
+			batch[i] = corrupt(batch[i])
+			isBad[i] = true
+		}
+		results := VerifySchnorrBatch(batch)
+		if len(results) != len(batch) {
+			t.Fatalf("%d results for %d signatures", len(results), len(batch))
+		}
+		for i, ok := range results {
+			if ok == isBad[i] {
+				t.Errorf("bad signatures %v: signature %d reported valid %v", bad, i, ok)
+			}
+		}
+	}
+}
+
+func BenchmarkVerifySchnorrSig(b *testing.B) {
+	withoutSigCache(b)
+	sigs := testSchnorrSigs(b, 256)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sig := range sigs {
+			VerifySchnorrSig(sig)
+		}
+	}
+}
+
+func BenchmarkVerifySchnorrBatch(b *testing.B) {
+	withoutSigCache(b)
+	sigs := testSchnorrSigs(b, 256)
+	for _, size := range []int{16, 64, 256} {
+		b.Run(fmt.Sprintf("batches of %d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < len(sigs); j += size {
+					VerifySchnorrBatch(sigs[j:min(j+size, len(sigs))])
+				}
+			}
+		})
+	}
+	b.Run("one bad signature", func(b *testing.B) {
+		batch := append([]SchnorrSig(nil), sigs...)
+		batch[100] = corrupt(batch[100])
+		for i := 0; i < b.N; i++ {
+			VerifySchnorrBatch(batch)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+// DefaultSigCacheSize is how many verified signatures SignatureCache remembers. an entry is a 32 byte key plus map
+// overhead, so the default costs a few MB
+const DefaultSigCacheSize = 100000
+
+// SignatureCache remembers signatures that verified, so revalidating a mempool or rebuilding a template doesn't
+// repeat the elliptic curve work. set it to nil to turn caching off
+var SignatureCache = NewSigCache(DefaultSigCacheSize)
+
+// SigCache is a bounded set of (sighash, pubkey, signature) triples known to be valid. only valid signatures are
+// added, so a hit means the signature checks out and a miss means it has to be verified. once full the oldest entry
+// is evicted. it is safe for concurrent use
+type SigCache struct {
+	mu         sync.RWMutex
+	entries    map[[32]byte]struct{}
+	order      [][32]byte // ring buffer of keys in insertion order
+	next       int
+	maxEntries int
+}
+
+// NewSigCache creates a cache holding at most maxEntries signatures
+func NewSigCache(maxEntries int) *SigCache {
+	return &SigCache{
+		entries:    make(map[[32]byte]struct{}),
+		order:      make([][32]byte, 0, maxEntries),
+		maxEntries: maxEntries,
+	}
+}
+
+// sigCacheKey hashes the triple down to a fixed size key. the lengths are included so different splits of the same
+// bytes can't collide
+func sigCacheKey(sigHash []byte, pubKey []byte, sig []byte) [32]byte {
+	hasher := sha256.New()
+	for _, part := range [][]byte{sigHash, pubKey, sig} {
+		hasher.Write(binary.BigEndian.AppendUint32(nil, uint32(len(part))))
+		hasher.Write(part)
+	}
+	var key [32]byte
+	copy(key[:], hasher.Sum(nil))
+	return key
+}
+
+// Exists reports whether the signature is known to be valid for the sighash and pubkey
+func (c *SigCache) Exists(sigHash []byte, pubKey []byte, sig []byte) bool {
+	if c == nil {
+		return false
+	}
+	key := sigCacheKey(sigHash, pubKey, sig)
+	c.mu.RLock()
+	_, ok := c.entries[key]
+	c.mu.RUnlock()
+	return ok
+}
+
+// Add records a signature that verified
+func (c *SigCache) Add(sigHash []byte, pubKey []byte, sig []byte) {
+	if c == nil || c.maxEntries <= 0 {
+		return
+	}
+	key := sigCacheKey(sigHash, pubKey, sig)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if len(c.order) < c.maxEntries {
+		c.order = append(c.order, key)
+	} else {
+		delete(c.entries, c.order[c.next])
+		c.order[c.next] = key
+		c.next = (c.next + 1) % c.maxEntries
+	}
+	c.entries[key] = struct{}{}
+}
+
+// Len returns the number of signatures in the cache
+func (c *SigCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// the sighash types. SigHashDefault only exists for taproot, where it means ALL
+const (
+	SigHashDefault      = 0x00
+	SigHashAll          = 0x01
+	SigHashNone         = 0x02
+	SigHashSingle       = 0x03
+	SigHashAnyOneCanPay = 0x80
+)
+
+// TxSigHashes holds everything the signature hashes of a transaction's inputs have in common, worked out once per
+// transaction instead of once per input: the BIP143 midstate hashes for segwit v0, the BIP341 ones for taproot, and a
+// stripped copy of the transaction for legacy sighashes
+type TxSigHashes struct {
+	tx *wire.MsgTx // scriptsigs and witnesses removed
+
+	// BIP143, double sha256
+	HashPrevouts chainhash.Hash
+	HashSequence chainhash.Hash
+	HashOutputs  chainhash.Hash
+
+	// BIP341, single sha256
+	ShaPrevouts      [32]byte
+	ShaAmounts       [32]byte
+	ShaScriptPubKeys [32]byte
+	ShaSequences     [32]byte
+	ShaOutputs       [32]byte
+
+	amounts       []int64
+	scriptPubKeys [][]byte
+
+	// the sighashes CalcSigHash worked out, by input and hash type, since every signature of a multisig input (and
+	// every time an input is checked) needs one
+	mu     sync.Mutex
+	cached map[inputSigHash][]byte
+}
+
+type inputSigHash struct {
+	inputIndex int
+	hashType   uint32
+}
+
+// NewTxSigHashes precomputes the sighash midstates of a transaction. the prevouts have to be filled in since both
+// segwit versions commit to the amounts being spent, and taproot to their scriptpubkeys too
+func NewTxSigHashes(transaction types.TransactionData) *TxSigHashes {
+	sigHashes := &TxSigHashes{tx: wire.NewMsgTx(int32(transaction.Version)), cached: map[inputSigHash][]byte{}}
+	sigHashes.tx.LockTime = uint32(transaction.Locktime)
+	var prevouts, sequences, amounts, scriptPubKeys, outputs bytes.Buffer
+	for _, input := range transaction.Vin {
+		prevOutHash, _ := chainhash.NewHashFromStr(input.TxID)
+		prevOut := wire.NewOutPoint(prevOutHash, uint32(input.Vout))
+		txIn := wire.NewTxIn(prevOut, nil, nil)
+		txIn.Sequence = uint32(input.Sequence)
+		sigHashes.tx.AddTxIn(txIn)
+
+		prevouts.Write(prevOutHash[:])
+		binary.Write(&prevouts, binary.LittleEndian, uint32(input.Vout))
+		binary.Write(&sequences, binary.LittleEndian, uint32(input.Sequence))
+		binary.Write(&amounts, binary.LittleEndian, int64(input.Prevout.Value))
+		scriptPubKey, _ := hex.DecodeString(input.Prevout.ScriptPubKey)
+		wire.WriteVarBytes(&scriptPubKeys, 0, scriptPubKey)
+		sigHashes.amounts = append(sigHashes.amounts, int64(input.Prevout.Value))
+		sigHashes.scriptPubKeys = append(sigHashes.scriptPubKeys, scriptPubKey)
+	}
+	for _, output := range transaction.Vout {
+		scriptPubKey, _ := hex.DecodeString(output.ScriptPubKey)
+		txOut := wire.NewTxOut(int64(output.Value), scriptPubKey)
+		sigHashes.tx.AddTxOut(txOut)
+		wire.WriteTxOut(&outputs, 0, 0, txOut)
+	}
+	sigHashes.HashPrevouts = chainhash.DoubleHashH(prevouts.Bytes())
+	sigHashes.HashSequence = chainhash.DoubleHashH(sequences.Bytes())
+	sigHashes.HashOutputs = chainhash.DoubleHashH(outputs.Bytes())
+	sigHashes.ShaPrevouts = sha256.Sum256(prevouts.Bytes())
+	sigHashes.ShaAmounts = sha256.Sum256(amounts.Bytes())
+	sigHashes.ShaScriptPubKeys = sha256.Sum256(scriptPubKeys.Bytes())
+	sigHashes.ShaSequences = sha256.Sum256(sequences.Bytes())
+	sigHashes.ShaOutputs = sha256.Sum256(outputs.Bytes())
+	return sigHashes
+}
+
+// LegacySigHash is the pre segwit signature hash: the transaction with every scriptsig emptied except the signed
+// input's, which is replaced by subScript, followed by the hash type
+func (h *TxSigHashes) LegacySigHash(inputIndex int, subScript []byte, hashType uint32) []byte {
+	baseType := hashType & 0x1f
+	if baseType == SigHashSingle && inputIndex >= len(h.tx.TxOut) {
+		// the famous SIGHASH_SINGLE bug, this "hash" is the number one
+		one := make([]byte, 32)
+		one[0] = 0x01
+		return one
+	}
+	tx := h.tx.Copy()
+	tx.TxIn[inputIndex].SignatureScript = subScript
+	switch baseType {
+	case SigHashNone:
+		tx.TxOut = nil
+	case SigHashSingle:
+		tx.TxOut = tx.TxOut[:inputIndex+1]
+		for i := 0; i < inputIndex; i++ {
+			tx.TxOut[i] = wire.NewTxOut(-1, nil)
+		}
+	}
+	if baseType == SigHashNone || baseType == SigHashSingle {
+		for i := range tx.TxIn {
+			if i != inputIndex {
+				tx.TxIn[i].Sequence = 0
+			}
+		}
+	}
+	if hashType&SigHashAnyOneCanPay != 0 {
+		tx.TxIn = tx.TxIn[inputIndex : inputIndex+1]
+	}
+	var preImg bytes.Buffer
+	tx.SerializeNoWitness(&preImg)
+	binary.Write(&preImg, binary.LittleEndian, hashType)
+	return chainhash.DoubleHashB(preImg.Bytes())
+}
+
+// WitnessV0SigHash is the BIP143 signature hash for a segwit v0 input
+func (h *TxSigHashes) WitnessV0SigHash(inputIndex int, scriptCode []byte, amount int64, hashType uint32) []byte {
+	baseType := hashType & 0x1f
+	anyOneCanPay := hashType&SigHashAnyOneCanPay != 0
+	var zeroHash chainhash.Hash
+	txIn := h.tx.TxIn[inputIndex]
+
+	var preImg bytes.Buffer
+	binary.Write(&preImg, binary.LittleEndian, h.tx.Version)
+	if anyOneCanPay {
+		preImg.Write(zeroHash[:])
+	} else {
+		preImg.Write(h.HashPrevouts[:])
+	}
+	if anyOneCanPay || baseType == SigHashNone || baseType == SigHashSingle {
+		preImg.Write(zeroHash[:])
+	} else {
+		preImg.Write(h.HashSequence[:])
+	}
+	preImg.Write(txIn.PreviousOutPoint.Hash[:])
+	binary.Write(&preImg, binary.LittleEndian, txIn.PreviousOutPoint.Index)
+	wire.WriteVarBytes(&preImg, 0, scriptCode)
+	binary.Write(&preImg, binary.LittleEndian, amount)
+	binary.Write(&preImg, binary.LittleEndian, txIn.Sequence)
+	switch {
+	case baseType != SigHashNone && baseType != SigHashSingle:
+		preImg.Write(h.HashOutputs[:])
+	case baseType == SigHashSingle && inputIndex < len(h.tx.TxOut):
+		var output bytes.Buffer
+		wire.WriteTxOut(&output, 0, 0, h.tx.TxOut[inputIndex])
+		preImg.Write(chainhash.DoubleHashB(output.Bytes()))
+	default:
+		preImg.Write(zeroHash[:])
+	}
+	binary.Write(&preImg, binary.LittleEndian, h.tx.LockTime)
+	binary.Write(&preImg, binary.LittleEndian, hashType)
+	return chainhash.DoubleHashB(preImg.Bytes())
+}
+
+// TaprootSigHash is the BIP341 signature hash for a taproot input. annex is nil unless the witness carries one, and
+// leafHash is nil for a key path spend or the tapleaf hash of the script being run for a script path spend
+func (h *TxSigHashes) TaprootSigHash(inputIndex int, hashType byte, annex []byte, leafHash []byte) ([]byte, error) {
+	baseType := hashType & 0x03
+	anyOneCanPay := hashType&SigHashAnyOneCanPay != 0
+	if hashType > 0x03 && (hashType < 0x81 || hashType > 0x83) {
+		return nil, fmt.Errorf("invalid taproot sighash type %#x", hashType)
+	}
+	if baseType == SigHashSingle && inputIndex >= len(h.tx.TxOut) {
+		return nil, fmt.Errorf("SIGHASH_SINGLE on input %d without a matching output", inputIndex)
+	}
+	txIn := h.tx.TxIn[inputIndex]
+
+	var sigMsg bytes.Buffer
+	sigMsg.WriteByte(0x00) // sighash epoch
+	sigMsg.WriteByte(hashType)
+	binary.Write(&sigMsg, binary.LittleEndian, h.tx.Version)
+	binary.Write(&sigMsg, binary.LittleEndian, h.tx.LockTime)
+	if !anyOneCanPay {
+		sigMsg.Write(h.ShaPrevouts[:])
+		sigMsg.Write(h.ShaAmounts[:])
+		sigMsg.Write(h.ShaScriptPubKeys[:])
+		sigMsg.Write(h.ShaSequences[:])
+	}
+	if baseType != SigHashNone && baseType != SigHashSingle {
+		sigMsg.Write(h.ShaOutputs[:])
+	}
+	spendType := byte(0)
+	if leafHash != nil {
+		spendType |= 0x02
+	}
+	if annex != nil {
+		spendType |= 0x01
+	}
+	sigMsg.WriteByte(spendType)
+	if anyOneCanPay {
+		sigMsg.Write(txIn.PreviousOutPoint.Hash[:])
+		binary.Write(&sigMsg, binary.LittleEndian, txIn.PreviousOutPoint.Index)
+		binary.Write(&sigMsg, binary.LittleEndian, h.amounts[inputIndex])
+		wire.WriteVarBytes(&sigMsg, 0, h.scriptPubKeys[inputIndex])
+		binary.Write(&sigMsg, binary.LittleEndian, txIn.Sequence)
+	} else {
+		binary.Write(&sigMsg, binary.LittleEndian, uint32(inputIndex))
+	}
+	if annex != nil {
+		var annexBuf bytes.Buffer
+		wire.WriteVarBytes(&annexBuf, 0, annex)
+		shaAnnex := sha256.Sum256(annexBuf.Bytes())
+		sigMsg.Write(shaAnnex[:])
+	}
+	if baseType == SigHashSingle {
+		var output bytes.Buffer
+		wire.WriteTxOut(&output, 0, 0, h.tx.TxOut[inputIndex])
+		shaSingleOutput := sha256.Sum256(output.Bytes())
+		sigMsg.Write(shaSingleOutput[:])
+	}
+	if leafHash != nil {
+		sigMsg.Write(leafHash)
+		sigMsg.WriteByte(0x00)                                 // key version
+		binary.Write(&sigMsg, binary.LittleEndian, ^uint32(0)) // no OP_CODESEPARATOR executed
+	}
+	return chainhash.TaggedHash([]byte("TapSighash"), sigMsg.Bytes())[:], nil
+}
+
+// SigHashType is the hash type an ECDSA signature signs with, its last byte. an empty signature has none, so it gets
+// SigHashAll, which doesn't matter since it can't verify anyway
+func SigHashType(sig []byte) uint32 {
+	if len(sig) == 0 {
+		return SigHashAll
+	}
+	return uint32(sig[len(sig)-1])
+}
+
+// CalcSigHash works out the signature hash for one input of a transaction with the given hash type (see
+// SigHashType), picking the legacy or BIP143 algorithm and the script code from the type of output being spent. the
+// result is kept on sigHashes, so each input and hash type is only hashed once
+func CalcSigHash(transaction types.TransactionData, inputIndex int, sigHashes *TxSigHashes, hashType uint32) []byte {
+	key := inputSigHash{inputIndex: inputIndex, hashType: hashType}
+	sigHashes.mu.Lock()
+	sigHash, ok := sigHashes.cached[key]
+	sigHashes.mu.Unlock()
+	if ok {
+		return sigHash
+	}
+	sigHash = calcSigHash(transaction, inputIndex, sigHashes, hashType)
+	sigHashes.mu.Lock()
+	sigHashes.cached[key] = sigHash
+	sigHashes.mu.Unlock()
+	return sigHash
+}
+
+func calcSigHash(transaction types.TransactionData, inputIndex int, sigHashes *TxSigHashes, hashType uint32) []byte {
+	input := transaction.Vin[inputIndex]
+	inputType := InputType(input)
+	scriptSigBytes, _ := hex.DecodeString(input.ScriptSig)
+	switch {
+	case inputType == script.P2PKH || inputType == script.Multisig:
+		// the script code is the scriptpubkey itself
+		scriptPubKey, _ := hex.DecodeString(input.Prevout.ScriptPubKey)
+		return sigHashes.LegacySigHash(inputIndex, scriptPubKey, hashType)
+	case inputType == script.P2SH && input.Witness == nil:
+		// the script code is the redeem script, the last push of the scriptsig
+		redeemScript, _ := script.LastPush(scriptSigBytes)
+		return sigHashes.LegacySigHash(inputIndex, redeemScript, hashType)
+	}
+	var scriptCode []byte
+	if inputType == script.P2WPKH {
+		scriptCode = script.PayToPubKeyHash(ScriptPubKeyHash(input.Prevout.ScriptPubKey))
+	} else if inputType == script.P2SH && len(input.Witness) == 2 {
+		// p2sh-p2wpkh, the pubkey hash is the program of the redeem script
+		redeemScript, _ := script.LastPush(scriptSigBytes)
+		scriptCode = script.PayToPubKeyHash(ScriptPubKeyHash(hex.EncodeToString(redeemScript)))
+	} else if (inputType == script.P2WSH || inputType == script.P2SH) && len(input.Witness) > 0 {
+		// p2wsh and p2sh-p2wsh, the script code is the witness script
+		scriptCode, _ = hex.DecodeString(input.Witness[len(input.Witness)-1])
+	}
+	return sigHashes.WitnessV0SigHash(inputIndex, scriptCode, int64(input.Prevout.Value), hashType)
+}
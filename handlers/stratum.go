@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// the stratum error codes miners understand
+const (
+	stratumOtherError    = 20
+	stratumJobNotFound   = 21
+	stratumDuplicate     = 22
+	stratumLowDifficulty = 23
+	stratumUnauthorized  = 24
+	stratumNotSubscribed = 25
+)
+
+const (
+	// ExtraNonce1Size is the size of the per connection extranonce the server assigns
+	ExtraNonce1Size = 4
+	// ExtraNonce2Size is the size of the extranonce miners roll themselves
+	ExtraNonce2Size = 4
+	// maxFutureBlockTime is how far ahead of our clock a share's ntime may be, like bitcoin's two hours
+	maxFutureBlockTime = 2 * time.Hour
+)
+
+// diff1Target is the target at difficulty 1, the pool difficulty shares are measured against
+var diff1Target = blockchain.CompactToBig(0x1d00ffff)
+
+// DifficultyToTarget converts a share difficulty into the target hashes have to be at or below
+func DifficultyToTarget(difficulty float64) *big.Int {
+	if difficulty <= 0 {
+		return new(big.Int).Lsh(big.NewInt(1), 256)
+	}
+	target, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), big.NewFloat(difficulty)).Int(nil)
+	return target
+}
+
+// TargetToDifficulty is DifficultyToTarget the other way round
+func TargetToDifficulty(target *big.Int) float64 {
+	difficulty, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), new(big.Float).SetInt(target)).Float64()
+	return difficulty
+}
+
+// StratumServer hands work out to miners over stratum v1. jobs come from a BlockBuilder: the coinbase is split
+// around the extranonces (coinb1, extranonce1 from the server, extranonce2 from the miner, coinb2) and sent with the
+// merkle branch from the coinbase up, so miners can roll the coinbase themselves. shares are checked against each
+// connection's difficulty, which vardiff adjusts to get a share every ShareTime, and a share that also meets the
+// network target is turned into a full block and passed to OnBlock
+type StratumServer struct {
+	// Authorize checks a worker's credentials; nil lets every worker in
+	Authorize func(user, password string) bool
+	// OnBlock is called with every block found by a share
+	OnBlock func(block *wire.MsgBlock)
+	// StartDifficulty is the share difficulty a connection starts at, MinDifficulty and MaxDifficulty bound vardiff.
+	// 0 for StartDifficulty means 1/64 of the network difficulty, and shares are never made harder than a block
+	StartDifficulty float64
+	MinDifficulty   float64
+	MaxDifficulty   float64
+	// ShareTime is how often vardiff wants a share from each connection, RetargetTime how often it adjusts
+	ShareTime    time.Duration
+	RetargetTime time.Duration
+
+	mu          sync.Mutex
+	jobs        map[string]*stratumJob
+	current     *stratumJob
+	nextJobID   uint64
+	nextSession uint32
+	conns       map[*stratumConn]bool
+	blocks      map[chainhash.Hash]bool
+}
+
+// stratumJob is one piece of work: a template with its coinbase split around the extranonces
+type stratumJob struct {
+	id       string
+	built    *BuiltBlock
+	coinb1   []byte
+	coinb2   []byte
+	branch   []chainhash.Hash
+	version  int32
+	bits     uint32
+	ntime    uint32
+	prevHash chainhash.Hash
+	shares   map[string]bool // submitted so far, to catch duplicates
+}
+
+// notifyParams are the mining.notify params for the job
+func (j *stratumJob) notifyParams(clean bool) []interface{} {
+	branch := make([]string, len(j.branch))
+	for i := range j.branch {
+		branch[i] = hex.EncodeToString(j.branch[i][:])
+	}
+	return []interface{}{j.id, stratumPrevHash(j.prevHash), hex.EncodeToString(j.coinb1), hex.EncodeToString(j.coinb2),
+		branch, fmt.Sprintf("%08x", uint32(j.version)), fmt.Sprintf("%08x", j.bits), fmt.Sprintf("%08x", j.ntime), clean}
+}
+
+// stratumPrevHash is the previous block hash the way stratum sends it: the header's bytes with every 4 byte word
+// byte swapped. ParseStratumPrevHash undoes it
+func stratumPrevHash(hash chainhash.Hash) string {
+	var swapped chainhash.Hash
+	for i := 0; i < chainhash.HashSize; i += 4 {
+		binary.BigEndian.PutUint32(swapped[i:], binary.LittleEndian.Uint32(hash[i:]))
+	}
+	return hex.EncodeToString(swapped[:])
+}
+
+// ParseStratumPrevHash turns the prevhash of a mining.notify back into the hash that goes in the header
+func ParseStratumPrevHash(prevHash string) (chainhash.Hash, error) {
+	var hash chainhash.Hash
+	swapped, err := hex.DecodeString(prevHash)
+	if err != nil || len(swapped) != chainhash.HashSize {
+		return hash, fmt.Errorf("bad prevhash %q", prevHash)
+	}
+	for i := 0; i < chainhash.HashSize; i += 4 {
+		binary.LittleEndian.PutUint32(hash[i:], binary.BigEndian.Uint32(swapped[i:]))
+	}
+	return hash, nil
+}
+
+// SplitCoinbase serializes a coinbase (without its witness, which is what the txid and so the merkle root commit to)
+// with extranonceSize bytes of room at the end of its scriptSig, and cuts it around them
+func SplitCoinbase(coinbase *wire.MsgTx, extranonceSize int) ([]byte, []byte) {
+	tx := coinbase.Copy()
+	baseScript := tx.TxIn[0].SignatureScript
+	tx.TxIn[0].SignatureScript = append(append([]byte(nil), baseScript...), make([]byte, extranonceSize)...)
+	serialized := SerializeWireMsgTxNoWitness(tx)
+	// version, input count, prevout, scriptSig length, then the scriptSig
+	offset := 4 + wire.VarIntSerializeSize(1) + 36 + wire.VarIntSerializeSize(uint64(len(tx.TxIn[0].SignatureScript))) + len(baseScript)
+	return serialized[:offset], serialized[offset+extranonceSize:]
+}
+
+// StratumHeader puts a block header together from a job's pieces, as both sides of stratum do
+func StratumHeader(coinb1, extraNonce1, extraNonce2, coinb2 []byte, branch []chainhash.Hash, version int32,
+	prevHash chainhash.Hash, bits uint32, ntime uint32, nonce uint32) (wire.BlockHeader, []byte) {
+	coinbase := make([]byte, 0, len(coinb1)+len(extraNonce1)+len(extraNonce2)+len(coinb2))
+	coinbase = append(append(append(append(coinbase, coinb1...), extraNonce1...), extraNonce2...), coinb2...)
+	merkleRoot := MerkleRootFromBranch(chainhash.DoubleHashH(coinbase), branch, 0)
+	header := wire.BlockHeader{
+		Version:    version,
+		PrevBlock:  prevHash,
+		MerkleRoot: merkleRoot,
+		Timestamp:  time.Unix(int64(ntime), 0),
+		Bits:       bits,
+		Nonce:      nonce,
+	}
+	return header, coinbase
+}
+
+// NewStratumServer creates a server handing out jobs built from the builder
+func NewStratumServer(builder *BlockBuilder) (*StratumServer, error) {
+	server := &StratumServer{
+		ShareTime:    5 * time.Second,
+		RetargetTime: 30 * time.Second,
+		jobs:         map[string]*stratumJob{},
+		conns:        map[*stratumConn]bool{},
+		blocks:       map[chainhash.Hash]bool{},
+	}
+	if err := server.SetBuilder(builder); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// SetBuilder makes a new job from the builder and sends it to every miner, telling them to drop the old ones
+func (s *StratumServer) SetBuilder(builder *BlockBuilder) error {
+	built, err := builder.Build()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.nextJobID++
+	coinb1, coinb2 := SplitCoinbase(built.Coinbase, ExtraNonce1Size+ExtraNonce2Size)
+	job := &stratumJob{
+		id:       strconv.FormatUint(s.nextJobID, 16),
+		built:    built,
+		coinb1:   coinb1,
+		coinb2:   coinb2,
+		branch:   MerkleBranch(BlockTxIds(built.Block), 0),
+		version:  built.Block.Header.Version,
+		bits:     built.Block.Header.Bits,
+		ntime:    uint32(time.Now().Unix()),
+		prevHash: built.Block.Header.PrevBlock,
+		shares:   map[string]bool{},
+	}
+	// a new template makes the old jobs worthless
+	s.jobs = map[string]*stratumJob{job.id: job}
+	s.current = job
+	conns := s.connList()
+	s.mu.Unlock()
+	for _, conn := range conns {
+		conn.notify(job, true)
+	}
+	return nil
+}
+
+func (s *StratumServer) connList() []*stratumConn {
+	conns := make([]*stratumConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// NetworkDifficulty is the difficulty of the block target of the current job
+func (s *StratumServer) NetworkDifficulty() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return TargetToDifficulty(blockchain.CompactToBig(s.current.bits))
+}
+
+// clampDifficulty keeps a share difficulty within the configured bounds and no harder than a block
+func (s *StratumServer) clampDifficulty(difficulty float64) float64 {
+	network := s.NetworkDifficulty()
+	if s.MinDifficulty > 0 {
+		difficulty = math.Max(difficulty, s.MinDifficulty)
+	}
+	if s.MaxDifficulty > 0 {
+		difficulty = math.Min(difficulty, s.MaxDifficulty)
+	}
+	return math.Min(difficulty, network)
+}
+
+// ListenAndServe accepts miners on addr until the listener fails
+func (s *StratumServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts miners on the listener until it fails
+func (s *StratumServer) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(netConn)
+	}
+}
+
+// stratumConn is one miner's connection
+type stratumConn struct {
+	server      *StratumServer
+	netConn     net.Conn
+	writeMu     sync.Mutex
+	extraNonce1 []byte
+
+	// the rest belongs to the connection's read loop
+	subscribed     bool
+	authorized     bool
+	difficulty     float64
+	prevDifficulty float64 // shares for jobs sent before a retarget are accepted at the old difficulty too
+	retargetStart  time.Time
+	retargetShares int
+}
+
+type stratumMessage struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method,omitempty"`
+	Params []json.RawMessage `json:"params,omitempty"`
+}
+
+type stratumResponse struct {
+	ID     interface{} `json:"id"`
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+}
+
+type stratumNotification struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// stratumError is the [code, message, traceback] triple stratum errors are sent as
+type stratumError struct {
+	code    int
+	message string
+}
+
+func (e *stratumError) Error() string {
+	return e.message
+}
+
+func (s *StratumServer) handleConn(netConn net.Conn) {
+	s.mu.Lock()
+	s.nextSession++
+	conn := &stratumConn{server: s, netConn: netConn, extraNonce1: make([]byte, ExtraNonce1Size)}
+	binary.BigEndian.PutUint32(conn.extraNonce1, s.nextSession)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		netConn.Close()
+	}()
+
+	scanner := bufio.NewScanner(netConn)
+	scanner.Buffer(make([]byte, 0, 4096), 64*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var message stratumMessage
+		if err := json.Unmarshal(line, &message); err != nil {
+			conn.send(stratumResponse{Error: []interface{}{stratumOtherError, "parse error: " + err.Error(), nil}})
+			return
+		}
+		result, err := conn.handle(message)
+		response := stratumResponse{ID: message.ID, Result: result}
+		if err != nil {
+			code := stratumOtherError
+			var stratumErr *stratumError
+			if errors.As(err, &stratumErr) {
+				code = stratumErr.code
+			}
+			response.Result = nil
+			response.Error = []interface{}{code, err.Error(), nil}
+		}
+		conn.send(response)
+		if message.Method == "mining.authorize" && err == nil {
+			conn.start()
+		}
+	}
+}
+
+// send writes one json line to the miner
+func (c *stratumConn) send(v interface{}) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.netConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.netConn.Write(append(line, '\n'))
+}
+
+func (c *stratumConn) notify(job *stratumJob, clean bool) {
+	c.send(stratumNotification{Method: "mining.notify", Params: job.notifyParams(clean)})
+}
+
+func (c *stratumConn) setDifficulty(difficulty float64) {
+	c.send(stratumNotification{Method: "mining.set_difficulty", Params: []interface{}{difficulty}})
+}
+
+// start registers an authorized miner for job notifications and gives it its difficulty and first job
+func (c *stratumConn) start() {
+	server := c.server
+	c.difficulty = server.StartDifficulty
+	if c.difficulty <= 0 {
+		c.difficulty = server.NetworkDifficulty() / 64
+	}
+	c.difficulty = server.clampDifficulty(c.difficulty)
+	c.prevDifficulty = c.difficulty
+	c.retargetStart = time.Now()
+	server.mu.Lock()
+	server.conns[c] = true
+	job := server.current
+	server.mu.Unlock()
+	c.setDifficulty(c.difficulty)
+	c.notify(job, true)
+}
+
+func (c *stratumConn) handle(message stratumMessage) (interface{}, error) {
+	switch message.Method {
+	case "mining.subscribe":
+		c.subscribed = true
+		sessionID := hex.EncodeToString(c.extraNonce1)
+		return []interface{}{
+			[][]string{{"mining.set_difficulty", sessionID}, {"mining.notify", sessionID}},
+			hex.EncodeToString(c.extraNonce1),
+			ExtraNonce2Size,
+		}, nil
+	case "mining.authorize":
+		var user, password string
+		if len(message.Params) > 0 {
+			json.Unmarshal(message.Params[0], &user)
+		}
+		if len(message.Params) > 1 {
+			json.Unmarshal(message.Params[1], &password)
+		}
+		if !c.subscribed {
+			return nil, &stratumError{stratumNotSubscribed, "Not subscribed"}
+		}
+		if c.server.Authorize != nil && !c.server.Authorize(user, password) {
+			return false, &stratumError{stratumUnauthorized, "Unauthorized worker"}
+		}
+		c.authorized = true
+		return true, nil
+	case "mining.submit":
+		return c.submit(message.Params)
+	case "mining.extranonce.subscribe":
+		return false, nil
+	default:
+		return nil, &stratumError{stratumOtherError, "Unknown method " + message.Method}
+	}
+}
+
+// submit checks a share: [worker, job id, extranonce2, ntime, nonce]
+func (c *stratumConn) submit(params []json.RawMessage) (interface{}, error) {
+	if !c.subscribed {
+		return nil, &stratumError{stratumNotSubscribed, "Not subscribed"}
+	}
+	if !c.authorized {
+		return nil, &stratumError{stratumUnauthorized, "Unauthorized worker"}
+	}
+	if len(params) < 5 {
+		return nil, &stratumError{stratumOtherError, "mining.submit takes worker, job id, extranonce2, ntime and nonce"}
+	}
+	fields := make([]string, 5)
+	for i := range fields {
+		if err := json.Unmarshal(params[i], &fields[i]); err != nil {
+			return nil, &stratumError{stratumOtherError, fmt.Sprintf("param %d is not a string", i)}
+		}
+	}
+	server := c.server
+	server.mu.Lock()
+	job := server.jobs[fields[1]]
+	server.mu.Unlock()
+	if job == nil {
+		return nil, &stratumError{stratumJobNotFound, "Job not found"}
+	}
+	extraNonce2, err := hex.DecodeString(fields[2])
+	if err != nil || len(extraNonce2) != ExtraNonce2Size {
+		return nil, &stratumError{stratumOtherError, "Incorrect size of extranonce2"}
+	}
+	ntime, err := strconv.ParseUint(fields[3], 16, 32)
+	if err != nil || uint32(ntime) < job.ntime || time.Unix(int64(ntime), 0).After(time.Now().Add(maxFutureBlockTime)) {
+		return nil, &stratumError{stratumOtherError, "ntime out of range"}
+	}
+	nonce, err := strconv.ParseUint(fields[4], 16, 32)
+	if err != nil {
+		return nil, &stratumError{stratumOtherError, "bad nonce"}
+	}
+
+	header, coinbase := StratumHeader(job.coinb1, c.extraNonce1, extraNonce2, job.coinb2, job.branch, job.version,
+		job.prevHash, job.bits, uint32(ntime), uint32(nonce))
+	shareKey := hex.EncodeToString(c.extraNonce1) + fields[2] + fields[3] + fields[4]
+	server.mu.Lock()
+	duplicate := job.shares[shareKey]
+	job.shares[shareKey] = true
+	server.mu.Unlock()
+	if duplicate {
+		return nil, &stratumError{stratumDuplicate, "Duplicate share"}
+	}
+	headerHash := header.BlockHash()
+	hashValue := blockchain.HashToBig(&headerHash)
+	if hashValue.Cmp(DifficultyToTarget(math.Min(c.difficulty, c.prevDifficulty))) > 0 {
+		return nil, &stratumError{stratumLowDifficulty, "Low difficulty share"}
+	}
+	if hashValue.Cmp(blockchain.CompactToBig(job.bits)) <= 0 {
+		if err := server.foundBlock(job, header, coinbase); err != nil {
+			fmt.Println("Error assembling block from share: ", err)
+		}
+	}
+	c.retarget()
+	return true, nil
+}
+
+// foundBlock assembles the block a share solved and hands it to OnBlock
+func (s *StratumServer) foundBlock(job *stratumJob, header wire.BlockHeader, coinbaseBytes []byte) error {
+	coinbase := new(wire.MsgTx)
+	if err := coinbase.DeserializeNoWitness(bytes.NewReader(coinbaseBytes)); err != nil {
+		return err
+	}
+	// the witness reserved value the commitment was made with
+	coinbase.TxIn[0].Witness = job.built.Coinbase.TxIn[0].Witness
+	block := wire.NewMsgBlock(&header)
+	block.AddTransaction(coinbase)
+	for _, tx := range job.built.Block.Transactions[1:] {
+		block.AddTransaction(tx)
+	}
+	blockHash := block.BlockHash()
+	s.mu.Lock()
+	seen := s.blocks[blockHash]
+	s.blocks[blockHash] = true
+	s.mu.Unlock()
+	if !seen && s.OnBlock != nil {
+		s.OnBlock(block)
+	}
+	return nil
+}
+
+// retarget counts an accepted share and, once RetargetTime has passed, moves the difficulty towards one share every
+// ShareTime, by at most a factor of 4 either way
+func (c *stratumConn) retarget() {
+	c.retargetShares++
+	elapsed := time.Since(c.retargetStart)
+	if elapsed < c.server.RetargetTime {
+		return
+	}
+	perShare := elapsed / time.Duration(c.retargetShares)
+	factor := math.Max(0.25, math.Min(4, float64(c.server.ShareTime)/float64(perShare)))
+	difficulty := c.server.clampDifficulty(c.difficulty * factor)
+	c.retargetStart = time.Now()
+	c.retargetShares = 0
+	c.prevDifficulty = c.difficulty
+	// small corrections aren't worth a message
+	if math.Abs(difficulty-c.difficulty) < c.difficulty*0.1 {
+		return
+	}
+	c.difficulty = difficulty
+	c.setDifficulty(difficulty)
+	c.server.mu.Lock()
+	job := c.server.current
+	c.server.mu.Unlock()
+	c.notify(job, false)
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// StratumClient is a single threaded CPU miner speaking stratum v1, for testing a StratumServer (or any pool) end
+// to end. it subscribes, authorizes, then hashes whatever job it was sent last, rolling extranonce2 when the nonces
+// run out, and submits every hash that meets the share difficulty
+type StratumClient struct {
+	Addr     string
+	User     string
+	Password string
+	// MaxBlocks stops the client once it has submitted that many shares that meet the network target, 0 for never
+	MaxBlocks int
+
+	Accepted atomic.Int64
+	Rejected atomic.Int64
+	Blocks   atomic.Int64
+
+	conn            net.Conn
+	writeMu         sync.Mutex
+	nextID          int
+	extraNonce1     []byte
+	extraNonce2Size int
+
+	mu         sync.Mutex
+	job        *clientJob
+	difficulty float64
+	generation atomic.Uint64 // bumped on every new job or difficulty, so the hashing loop picks it up
+	pending    map[int]bool  // ids of submits waiting for an answer, and whether they were blocks
+}
+
+// clientJob is a mining.notify as the client keeps it
+type clientJob struct {
+	id       string
+	prevHash chainhash.Hash
+	coinb1   []byte
+	coinb2   []byte
+	branch   []chainhash.Hash
+	version  int32
+	bits     uint32
+	ntime    uint32
+}
+
+// Run connects and mines until stop is closed, MaxBlocks blocks have been found or the connection drops
+func (c *StratumClient) Run(stop <-chan struct{}) error {
+	conn, err := net.Dial("tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.pending = map[int]bool{}
+	defer conn.Close()
+
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(make([]byte, 0, 4096), 1024*1024)
+	subscribeID := c.call("mining.subscribe", []interface{}{"stratum-cpu/1.0"})
+	if err := c.readSubscribe(lines, subscribeID); err != nil {
+		return err
+	}
+	c.call("mining.authorize", []interface{}{c.User, c.Password})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.readLoop(lines)
+	}()
+	finished := make(chan struct{})
+	go func() {
+		c.hashLoop(stop)
+		close(finished)
+	}()
+	select {
+	case <-stop:
+		return nil
+	case <-finished:
+		return nil
+	case err := <-done:
+		return err
+	}
+}
+
+// call sends a request and returns its id
+func (c *StratumClient) call(method string, params []interface{}) int {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.nextID++
+	line, _ := json.Marshal(map[string]interface{}{"id": c.nextID, "method": method, "params": params})
+	c.conn.Write(append(line, '\n'))
+	return c.nextID
+}
+
+type stratumClientMessage struct {
+	ID     *int              `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Error  json.RawMessage   `json:"error"`
+}
+
+func (c *StratumClient) readSubscribe(lines *bufio.Scanner, id int) error {
+	for lines.Scan() {
+		var message stratumClientMessage
+		if err := json.Unmarshal(lines.Bytes(), &message); err != nil {
+			return err
+		}
+		if message.ID == nil || *message.ID != id {
+			continue
+		}
+		var result []json.RawMessage
+		if err := json.Unmarshal(message.Result, &result); err != nil || len(result) < 3 {
+			return fmt.Errorf("mining.subscribe failed: %s", message.Error)
+		}
+		var extraNonce1 string
+		json.Unmarshal(result[1], &extraNonce1)
+		c.extraNonce1, _ = hex.DecodeString(extraNonce1)
+		return json.Unmarshal(result[2], &c.extraNonce2Size)
+	}
+	return errors.New("connection closed before mining.subscribe was answered")
+}
+
+func (c *StratumClient) readLoop(lines *bufio.Scanner) error {
+	for lines.Scan() {
+		var message stratumClientMessage
+		if err := json.Unmarshal(lines.Bytes(), &message); err != nil {
+			return err
+		}
+		switch message.Method {
+		case "mining.notify":
+			job, err := parseNotify(message.Params)
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			c.job = job
+			c.mu.Unlock()
+			c.generation.Add(1)
+		case "mining.set_difficulty":
+			var difficulty float64
+			if len(message.Params) > 0 {
+				json.Unmarshal(message.Params[0], &difficulty)
+			}
+			c.mu.Lock()
+			c.difficulty = difficulty
+			c.mu.Unlock()
+			c.generation.Add(1)
+		case "":
+			if message.ID == nil {
+				continue
+			}
+			c.mu.Lock()
+			block, isSubmit := c.pending[*message.ID]
+			delete(c.pending, *message.ID)
+			c.mu.Unlock()
+			if !isSubmit {
+				if string(message.Result) != "true" {
+					return fmt.Errorf("request %d failed: %s", *message.ID, message.Error)
+				}
+				continue
+			}
+			if string(message.Result) == "true" {
+				c.Accepted.Add(1)
+				if block {
+					c.Blocks.Add(1)
+				}
+			} else {
+				c.Rejected.Add(1)
+				fmt.Println("share rejected: ", string(message.Error))
+			}
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	return errors.New("connection closed")
+}
+
+func parseNotify(params []json.RawMessage) (*clientJob, error) {
+	if len(params) < 8 {
+		return nil, errors.New("mining.notify with too few params")
+	}
+	var id, prevHash, coinb1, coinb2, version, bits, ntime string
+	var branch []string
+	for i, field := range []interface{}{&id, &prevHash, &coinb1, &coinb2, &branch, &version, &bits, &ntime} {
+		if err := json.Unmarshal(params[i], field); err != nil {
+			return nil, fmt.Errorf("mining.notify param %d: %v", i, err)
+		}
+	}
+	job := &clientJob{id: id}
+	var err error
+	if job.prevHash, err = ParseStratumPrevHash(prevHash); err != nil {
+		return nil, err
+	}
+	if job.coinb1, err = hex.DecodeString(coinb1); err != nil {
+		return nil, err
+	}
+	if job.coinb2, err = hex.DecodeString(coinb2); err != nil {
+		return nil, err
+	}
+	for _, node := range branch {
+		hash, err := hex.DecodeString(node)
+		if err != nil || len(hash) != chainhash.HashSize {
+			return nil, fmt.Errorf("bad merkle branch node %q", node)
+		}
+		var h chainhash.Hash
+		copy(h[:], hash)
+		job.branch = append(job.branch, h)
+	}
+	var parsed [3]uint32
+	for i, field := range []string{version, bits, ntime} {
+		value, err := strconv.ParseUint(field, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("mining.notify: bad version, bits or ntime %q", field)
+		}
+		parsed[i] = uint32(value)
+	}
+	job.version, job.bits, job.ntime = int32(parsed[0]), parsed[1], parsed[2]
+	return job, nil
+}
+
+// hashLoop mines the current job until stop is closed or MaxBlocks is reached
+func (c *StratumClient) hashLoop(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if c.MaxBlocks > 0 && int(c.Blocks.Load()) >= c.MaxBlocks {
+			return
+		}
+		generation := c.generation.Load()
+		c.mu.Lock()
+		job, difficulty := c.job, c.difficulty
+		c.mu.Unlock()
+		if job == nil || difficulty <= 0 {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		c.mineJob(job, DifficultyToTarget(difficulty), func() bool {
+			select {
+			case <-stop:
+				return true
+			default:
+			}
+			return c.generation.Load() != generation || (c.MaxBlocks > 0 && int(c.Blocks.Load()) >= c.MaxBlocks)
+		})
+	}
+}
+
+// mineJob hashes a job until interrupted says to stop, which it asks every 65536 hashes
+func (c *StratumClient) mineJob(job *clientJob, shareTarget *big.Int, interrupted func() bool) {
+	networkTarget := blockchain.CompactToBig(job.bits)
+	extraNonce2 := make([]byte, c.extraNonce2Size)
+	for roll := uint64(0); ; roll++ {
+		for i := range extraNonce2 {
+			extraNonce2[len(extraNonce2)-1-i] = byte(roll >> (8 * i))
+		}
+		header, _ := StratumHeader(job.coinb1, c.extraNonce1, extraNonce2, job.coinb2, job.branch, job.version,
+			job.prevHash, job.bits, job.ntime, 0)
+		for nonce := uint32(0); ; nonce++ {
+			if nonce&0xffff == 0 && interrupted() {
+				return
+			}
+			header.Nonce = nonce
+			hash := header.BlockHash()
+			hashValue := blockchain.HashToBig(&hash)
+			if hashValue.Cmp(shareTarget) <= 0 {
+				c.submit(job, extraNonce2, nonce, hashValue.Cmp(networkTarget) <= 0)
+			}
+			if nonce == ^uint32(0) {
+				break
+			}
+		}
+	}
+}
+
+func (c *StratumClient) submit(job *clientJob, extraNonce2 []byte, nonce uint32, block bool) {
+	var nonceBytes [4]byte
+	binary.BigEndian.PutUint32(nonceBytes[:], nonce)
+	c.writeMu.Lock()
+	c.nextID++
+	id := c.nextID
+	line, _ := json.Marshal(map[string]interface{}{"id": id, "method": "mining.submit", "params": []string{
+		c.User, job.id, hex.EncodeToString(extraNonce2), fmt.Sprintf("%08x", job.ntime), hex.EncodeToString(nonceBytes[:])}})
+	c.mu.Lock()
+	c.pending[id] = block
+	c.mu.Unlock()
+	c.conn.Write(append(line, '\n'))
+	c.writeMu.Unlock()
+}
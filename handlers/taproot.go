@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// annexTag marks the last witness item of a taproot spend as an annex rather than a control block or signature
+const annexTag = 0x50
+
+// SchnorrSig is one BIP340 signature check a taproot input needs: sig over msg (the sighash) by the x-only PubKey
+type SchnorrSig struct {
+	Sig        []byte // 64 bytes, the sighash type byte removed
+	PubKey     []byte // 32 byte x-only key
+	Msg        []byte // 32 byte sighash
+	InputIndex int
+}
+
+// TaprootSigs works out the schnorr signature checks spending a taproot input takes, without doing them. a key path
+// spend is one check against the output key. for a script path spend the control block has to commit to the script
+// and the output key, which is checked here; a leaf of the form <key> OP_CHECKSIG adds its one signature check. any
+// other leaf is run through btcd's script engine right away, signatures and all, so it adds no checks when it passes
+func TaprootSigs(transaction types.TransactionData, inputIndex int, sigHashes *TxSigHashes) ([]SchnorrSig, error) {
+	input := transaction.Vin[inputIndex]
+	scriptPubKey, _ := hex.DecodeString(input.Prevout.ScriptPubKey)
+	version, outputKey, ok := script.WitnessProgram(scriptPubKey)
+	if !ok || version != 1 || len(outputKey) != 32 {
+		return nil, errors.New("not a taproot output")
+	}
+	witness := make([][]byte, len(input.Witness))
+	for i, item := range input.Witness {
+		var err error
+		if witness[i], err = hex.DecodeString(item); err != nil {
+			return nil, err
+		}
+	}
+	if len(witness) == 0 {
+		return nil, errors.New("empty witness")
+	}
+	var annex []byte
+	if len(witness) >= 2 && len(witness[len(witness)-1]) > 0 && witness[len(witness)-1][0] == annexTag {
+		annex = witness[len(witness)-1]
+		witness = witness[:len(witness)-1]
+	}
+
+	if len(witness) == 1 {
+		// key path
+		sig, err := taprootSig(witness[0], inputIndex, outputKey, sigHashes, annex, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []SchnorrSig{sig}, nil
+	}
+
+	// script path, the last item is the control block and the one before it the leaf script
+	leafScript := witness[len(witness)-2]
+	controlBlock, err := txscript.ParseControlBlock(witness[len(witness)-1])
+	if err != nil {
+		return nil, err
+	}
+	if err := txscript.VerifyTaprootLeafCommitment(controlBlock, outputKey, leafScript); err != nil {
+		return nil, err
+	}
+	stack := witness[:len(witness)-2]
+	if controlBlock.LeafVersion != txscript.BaseLeafVersion || len(leafScript) != 34 ||
+		leafScript[0] != script.OP_PUSHBYTES_32 || leafScript[33] != script.OP_CHECKSIG {
+		if err := executeTaprootInput(transaction, inputIndex); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("<key> OP_CHECKSIG leaf spent with %d stack items", len(stack))
+	}
+	leafHash := txscript.NewBaseTapLeaf(leafScript).TapHash()
+	sig, err := taprootSig(stack[0], inputIndex, leafScript[1:33], sigHashes, annex, leafHash[:])
+	if err != nil {
+		return nil, err
+	}
+	return []SchnorrSig{sig}, nil
+}
+
+// taprootScriptFlags are the consensus rules a taproot script path spend is executed under
+const taprootScriptFlags = txscript.ScriptBip16 | txscript.ScriptVerifyWitness | txscript.ScriptVerifyTaproot |
+	txscript.ScriptVerifyCheckLockTimeVerify | txscript.ScriptVerifyCheckSequenceVerify
+
+// executeTaprootInput runs the script engine over a taproot input, with every input's prevout for the sighashes
+func executeTaprootInput(transaction types.TransactionData, inputIndex int) error {
+	msgTx, err := TransactionDataToMsgTx(transaction)
+	if err != nil {
+		return err
+	}
+	prevouts := txscript.NewMultiPrevOutFetcher(nil)
+	for i, input := range transaction.Vin {
+		scriptPubKey, err := hex.DecodeString(input.Prevout.ScriptPubKey)
+		if err != nil {
+			return err
+		}
+		prevouts.AddPrevOut(msgTx.TxIn[i].PreviousOutPoint, wire.NewTxOut(int64(input.Prevout.Value), scriptPubKey))
+	}
+	prevout := prevouts.FetchPrevOutput(msgTx.TxIn[inputIndex].PreviousOutPoint)
+	engine, err := txscript.NewEngine(prevout.PkScript, msgTx, inputIndex, taprootScriptFlags, nil,
+		txscript.NewTxSigHashes(msgTx, prevouts), prevout.Value, prevouts)
+	if err != nil {
+		return err
+	}
+	return engine.Execute()
+}
+
+// taprootSig splits a 64 or 65 byte taproot signature into the signature and its sighash type, and computes the
+// sighash it signs
+func taprootSig(sigBytes []byte, inputIndex int, pubKey []byte, sigHashes *TxSigHashes, annex []byte, leafHash []byte) (SchnorrSig, error) {
+	hashType := byte(SigHashDefault)
+	switch len(sigBytes) {
+	case 64:
+	case 65:
+		// an explicit sighash type byte can't be the default one, that's what the 64 byte form is for
+		if sigBytes[64] == SigHashDefault {
+			return SchnorrSig{}, errors.New("65 byte signature with the default sighash type")
+		}
+		hashType = sigBytes[64]
+	default:
+		return SchnorrSig{}, fmt.Errorf("taproot signature of %d bytes", len(sigBytes))
+	}
+	msg, err := sigHashes.TaprootSigHash(inputIndex, hashType, annex, leafHash)
+	if err != nil {
+		return SchnorrSig{}, err
+	}
+	return SchnorrSig{Sig: sigBytes[:64], PubKey: pubKey, Msg: msg, InputIndex: inputIndex}, nil
+}
+
+// VerifySchnorrSig verifies a single BIP340 signature. signatures that verify are remembered in SignatureCache
+func VerifySchnorrSig(sig SchnorrSig) bool {
+	if SignatureCache.Exists(sig.Msg, sig.PubKey, sig.Sig) {
+		return true
+	}
+	signature, err := schnorr.ParseSignature(sig.Sig)
+	if err != nil {
+		return false
+	}
+	pubKey, err := schnorr.ParsePubKey(sig.PubKey)
+	if err != nil {
+		return false
+	}
+	if !signature.Verify(sig.Msg, pubKey) {
+		return false
+	}
+	SignatureCache.Add(sig.Msg, sig.PubKey, sig.Sig)
+	return true
+}
+
+// verifyTaprootInput checks every signature a taproot input needs one by one
+func verifyTaprootInput(transaction types.TransactionData, inputIndex int, sigHashes *TxSigHashes) bool {
+	sigs, err := TaprootSigs(transaction, inputIndex, sigHashes)
+	if err != nil {
+		return false
+	}
+	for _, sig := range sigs {
+		if !VerifySchnorrSig(sig) {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectSchnorrSigs gathers the schnorr signature checks of every taproot input of the transactions. inputs whose
+// witness doesn't even parse are left out
+func CollectSchnorrSigs(transactions []types.TransactionData) []SchnorrSig {
+	var sigs []SchnorrSig
+	for _, transaction := range transactions {
+		var sigHashes *TxSigHashes
+		for i, input := range transaction.Vin {
+			if InputType(input) != script.P2TR {
+				continue
+			}
+			if sigHashes == nil {
+				sigHashes = NewTxSigHashes(transaction)
+			}
+			if inputSigs, err := TaprootSigs(transaction, i, sigHashes); err == nil {
+				sigs = append(sigs, inputSigs...)
+			}
+		}
+	}
+	return sigs
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// mempoolTestDir is the challenge mempool, relative to this package
+const mempoolTestDir = "../mempool"
+
+// scriptPathSpend finds a mempool transaction spending a taproot input through a leaf that isn't <key> OP_CHECKSIG,
+// with a 64 byte signature first on the stack, like an inscription's reveal
+func scriptPathSpend(t *testing.T) (types.TransactionData, int) {
+	files, err := os.ReadDir(mempoolTestDir)
+	if err != nil {
+		t.Skip("no mempool directory:", err)
+	}
+	for _, file := range files {
+		transaction, err := LoadTxFile(filepath.Join(mempoolTestDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		for i, input := range transaction.Vin {
+			if !strings.HasPrefix(input.Prevout.ScriptPubKey, "5120") || len(input.Witness) != 3 ||
+				len(input.Witness[0]) != 128 || len(input.Witness[1]) == 68 {
+				continue
+			}
+			return transaction, i
+		}
+	}
+	t.Skip("no script path spend in the mempool")
+	return types.TransactionData{}, 0
+}
+
+func TestTaprootSigsExecutesLeaf(t *testing.T) {
+	transaction, inputIndex := scriptPathSpend(t)
+	sigs, err := TaprootSigs(transaction, inputIndex, NewTxSigHashes(transaction))
+	if err != nil {
+		t.Fatalf("%s input %d: %v", transaction.TxID, inputIndex, err)
+	}
+	if len(sigs) != 0 {
+		t.Errorf("%s input %d: executed leaf left %d signatures to check", transaction.TxID, inputIndex, len(sigs))
+	}
+
+	// the same spend with the signature broken has to fail in the leaf itself, the commitment still checks out
+	sig, _ := hex.DecodeString(transaction.Vin[inputIndex].Witness[0])
+	sig[63] ^= 1
+	broken := transaction
+	broken.Vin = append([]types.TransactionVin(nil), transaction.Vin...)
+	broken.Vin[inputIndex].Witness = append([]string{hex.EncodeToString(sig)}, transaction.Vin[inputIndex].Witness[1:]...)
+	if _, err := TaprootSigs(broken, inputIndex, NewTxSigHashes(broken)); err == nil {
+		t.Errorf("%s input %d: leaf passes with a bad signature", transaction.TxID, inputIndex)
+	}
+}
@@ -3,12 +3,12 @@ package handlers
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"sort"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
 	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
@@ -17,51 +17,15 @@ import (
 	"github.com/btcsuite/btcd/wire"
 )
 
+// FullTxValidation reports whether a transaction passes the consensus profile's rules (see builtin_rules.go), i.e the
+// structure, timelock, hash, signature and fee checks
 func FullTxValidation(transaction types.TransactionData) bool {
-	timeLockValid := ValidateTxTimeLock(transaction)
-	var validateHashes bool
-	var verifyTxSig bool
-	if timeLockValid {
-		validateHashes = ValidateTxHashes(transaction)
-		verifyTxSig = VerifyFullTxSig(transaction)
-	}
-
-	return validateHashes && verifyTxSig && timeLockValid
+	return ConsensusProfile.CheckTx(transaction) == nil
 }
 
+// SortTxs sorts transactions by fee per weight unit, highest first
 func SortTxs(transactions []types.TransactionData) {
-	sort.Slice(transactions, func(i, j int) bool {
-		inputAmountI := 0
-		outputAmountI := 0
-		for _, vin := range transactions[i].Vin {
-			inputAmountI += vin.Prevout.Value
-		}
-		for _, vout := range transactions[i].Vout {
-			outputAmountI += vout.Value
-		}
-		inputAmountJ := 0
-		outputAmountJ := 0
-		for _, vin := range transactions[j].Vin {
-			inputAmountJ += vin.Prevout.Value
-		}
-		for _, vout := range transactions[j].Vout {
-			outputAmountJ += vout.Value
-		}
-		// serialize transactions i and j and return the serialized transactions wi and without witness fields
-		_, _, txIWOWit, txIWithWith := SerializeATx(transactions[i])
-		_, _, txJWOWit, txJWithWith := SerializeATx(transactions[j])
-		txIBaseSize, txITotSize := len(txIWOWit), len(txIWithWith)
-		txJBaseSize, txJTotSize := len(txJWOWit), len(txJWithWith)
-		// calculate total weight for both transcation
-		txIWeight := txIBaseSize*3 + txITotSize
-		txJWeight := txJBaseSize*3 + txJTotSize
-		//calculate fee for both transactions
-		feeI := inputAmountI - outputAmountI
-		feeJ := inputAmountJ - outputAmountJ
-		ratioI := float64(feeI) / float64(txIWeight)
-		ratioJ := float64(feeJ) / float64(txJWeight)
-		return ratioI > ratioJ
-	})
+	SortTxsByStrategy(transactions, StrategyFeeRate)
 }
 
 func ValidateTxTimeLock(transaction types.TransactionData) bool {
@@ -101,21 +65,23 @@ func ValidateTxHashes(transaction types.TransactionData) bool {
 	// WE WILL CALL THE PUBKEY/REDEEMSCRIPT VARIABLE 'rawKey' FOR SIMPLICITY and 'rawKeyHash' FOR THE HASH
 	txIsVerified := true
 	overallStack := new(types.Stack)
-	for i, input := range transaction.Vin {
+	for _, input := range transaction.Vin {
 		stack := new(types.Stack)
-		if transaction.Vin[i].Prevout.ScriptPubKeyType == "v0_p2wpkh" {
+		inputType := InputType(input)
+		if inputType == script.P2WPKH {
+			// a p2wpkh witness is exactly <sig> <pubkey>, anything else is invalid rather than something to index into
+			if len(input.Witness) != 2 {
+				overallStack.Push([]byte{0x00})
+				break
+			}
 			sigBytes, _ := hex.DecodeString(input.ScriptSig)
 			pubKeyBytes, _ := hex.DecodeString(input.Witness[1]) // in this case, we are extracting the redeemscript
 			stack.Push(sigBytes)
 			stack.Push(pubKeyBytes)
 			hashPubKey := btcutil.Hash160(pubKeyBytes)
 			stack.Push(hashPubKey)
-			scriptPubKeyAsm := strings.Split(input.Prevout.ScriptPubKeyAsm, " ")
-			if len(scriptPubKeyAsm) >= 3 {
-				// here we extract hashed pubkey from scriptpubkey and add it to the stack
-				hashedKey, _ := hex.DecodeString(scriptPubKeyAsm[2])
-				stack.Push(hashedKey)
-			}
+			// here we extract hashed pubkey from scriptpubkey and add it to the stack
+			stack.Push(ScriptPubKeyHash(input.Prevout.ScriptPubKey))
 			providedPubKeyHash, _ := stack.Pop()
 			hashedPubKey, _ := stack.Pop()
 			if bytes.Equal(providedPubKeyHash, hashedPubKey) {
@@ -129,21 +95,21 @@ func ValidateTxHashes(transaction types.TransactionData) bool {
 				break
 			}
 
-		} else if transaction.Vin[i].Prevout.ScriptPubKeyType == "p2pkh" {
+		} else if inputType == script.P2PKH {
 			// fmt.Println("\n IS P2PKH ")
-			splitScriptSigAsm := strings.Split(input.ScriptSigAsm, " ")
-			sigBytes, _ := hex.DecodeString(splitScriptSigAsm[1])
-			pubKeyBytes, _ := hex.DecodeString(splitScriptSigAsm[3]) // in this case, we are extracting the redeemscript
+			scriptSigBytes, _ := hex.DecodeString(input.ScriptSig)
+			scriptSigPushes, err := script.Pushes(scriptSigBytes)
+			if err != nil || len(scriptSigPushes) != 2 {
+				overallStack.Push([]byte{0x00})
+				break
+			}
+			sigBytes, pubKeyBytes := scriptSigPushes[0], scriptSigPushes[1]
 			stack.Push(sigBytes)
 			stack.Push(pubKeyBytes)
 			hashPubKey := btcutil.Hash160(pubKeyBytes)
 			stack.Push(hashPubKey)
-			scriptPubKeyAsm := strings.Split(input.Prevout.ScriptPubKeyAsm, " ")
-			if len(scriptPubKeyAsm) >= 4 {
-				// here we extract hashed pubkey from scriptpubkey and add it to the stack
-				hashedKey, _ := hex.DecodeString(scriptPubKeyAsm[3])
-				stack.Push(hashedKey)
-			}
+			// here we extract hashed pubkey from scriptpubkey and add it to the stack
+			stack.Push(ScriptPubKeyHash(input.Prevout.ScriptPubKey))
 			providedPubKeyHash, _ := stack.Pop()
 			hashedPubKey, _ := stack.Pop()
 			if bytes.Equal(providedPubKeyHash, hashedPubKey) {
@@ -156,19 +122,19 @@ func ValidateTxHashes(transaction types.TransactionData) bool {
 				overallStack.Push([]byte{0x00})
 				break
 			}
-		} else if transaction.Vin[i].Prevout.ScriptPubKeyType == "p2sh" {
-			splitScriptSigAsm := strings.Split(input.ScriptSigAsm, " ")
-			pubKeyBytes, _ := hex.DecodeString(splitScriptSigAsm[len(splitScriptSigAsm)-1]) // in this case, we are extracting the redeemscript
+		} else if inputType == script.P2SH {
+			scriptSigBytes, _ := hex.DecodeString(input.ScriptSig)
+			pubKeyBytes, err := script.LastPush(scriptSigBytes) // in this case, we are extracting the redeemscript
+			if err != nil {
+				overallStack.Push([]byte{0x00})
+				break
+			}
 			stack.Push([]byte{0x00})
 			// stack.Push(sigBytes)
 			hashPubKey := btcutil.Hash160(pubKeyBytes)
 			stack.Push(hashPubKey)
-			scriptPubKeyAsm := strings.Split(input.Prevout.ScriptPubKeyAsm, " ")
-			if len(scriptPubKeyAsm) >= 3 {
-				// here we extract hashed pubkey from scriptpubkey and add it to the stack
-				hashedKey, _ := hex.DecodeString(scriptPubKeyAsm[2])
-				stack.Push(hashedKey)
-			}
+			// here we extract hashed pubkey from scriptpubkey and add it to the stack
+			stack.Push(ScriptPubKeyHash(input.Prevout.ScriptPubKey))
 			providedPubKeyHash, _ := stack.Pop()
 			hashedPubKey, _ := stack.Pop()
 			if bytes.Equal(providedPubKeyHash, hashedPubKey) {
@@ -181,19 +147,19 @@ func ValidateTxHashes(transaction types.TransactionData) bool {
 				overallStack.Push([]byte{0x00})
 				break
 			}
-		} else if transaction.Vin[i].Prevout.ScriptPubKeyType == "v0_p2wsh" {
+		} else if inputType == script.P2WSH {
+			if len(input.Witness) == 0 {
+				overallStack.Push([]byte{0x00})
+				break
+			}
 			sigBytes, _ := hex.DecodeString(input.ScriptSig)
 			pubKeyBytes, _ := hex.DecodeString(input.Witness[len(input.Witness)-1]) // in this case, we are extracting the redeemscript
 			stack.Push(sigBytes)
 			stack.Push(pubKeyBytes)
 			hashPubKey := chainhash.HashB(pubKeyBytes)
 			stack.Push(hashPubKey)
-			scriptPubKeyAsm := strings.Split(input.Prevout.ScriptPubKeyAsm, " ")
-			if len(scriptPubKeyAsm) >= 3 {
-				// here we extract hashed pubkey from scriptpubkey and add it to the stack
-				hashedKey, _ := hex.DecodeString(scriptPubKeyAsm[2])
-				stack.Push(hashedKey)
-			}
+			// here we extract hashed pubkey from scriptpubkey and add it to the stack
+			stack.Push(ScriptPubKeyHash(input.Prevout.ScriptPubKey))
 			providedPubKeyHash, _ := stack.Pop()
 			hashedPubKey, _ := stack.Pop()
 			if bytes.Equal(providedPubKeyHash, hashedPubKey) {
@@ -204,7 +170,7 @@ func ValidateTxHashes(transaction types.TransactionData) bool {
 				overallStack.Push([]byte{0x00})
 				break
 			}
-		} else if transaction.Vin[i].Prevout.ScriptPubKeyType == "v1_p2tr" {
+		} else if inputType == script.P2TR {
 			stack.Push([]byte{0x01})
 			overallStack.Push([]byte{0x01})
 			// return true
@@ -216,7 +182,7 @@ func ValidateTxHashes(transaction types.TransactionData) bool {
 
 	}
 	stackT, _ := overallStack.Pop()
-	if stackT[0] == 0x01 {
+	if len(stackT) > 0 && stackT[0] == 0x01 {
 		// fmt.Println("Valid transaction")
 		txIsVerified = true
 	} else {
@@ -283,288 +249,235 @@ func SerializeATx(transaction types.TransactionData) (*wire.MsgTx, *wire.MsgTx,
 	return tx, wTx, rawTxBytes, txBuf1.Bytes()
 }
 
-// TODO: Rename this function as it effectively calculates th signature hash message, so an appropriate name should be given
+// SerializeATxWOSigScript returns the SIGHASH_ALL signature hash of one input. it predates CalcSigHash, which it now
+// just calls with freshly computed sighash midstates, so prefer CalcSigHash with a shared TxSigHashes when hashing
+// several inputs
 func SerializeATxWOSigScript(transaction types.TransactionData, inputIndex int) []byte {
-	numberOfInputs := len(transaction.Vin)
-	numberOfOutputs := len(transaction.Vout)
-	tx := wire.NewMsgTx(int32(transaction.Version))
-
-	// Add the inputs
-	for i := 0; i < numberOfInputs; i++ {
-		var txIn *wire.TxIn
-		input := transaction.Vin[i]
-		prevOutHash, _ := chainhash.NewHashFromStr(input.TxID)
-		prevOut := wire.NewOutPoint(prevOutHash, uint32(input.Vout))
-		// scripPubKey, _ := hex.DecodeString(input.Prevout.ScriptPubKey)
-		txIn = wire.NewTxIn(prevOut, nil, nil)
-		// if transaction.Vin[i].Prevout.ScriptPubKeyType == "p2sh" {
-		// 	txIn = wire.NewTxIn(prevOut, nil, nil)
-		// } else if transaction.Vin[i].Prevout.ScriptPubKeyType == "p2pkh" {
-		// 	txIn = wire.NewTxIn(prevOut, nil, nil)
-		// } else if transaction.Vin[i].Prevout.ScriptPubKeyType == "v0_p2wpkh" {
-		// 	txIn = wire.NewTxIn(prevOut, nil, nil)
-		// } else if transaction.Vin[i].Prevout.ScriptPubKeyType == "v0_p2wsh" {
-		// 	txIn = wire.NewTxIn(prevOut, nil, nil)
-		// } else if transaction.Vin[i].Prevout.ScriptPubKeyType == "v1_p2tr" {
-		// 	txIn = wire.NewTxIn(prevOut, nil, nil)
-		// }
-
-		txIn.Sequence = uint32(input.Sequence)
-		tx.AddTxIn(txIn)
-	}
-
-	// Add the outputs
-	for i := 0; i < numberOfOutputs; i++ {
-		output := transaction.Vout[i]
-		scriptPubKey, _ := hex.DecodeString(output.ScriptPubKey)
-		txOut := wire.NewTxOut(int64(output.Value), scriptPubKey)
-		tx.AddTxOut(txOut)
-	}
-
-	tx.LockTime = uint32(transaction.Locktime)
-
-	var rawTxBytes []byte
-	if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "p2pkh" { // this is just temporary and a more robust way of handling this should be implemented
-		input := transaction.Vin[inputIndex]
-		scripPubKey, _ := hex.DecodeString(input.Prevout.ScriptPubKey)
-		tx.TxIn[inputIndex].SignatureScript = scripPubKey
-		// Serialize
-		var txBuffer bytes.Buffer
-		serializeErr := tx.Serialize(&txBuffer)
-		if serializeErr != nil {
-			fmt.Println("Error serializing transaction:", serializeErr)
-			return nil
-		}
-		rawTxBytes = txBuffer.Bytes()
-		rawTxHex := hex.EncodeToString(rawTxBytes)
-		rawTxHex = rawTxHex + "01000000"
-		txWithSighashBytes, _ := hex.DecodeString(rawTxHex)
-		hashedTx := chainhash.DoubleHashB(txWithSighashBytes)
-		return hashedTx
-	} else if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "p2sh" && transaction.Vin[inputIndex].Witness == nil {
-		scriptSigAsmSplitted := strings.Split(transaction.Vin[inputIndex].ScriptSigAsm, " ")
-		redeemScriptBytes, _ := hex.DecodeString(scriptSigAsmSplitted[len(scriptSigAsmSplitted)-1])
-		tx.TxIn[inputIndex].SignatureScript = redeemScriptBytes
-		var txBuf bytes.Buffer
-		tx.Serialize(&txBuf)
-		rawTxBytes = txBuf.Bytes()
-		rawTxHex := hex.EncodeToString(rawTxBytes)
-		rawTxHex = rawTxHex + "01000000"
-		txWithSighashBytes, _ := hex.DecodeString(rawTxHex)
-		hashedTx := chainhash.DoubleHashB(txWithSighashBytes)
-		// fmt.Println("\nserialized: ", rawTxHex, "tx id: ", transaction.TxFilename)
-		return hashedTx
-		// }
-	} else {
-		input := transaction.Vin[inputIndex]
-		output := transaction.Vout
-		version := transaction.Version
-		versionFormatted := fmt.Sprintf("%08x", version)
-		hexVersion := ReverseBytesFromHexStr(versionFormatted) // method basically reverses the hex string bytes
-		// now to the inputs
-		// hash of all outpoints
-		var serializedInputsStr string
-		for _, vin := range transaction.Vin {
-			hashedTxId, _ := chainhash.NewHashFromStr(vin.TxID)
-			reversedTxId := ReverseBytesFromHexStr(hashedTxId.String())
-			reversedVout := ReverseBytesFromHexStr(fmt.Sprintf("%08x", vin.Vout))
-			serializedInputsStr += reversedTxId + reversedVout
-		}
-		// hashedTxId, _ := chainhash.NewHashFromStr(input.TxID)
-		// reversedTxId := ReverseBytesFromHexStr(hashedTxId.String())
-		// reversedVout := ReverseBytesFromHexStr(fmt.Sprintf("%08x", input.Vout))
-		// serializedInput := reversedTxId + reversedVout
-		serializedInputsBytes, _ := hex.DecodeString(serializedInputsStr)
-		hashInputs := chainhash.DoubleHashH(serializedInputsBytes)
-		hashInputsReversed := ReverseBytesFromHexStr(hashInputs.String())
-		// get all the sequences from inputs and hash each of them
-		sequencesStr := ""
-		for _, vin := range transaction.Vin {
-			sequencesHex := fmt.Sprintf("%08x", vin.Sequence)
-			sequencesStr += sequencesHex
-		}
-		sequencesHex := sequencesStr
-		sequencesBytes, _ := hex.DecodeString(sequencesHex)
-		reverseSequencesBytes := ReverseSlice(sequencesBytes)
-		sequencesHash := chainhash.DoubleHashH(reverseSequencesBytes)
-		sequencesHashReversed := ReverseBytesFromHexStr(sequencesHash.String())
-		// serialize the output we want to spend
-		hashedTxId, _ := chainhash.NewHashFromStr(input.TxID)
-		reversedTxId := ReverseBytesFromHexStr(hashedTxId.String())
-		reversedVout := ReverseBytesFromHexStr(fmt.Sprintf("%08x", input.Vout))
-		serializedInputToSign := reversedTxId + reversedVout
-		// get the pubkey to use in the script code
-		scriptPubKeyAsm := strings.Split(input.Prevout.ScriptPubKeyAsm, " ")
-		pubkeyHashStr := scriptPubKeyAsm[2]
-		var scriptCode string
-		if input.Prevout.ScriptPubKeyType == "v0_p2wpkh" {
-			scriptCode = "1976a914" + pubkeyHashStr + "88ac"
-		} else if input.Prevout.ScriptPubKeyType == "p2sh" && len(input.Witness) == 2 {
-			scriptSigAsmSplitted := strings.Split(input.InnerRedeemScript, " ")
-			redeemScriptStr := scriptSigAsmSplitted[len(scriptSigAsmSplitted)-1]
-			scriptCode = "1976a914" + redeemScriptStr + "88ac"
-		} else if input.Prevout.ScriptPubKeyType == "v0_p2wsh" || (input.Prevout.ScriptPubKeyType == "p2sh" && len(input.Witness) > 2) {
-			witnessScript := input.Witness[len(input.Witness)-1]
-			witnessScriptByteLength := len(witnessScript) / 2
-			witnessScriptByteLengthHex := fmt.Sprintf("%02x", witnessScriptByteLength)
-			scriptCode = witnessScriptByteLengthHex + witnessScript
-		}
-
-		amt := input.Prevout.Value
-		amtP := fmt.Sprintf("%016x", amt)
-		hexEncodedAmt := ReverseBytesFromHexStr(amtP)
-		// get the sequence of the input we want to sign and serialize.
-		inputSequence := fmt.Sprintf("%08x", input.Sequence)
-		inputSequenceBytes, _ := hex.DecodeString(inputSequence)
-		reverseInputSequenceBytes := ReverseSlice(inputSequenceBytes)
-		serializeInputSequenceToSign := hex.EncodeToString(reverseInputSequenceBytes)
-		// serializeSequenceToSign := hex.EncodeToString(reverseSequencesBytes)
-		// now serialize outputs and hash em
-		var outputsSerialized string
-		for i := 0; i < len(output); i++ {
-			hexReverseOutput1Amt := ReverseBytesFromHexStr(fmt.Sprintf("%016x", output[i].Value))
-			output1ScriptPubKeyLen := len(output[i].ScriptPubKey) / 2
-			output1ScriptPubKeyLenHex := fmt.Sprintf("%02x", output1ScriptPubKeyLen)
-			output1ScriptPubKey := output[i].ScriptPubKey
-			currOutputSerialized := hexReverseOutput1Amt + output1ScriptPubKeyLenHex + output1ScriptPubKey
-			outputsSerialized = outputsSerialized + currOutputSerialized
-		}
-		outputsSerializedBytes, _ := hex.DecodeString(outputsSerialized)
-		outputsHash := chainhash.DoubleHashH(outputsSerializedBytes)
-		outputsHashHex := outputsHash.String()
-		outputsHashHex = ReverseBytesFromHexStr(outputsHashHex)
-		hexReverseLocktime := ReverseBytesFromHexStr(fmt.Sprintf("%08x", transaction.Locktime))
-		preImg := hexVersion + hashInputsReversed + sequencesHashReversed + serializedInputToSign + scriptCode + hexEncodedAmt + serializeInputSequenceToSign + outputsHashHex + hexReverseLocktime + "01000000"
-		// fmt.Println("Preimage 2: ", preImg)
-		myPreImgBytes, _ := hex.DecodeString(preImg)
-		hashedPreImg := chainhash.DoubleHashB(myPreImgBytes)
-		return hashedPreImg
-	}
+	return CalcSigHash(transaction, inputIndex, NewTxSigHashes(transaction), SigHashAll)
 }
 
+// VerifyTxSig verifies the signature(s) of one input, see VerifyTxInputSig
 func VerifyTxSig(transaction types.TransactionData, inputIndex int) bool {
+	return VerifyTxInputSig(transaction, inputIndex, NewTxSigHashes(transaction))
+}
 
-	rawTxBytes := SerializeATxWOSigScript(transaction, inputIndex)
+// VerifyTxInputSig verifies the signature(s) of one input, using the transaction's precomputed sighash midstates
+func VerifyTxInputSig(transaction types.TransactionData, inputIndex int, sigHashes *TxSigHashes) bool {
+	inputType := InputType(transaction.Vin[inputIndex])
+	if inputType == script.P2TR {
+		return verifyTaprootInput(transaction, inputIndex, sigHashes)
+	}
 	var sig []byte
 	var pubKeyBytes []byte
-	multiSigRedeemStack := new(types.Stack)
-	if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "p2pkh" {
-		scriptSigAsm := strings.Split(transaction.Vin[inputIndex].ScriptSigAsm, " ")
-		sig, _ = hex.DecodeString(scriptSigAsm[1])
-		pubKeyBytes, _ = hex.DecodeString(scriptSigAsm[3])
-	} else if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "v1_p2tr" {
-		return true
-	} else if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "v0_p2wpkh" {
+	if inputType == script.P2PKH {
+		scriptSigBytes, _ := hex.DecodeString(transaction.Vin[inputIndex].ScriptSig)
+		scriptSigPushes, err := script.Pushes(scriptSigBytes)
+		if err != nil || len(scriptSigPushes) != 2 {
+			return false
+		}
+		sig, pubKeyBytes = scriptSigPushes[0], scriptSigPushes[1]
+	} else if inputType == script.P2WPKH {
+		if len(transaction.Vin[inputIndex].Witness) != 2 {
+			return false
+		}
 		sig, _ = hex.DecodeString(transaction.Vin[inputIndex].Witness[0])
 		pubKeyBytes, _ = hex.DecodeString(transaction.Vin[inputIndex].Witness[1])
-	} else if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "p2sh" && len(transaction.Vin[inputIndex].Witness) == 2 {
+	} else if inputType == script.P2SH && len(transaction.Vin[inputIndex].Witness) == 2 {
 		sig, _ = hex.DecodeString(transaction.Vin[inputIndex].Witness[0])
 		pubKeyBytes, _ = hex.DecodeString(transaction.Vin[inputIndex].Witness[1])
-	} else if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "v0_p2wsh" || (transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "p2sh" && (transaction.Vin[inputIndex].Witness == nil || len(transaction.Vin[inputIndex].Witness) > 2)) {
-		// TODO check if the witness first field is empty. if not. more complex script don't validate
-		// fmt.Println("Currently verifying tx: ", transaction.TxFilename)
-		if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "p2sh" && transaction.Vin[inputIndex].Witness == nil {
-			scriptSigSplitted := strings.Split(transaction.Vin[inputIndex].ScriptSigAsm, " ")
-			emptyStringByte, _ := hex.DecodeString("00")
-			multiSigRedeemStack.Push(emptyStringByte)
-			// get a subset of the scriptSigsplitted without the last two items (opcode to push witness script and witness script itself)
-			scriptSigSplittedSubset := scriptSigSplitted[:len(scriptSigSplitted)-2]
-			for _, op := range scriptSigSplittedSubset {
-				if strings.Contains(op, "_PUSHDATA") {
-					break
-				} else {
-					if strings.HasPrefix(op, "OP") {
-						continue
-					} else {
-						opBytes, _ := hex.DecodeString(op)
-						multiSigRedeemStack.Push(opBytes)
-					}
+	} else if inputType == script.P2WSH || inputType == script.Multisig || (inputType == script.P2SH && (transaction.Vin[inputIndex].Witness == nil || len(transaction.Vin[inputIndex].Witness) > 2)) {
+		// collect the items the spender placed on the stack ahead of the multisig script (the dummy element followed
+		// by the signatures) and the multisig script itself. where these live depends on how the script is wrapped
+		input := transaction.Vin[inputIndex]
+		var stackItems [][]byte
+		var multisigScript []byte
+		if inputType == script.Multisig || (inputType == script.P2SH && input.Witness == nil) {
+			scriptSigBytes, _ := hex.DecodeString(input.ScriptSig)
+			pushes, err := script.Pushes(scriptSigBytes)
+			if err != nil {
+				return false
+			}
+			if inputType == script.Multisig {
+				// bare multisig, the script is the scriptpubkey itself
+				stackItems = pushes
+				multisigScript, _ = hex.DecodeString(input.Prevout.ScriptPubKey)
+			} else {
+				// p2sh, the last push of the scriptsig is the redeem script
+				if len(pushes) == 0 {
+					return false
 				}
+				stackItems = pushes[:len(pushes)-1]
+				multisigScript = pushes[len(pushes)-1]
 			}
-
 		} else {
-			witnesses := transaction.Vin[inputIndex].Witness
-			if witnesses[0] != "" {
+			// p2wsh and p2sh-p2wsh, the last witness item is the witness script
+			witnesses := input.Witness
+			if len(witnesses) == 0 {
 				return false
 			}
-			if witnesses[0] == "" {
-				emptyStringByte, _ := hex.DecodeString("00")
-				multiSigRedeemStack.Push(emptyStringByte)
-			} else {
-				emptyStringByte, _ := hex.DecodeString(witnesses[0])
-				multiSigRedeemStack.Push(emptyStringByte)
-			}
-			for i := 1; i < len(witnesses)-1; i++ { // len(witnesses)-1 be3cause we don't want to include last item (witness script)
-				witnessBytes, _ := hex.DecodeString(witnesses[i])
-				multiSigRedeemStack.Push(witnessBytes)
+			for _, w := range witnesses[:len(witnesses)-1] {
+				witnessBytes, err := hex.DecodeString(w)
+				if err != nil {
+					return false
+				}
+				stackItems = append(stackItems, witnessBytes)
 			}
+			multisigScript, _ = hex.DecodeString(witnesses[len(witnesses)-1])
 		}
-		var witnessScriptAsm []string
-		if transaction.Vin[inputIndex].Prevout.ScriptPubKeyType == "p2sh" && transaction.Vin[inputIndex].Witness == nil {
-			witnessScriptAsm = strings.Split(transaction.Vin[inputIndex].InnerRedeemScript, " ")
-		} else {
-			witnessScriptAsm = strings.Split(transaction.Vin[inputIndex].InnerWitnessScript, " ")
+		return VerifyCheckMultiSig(func(hashType uint32) []byte {
+			return CalcSigHash(transaction, inputIndex, sigHashes, hashType)
+		}, stackItems, multisigScript)
+	}
+	// each signature says what it signs with its last byte
+	return verifyECDSASig(CalcSigHash(transaction, inputIndex, sigHashes, SigHashType(sig)), sig, pubKeyBytes)
+}
+
+// VerifyCheckMultiSig evaluates OP_CHECKMULTISIG the way the consensus rules do. stackItems are the items the spender
+// pushed ahead of the script, i.e the dummy element followed by the signatures. signatures must appear in the same order
+// as their pubkeys in the script, and each pubkey is only ever tried once, so a key can't satisfy more than one signature.
+// every signature can sign with a different hash type, so sigHash gives the input's signature hash for one
+func VerifyCheckMultiSig(sigHash func(hashType uint32) []byte, stackItems [][]byte, multisigScript []byte) bool {
+	requiredSigs, pubKeys, err := script.ParseMultisig(multisigScript)
+	if err != nil {
+		return false
+	}
+	// CHECKMULTISIG pops one more item than it needs (the dummy element), and that item must be empty (NULLDUMMY)
+	if len(stackItems) != requiredSigs+1 || len(stackItems[0]) != 0 {
+		return false
+	}
+	sigs := stackItems[1:]
+	keyIndex := 0
+	for sigIndex := 0; sigIndex < len(sigs); keyIndex++ {
+		// if there are fewer keys left than signatures left, there's no way for the rest of the signatures to match
+		if len(pubKeys)-keyIndex < len(sigs)-sigIndex {
+			return false
 		}
-		for _, witness := range witnessScriptAsm {
-			if strings.Contains(witness, "PUSHBYTES") || strings.Contains(witness, "OP_CHECK") {
-				continue
-			} else if strings.Contains(witness, "PUSHNUM_") {
-				opCodeSplit := strings.Split(witness, "_")
-				scriptOpCodeVal := fmt.Sprintf("%02s", opCodeSplit[len(opCodeSplit)-1])
-				opCodeVal, _ := hex.DecodeString(scriptOpCodeVal)
-				multiSigRedeemStack.Push(opCodeVal)
-			} else {
-				opCodeVal, _ := hex.DecodeString(witness)
-				multiSigRedeemStack.Push(opCodeVal)
-			}
+		sig := sigs[sigIndex]
+		if verifyECDSASig(sigHash(SigHashType(sig)), sig, pubKeys[keyIndex]) {
+			sigIndex++
 		}
-		// NOW CHECK SIGNATURES
-		var pubkeys []string
-		var sigs []string
-		numOfPupKeys, _ := multiSigRedeemStack.Pop()
-		numOfPupKeysInt, _ := strconv.Atoi(hex.EncodeToString(numOfPupKeys))
-		for i := 0; i < numOfPupKeysInt; i++ {
-			pubKey, _ := multiSigRedeemStack.Pop()
-			pubkeyStr := hex.EncodeToString(pubKey)
-			pubkeys = append([]string{pubkeyStr}, pubkeys...)
+	}
+	return true
+}
+
+// ScriptPubKeyHash returns the hash committed to by a p2pkh, p2sh, p2wpkh or p2wsh scriptpubkey, i.e the data of its
+// first non empty push. it returns nil if the script has no such push
+func ScriptPubKeyHash(scriptPubKeyHex string) []byte {
+	instructions, err := script.ParseHex(scriptPubKeyHex)
+	if err != nil {
+		return nil
+	}
+	for _, ins := range instructions {
+		if len(ins.Data) > 0 {
+			return ins.Data
+		}
+	}
+	return nil
+}
+
+// InputType classifies the output an input spends from the bytes of its scriptpubkey. all dispatch on script type
+// goes through here rather than trusting the scriptpubkey_type field in the json
+func InputType(input types.TransactionVin) script.Class {
+	return script.ClassifyHex(input.Prevout.ScriptPubKey)
+}
+
+// the json integrity errors, wrapped by what CheckTxScriptTypes and CheckTxAsm return
+var (
+	ErrScriptTypeMismatch = errors.New("declared script type doesn't match the script")
+	ErrAsmMismatch        = errors.New("asm doesn't match the script")
+)
+
+// CheckTxScriptTypes returns an error for the first prevout or output whose scriptpubkey_type in the json disagrees
+// with the type computed from its scriptpubkey bytes
+func CheckTxScriptTypes(transaction types.TransactionData) error {
+	for i, input := range transaction.Vin {
+		if class := InputType(input); !script.MatchesDeclaredType(input.Prevout.ScriptPubKeyType, class) {
+			return fmt.Errorf("input %d: %w: declared %s, computed %s", i, ErrScriptTypeMismatch, input.Prevout.ScriptPubKeyType, class)
+		}
+	}
+	for i, output := range transaction.Vout {
+		if class := script.ClassifyHex(output.ScriptPubKey); !script.MatchesDeclaredType(output.ScriptPubKeyType, class) {
+			return fmt.Errorf("output %d: %w: declared %s, computed %s", i, ErrScriptTypeMismatch, output.ScriptPubKeyType, class)
 		}
-		numOfSigs, _ := multiSigRedeemStack.Pop()
-		numOfSigsInt, _ := strconv.Atoi(hex.EncodeToString(numOfSigs))
-		for i := 0; i < numOfSigsInt; i++ {
-			sig, _ := multiSigRedeemStack.Pop()
-			sigStr := hex.EncodeToString(sig)
-			sigs = append([]string{sigStr}, sigs...)
+	}
+	return nil
+}
+
+// ValidateTxScriptTypes reports whether every declared scriptpubkey_type matches its script, see CheckTxScriptTypes
+func ValidateTxScriptTypes(transaction types.TransactionData) bool {
+	if err := CheckTxScriptTypes(transaction); err != nil {
+		fmt.Println("Script type mismatch in tx: ", transaction.TxFilename, err)
+		return false
+	}
+	return true
+}
+
+// CheckTxAsm checks every asm field supplied in the mempool json against the hex it is supposed to describe and
+// returns an error for the first that doesn't match. the validation code itself only ever looks at the hex, so this
+// is purely a check on the integrity of the json
+func CheckTxAsm(transaction types.TransactionData) error {
+	for i, input := range transaction.Vin {
+		err := script.VerifyAsm(input.ScriptSig, input.ScriptSigAsm)
+		if err == nil {
+			err = script.VerifyAsm(input.Prevout.ScriptPubKey, input.Prevout.ScriptPubKeyAsm)
 		}
-		var checkMultiSigValid []bool
-		for _, sig := range sigs {
-			sigBytes, _ := hex.DecodeString(sig)
-			signature, parseScriptErr := ecdsa.ParseDERSignature(sigBytes)
-			if parseScriptErr != nil {
-				fmt.Println("Error parsing signature:", parseScriptErr, "transaction: ", transaction.TxFilename, "\n sig:", hex.EncodeToString(sigBytes))
+		if err == nil && input.InnerRedeemScript != "" {
+			scriptSigBytes, _ := hex.DecodeString(input.ScriptSig)
+			var redeemScript []byte
+			if redeemScript, err = script.LastPush(scriptSigBytes); err == nil {
+				err = script.VerifyAsm(hex.EncodeToString(redeemScript), input.InnerRedeemScript)
 			}
-			for _, pubkey := range pubkeys {
-				pubKeyBytes, _ := hex.DecodeString(pubkey)
-				pubKey, _ := btcec.ParsePubKey(pubKeyBytes)
-				verified := signature.Verify(rawTxBytes, pubKey)
-				if verified {
-					// fmt.Println("Signature verified!!! Tx: ", transaction.TxFilename)
-					checkMultiSigValid = append(checkMultiSigValid, true)
-					break
-				}
+		}
+		if err == nil && input.InnerWitnessScript != "" {
+			if len(input.Witness) == 0 {
+				err = errors.New("inner witness script asm supplied without a witness")
+			} else {
+				err = script.VerifyAsm(input.Witness[len(input.Witness)-1], input.InnerWitnessScript)
 			}
 		}
-		if len(checkMultiSigValid) != numOfSigsInt {
-			return false
-		} else {
-			return true
+		if err != nil {
+			return fmt.Errorf("input %d: %w: %v", i, ErrAsmMismatch, err)
 		}
 	}
-	// Parse the DER encoded signature
-	signature, _ := ecdsa.ParseDERSignature(sig)
-	pubKey, _ := btcec.ParsePubKey(pubKeyBytes)
-	verified := signature.Verify(rawTxBytes, pubKey)
-	// fmt.Println("verified:", verified)
-	return verified
+	for i, output := range transaction.Vout {
+		if err := script.VerifyAsm(output.ScriptPubKey, output.ScriptPubKeyAsm); err != nil {
+			return fmt.Errorf("output %d: %w: %v", i, ErrAsmMismatch, err)
+		}
+	}
+	return nil
+}
+
+// ValidateTxAsm reports whether every asm field in the json matches its hex, see CheckTxAsm
+func ValidateTxAsm(transaction types.TransactionData) bool {
+	if err := CheckTxAsm(transaction); err != nil {
+		fmt.Println("Asm mismatch in tx: ", transaction.TxFilename, err)
+		return false
+	}
+	return true
+}
+
+// verifyECDSASig checks a DER signature (with its trailing sighash type byte) against a serialized pubkey. signatures
+// that verify are remembered in SignatureCache
+func verifyECDSASig(sigHash []byte, sigBytes []byte, pubKeyBytes []byte) bool {
+	if len(sigBytes) == 0 {
+		return false
+	}
+	if SignatureCache.Exists(sigHash, pubKeyBytes, sigBytes) {
+		return true
+	}
+	signature, err := ecdsa.ParseDERSignature(sigBytes)
+	if err != nil {
+		return false
+	}
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return false
+	}
+	if !signature.Verify(sigHash, pubKey) {
+		return false
+	}
+	SignatureCache.Add(sigHash, pubKeyBytes, sigBytes)
+	return true
 }
 
 // This function goes through each transaction input, tries to verify the signature and then proceeds to the next input
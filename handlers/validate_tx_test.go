@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/script"
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// validSpend finds a valid mempool transaction with an input spending the given output type
+func validSpend(t *testing.T, class script.Class) (types.TransactionData, int) {
+	files, err := os.ReadDir(mempoolTestDir)
+	if err != nil {
+		t.Skip("no mempool directory:", err)
+	}
+	for _, file := range files {
+		transaction, err := LoadTxFile(filepath.Join(mempoolTestDir, file.Name()))
+		if err != nil || !FullTxValidation(transaction) {
+			continue
+		}
+		for i, input := range transaction.Vin {
+			if InputType(input) == class {
+				return transaction, i
+			}
+		}
+	}
+	t.Skipf("no valid %s spend in the mempool", class)
+	return types.TransactionData{}, 0
+}
+
+// TestShortWitnessIsInvalid makes sure a witness with too few items, as a peer could relay it, is an invalid
+// transaction rather than an index out of range
+func TestShortWitnessIsInvalid(t *testing.T) {
+	for _, class := range []script.Class{script.P2WPKH, script.P2WSH} {
+		transaction, inputIndex := validSpend(t, class)
+		for _, witness := range [][]string{nil, {}, transaction.Vin[inputIndex].Witness[:1]} {
+			if class == script.P2WSH && len(witness) == 1 {
+				// a lone witness script is well formed, it just doesn't hold up
+				continue
+			}
+			short := transaction
+			short.Vin = append([]types.TransactionVin(nil), transaction.Vin...)
+			short.Vin[inputIndex].Witness = witness
+			if ValidateTxHashes(short) {
+				t.Errorf("%s input with %d witness items passes the hash check", class, len(witness))
+			}
+			if VerifyTxSig(short, inputIndex) {
+				t.Errorf("%s input with %d witness items has a valid signature", class, len(witness))
+			}
+			if FullTxValidation(short) {
+				t.Errorf("%s input with %d witness items is valid", class, len(witness))
+			}
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// submittedPrefix names the entries of transactions that came through Submit rather than from a file
+const submittedPrefix = "submitted/"
+
+// MempoolWatcher keeps a validated view of a mempool directory current. every Poll compares the directory with what it
+// saw last time: new and modified json files are decoded and validated (and only those), and transactions whose file
+// disappeared are dropped along with their descendants, since those spend outputs that are gone. it polls rather than
+// subscribing to file system events so it works the same everywhere. raw hex files are ignored. transactions from
+// elsewhere, e.g p2p, can be handed to Submit and go through the same validation on the next Poll, or a later one if
+// they have to wait for a parent. a new transaction spending the same outputs as one already in replaces it or is
+// dropped, as RBFPolicy decides, and one that would make a family of unconfirmed transactions go over MempoolLimits is
+// dropped
+type MempoolWatcher struct {
+	dir     string
+	profile *Profile
+	workers int
+	files   map[string]watchedFile // every json file seen in the directory, by name
+	entries map[string]*TxEntry    // the transactions in the mempool, by file name
+	// Prevouts are outputs submitted transactions may spend besides the mempool's, e.g from prevout files
+	Prevouts UTXOSet
+
+	replaced []types.Replacement
+
+	mu        sync.Mutex
+	submitted []*wire.MsgTx
+	orphans   []*wire.MsgTx // submitted transactions waiting for a parent, oldest first, only touched by Poll
+}
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// MempoolChange is what a Poll found
+type MempoolChange struct {
+	Added    []*TxEntry // newly added transactions, validated
+	Removed  []string   // txids of the transactions dropped, descendants of deleted files and replaced txs included
+	Rejected int        // files that aren't transactions or don't match their name, orphans dropped from a full pool, and txs RBFPolicy or MempoolLimits turned down
+	Orphans  int        // submitted transactions still waiting for a parent
+	Replaced []types.Replacement
+}
+
+// Empty reports whether the poll found nothing to do
+func (c MempoolChange) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && c.Rejected == 0 && len(c.Replaced) == 0
+}
+
+// NewMempoolWatcher creates a watcher for a mempool directory. it starts out empty, the first Poll loads the directory
+func NewMempoolWatcher(dir string, profile *Profile, workers int) *MempoolWatcher {
+	return &MempoolWatcher{
+		dir:     dir,
+		profile: profile,
+		workers: workers,
+		files:   map[string]watchedFile{},
+		entries: map[string]*TxEntry{},
+	}
+}
+
+// Poll brings the watcher up to date with the directory and reports what changed
+func (w *MempoolWatcher) Poll() (MempoolChange, error) {
+	var change MempoolChange
+	dirEntries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return change, err
+	}
+	current := make(map[string]watchedFile, len(dirEntries))
+	var added []string
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || IsRawTxFile(dirEntry.Name()) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			// deleted since ReadDir
+			continue
+		}
+		file := watchedFile{modTime: info.ModTime(), size: info.Size()}
+		current[dirEntry.Name()] = file
+		if seen, ok := w.files[dirEntry.Name()]; !ok || seen != file {
+			added = append(added, dirEntry.Name())
+		}
+	}
+
+	// a modified file is dropped and then read again, like a deletion followed by an addition
+	var gone []string
+	for name := range w.files {
+		if file, ok := current[name]; !ok || file != w.files[name] {
+			gone = append(gone, name)
+		}
+	}
+	change.Removed = w.remove(gone)
+	w.files = current
+
+	items := make([]mempoolItem, len(added))
+	for i, name := range added {
+		data, err := os.ReadFile(filepath.Join(w.dir, name))
+		items[i] = mempoolItem{name: name, data: data, named: true, err: err}
+	}
+	records := make([]MempoolRecord, len(items))
+	forEachParallel(len(items), w.workers, func(i int) {
+		records[i] = decodeMempoolItem(items[i])
+	})
+	for i, record := range records {
+		if record.Err != nil {
+			fmt.Println("Rejecting tx file: ", record.Err)
+			change.Rejected++
+			continue
+		}
+		entry := NewTxEntry(record.Tx)
+		w.entries[added[i]] = entry
+		change.Added = append(change.Added, entry)
+	}
+	change.Added = append(change.Added, w.addSubmitted(&change)...)
+	ValidateEntries(change.Added, w.profile, w.workers)
+	w.admit(&change)
+	return change, nil
+}
+
+// admit goes over the transactions a poll added, parents first, and lets each one that spends the same outputs as
+// transactions in the mempool replace them or not, as RBFPolicy decides, then checks it against MempoolLimits.
+// replaced transactions are dropped with their descendants, and so are the ones turned down. only valid transactions
+// count: an invalid one replaces nothing, and doesn't stand in the way of a replacement or count towards the limits
+func (w *MempoolWatcher) admit(change *MempoolChange) {
+	if len(change.Added) == 0 {
+		return
+	}
+	// files come in name order, children have to be admitted after their parents
+	transactions := make([]types.TransactionData, len(change.Added))
+	for i, entry := range change.Added {
+		transactions[i] = entry.Tx
+	}
+	ordered := make([]*TxEntry, 0, len(change.Added))
+	for _, i := range ParentsFirst(transactions) {
+		ordered = append(ordered, change.Added[i])
+	}
+	change.Added = ordered
+	added := make(map[*TxEntry]bool, len(change.Added))
+	for _, entry := range change.Added {
+		added[entry] = true
+	}
+	names := make(map[string]string, len(w.entries)) // file names by txid
+	index := NewConflictIndex()
+	for name, entry := range w.entries {
+		names[entry.Tx.TxID] = name
+		if entry.Valid() && !added[entry] {
+			index.Add(entry.Tx)
+		}
+	}
+	drop := func(txIds []string) {
+		dropNames := make([]string, len(txIds))
+		for i, txId := range txIds {
+			dropNames[i] = names[txId]
+		}
+		for _, txId := range w.remove(dropNames) {
+			index.Remove(txId)
+			change.Removed = append(change.Removed, txId)
+		}
+	}
+	for _, entry := range change.Added {
+		if !entry.Valid() || w.entries[names[entry.Tx.TxID]] != entry {
+			continue
+		}
+		replaced, err := RBFPolicy.Check(index, entry.Tx)
+		if err == nil {
+			err = MempoolLimits.Check(index, entry.Tx, replaced)
+		}
+		if err != nil {
+			fmt.Println("Rejecting tx: ", entry.Tx.TxID, err)
+			change.Rejected++
+			drop([]string{entry.Tx.TxID})
+			continue
+		}
+		for _, txId := range replaced {
+			replacement := types.Replacement{TxID: txId, ReplacedBy: entry.Tx.TxID, Fee: w.entries[names[txId]].Fee}
+			change.Replaced = append(change.Replaced, replacement)
+		}
+		drop(replaced)
+		index.Add(entry.Tx)
+	}
+	w.replaced = append(w.replaced, change.Replaced...)
+	// what got dropped isn't added after all
+	var kept []*TxEntry
+	for _, entry := range change.Added {
+		if w.entries[names[entry.Tx.TxID]] == entry {
+			kept = append(kept, entry)
+		}
+	}
+	change.Added = kept
+}
+
+// Replaced lists every transaction replaced by a conflicting one since the watcher started
+func (w *MempoolWatcher) Replaced() []types.Replacement {
+	return w.replaced
+}
+
+// Submit queues a transaction to be validated and added to the mempool on the next Poll. its prevouts are resolved
+// from the mempool and Prevouts, so it has to spend outputs the mempool's transactions create or spend, or that are
+// in Prevouts. one that doesn't yet waits as an orphan for its parents to be submitted, see addSubmitted
+func (w *MempoolWatcher) Submit(tx *wire.MsgTx) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.submitted = append(w.submitted, tx)
+}
+
+// addSubmitted turns the transactions submitted since the last Poll, and the orphans left over from earlier ones,
+// into entries, like LoadRawTxs does for raw hex files. ones already in the mempool are skipped. ones whose prevouts
+// can't be found yet are kept as orphans for the next Poll, since a peer can relay a child before its parent and won't
+// send either again, and like LoadBoundedMempool at most MaxOrphanTxs are kept, the oldest dropped first
+func (w *MempoolWatcher) addSubmitted(change *MempoolChange) []*TxEntry {
+	w.mu.Lock()
+	submitted := append(w.orphans, w.submitted...)
+	w.submitted = nil
+	w.mu.Unlock()
+	w.orphans = nil
+	if len(submitted) == 0 {
+		return nil
+	}
+	known := make(map[string]bool, len(w.entries))
+	transactions := make([]types.TransactionData, 0, len(w.entries))
+	for _, entry := range w.entries {
+		known[entry.Tx.TxID] = true
+		transactions = append(transactions, entry.Tx)
+	}
+	utxos := NewUTXOSetFromMempool(transactions)
+	for outpoint, prevout := range w.Prevouts {
+		utxos[outpoint] = prevout
+	}
+	// a child can arrive before its parent, so keep going over what's left while that adds something
+	var added []*TxEntry
+	var unresolved []error
+	for progress := true; progress && len(submitted) > 0; {
+		progress = false
+		unresolved = nil
+		var remaining []*wire.MsgTx
+		for _, tx := range submitted {
+			transaction := MsgTxToTransactionData(tx)
+			if known[transaction.TxID] {
+				continue
+			}
+			if err := utxos.ResolvePrevouts(&transaction); err != nil {
+				remaining = append(remaining, tx)
+				unresolved = append(unresolved, fmt.Errorf("%s: %v", transaction.TxID, err))
+				continue
+			}
+			utxos.AddTxOutputs(transaction)
+			known[transaction.TxID] = true
+			entry := NewTxEntry(transaction)
+			w.entries[submittedPrefix+transaction.TxID] = entry
+			added = append(added, entry)
+			progress = true
+		}
+		submitted = remaining
+	}
+	if excess := len(submitted) - MaxOrphanTxs; excess > 0 {
+		for _, err := range unresolved[:excess] {
+			fmt.Println("Rejecting submitted tx: ", fmt.Errorf("%w: %v", ErrOrphanPoolFull, err))
+			change.Rejected++
+		}
+		submitted = submitted[excess:]
+	}
+	w.orphans = submitted
+	change.Orphans = len(w.orphans)
+	return added
+}
+
+// remove drops the transactions read from the named files, and then every transaction spending an output of a
+// dropped one until there are none left. it returns the txids dropped
+func (w *MempoolWatcher) remove(names []string) []string {
+	removed := map[string]bool{}
+	var removedTxIds []string
+	for _, name := range names {
+		if entry, ok := w.entries[name]; ok {
+			delete(w.entries, name)
+			removed[entry.Tx.TxID] = true
+			removedTxIds = append(removedTxIds, entry.Tx.TxID)
+		}
+	}
+	for found := len(removedTxIds) > 0; found; {
+		found = false
+		for name, entry := range w.entries {
+			for _, input := range entry.Tx.Vin {
+				if removed[input.TxID] {
+					delete(w.entries, name)
+					removed[entry.Tx.TxID] = true
+					removedTxIds = append(removedTxIds, entry.Tx.TxID)
+					found = true
+					break
+				}
+			}
+		}
+	}
+	return removedTxIds
+}
+
+// Len is the number of transactions currently in the mempool
+func (w *MempoolWatcher) Len() int {
+	return len(w.entries)
+}
+
+// Entries returns the transactions currently in the mempool, in file name order, the submitted ones last
+func (w *MempoolWatcher) Entries() []*TxEntry {
+	names := make([]string, 0, len(w.entries))
+	for name := range w.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]*TxEntry, len(names))
+	for i, name := range names {
+		entries[i] = w.entries[name]
+	}
+	return entries
+}
+
+// MiningDaemon keeps a block template current with a MempoolWatcher and mines it. a new template only replaces the
+// one being mined when it earns at least MinFeeGain more in fees, or when the block being mined spends a transaction
+// that's gone from the mempool, since restarting throws away the work done on the old one
+type MiningDaemon struct {
+	Watcher    *MempoolWatcher
+	Interval   time.Duration
+	MinFeeGain int // sats
+	// NewBuilder returns a builder set up with the strategy, weight budget and profile to mine with, without
+	// candidates; the daemon adds the mempool's entries to it
+	NewBuilder func() (*BlockBuilder, error)
+	// OnBlock is called with every block mined
+	OnBlock func(*BuiltBlock)
+}
+
+// miningJob is the block the daemon is working on
+type miningJob struct {
+	built *BuiltBlock
+	fees  int
+	txIds map[string]bool
+	stop  chan struct{}
+	done  chan bool
+}
+
+// Run polls and mines until stop is closed. finding a block doesn't take its transactions out of the directory,
+// that's up to whatever feeds it, and nothing more is mined until the directory changes again
+func (d *MiningDaemon) Run(stop <-chan struct{}) error {
+	var job *miningJob
+	mined := false // whether the current job's block was found, so the same block isn't mined twice
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		change, err := d.Watcher.Poll()
+		if err != nil {
+			fmt.Println("Error reading mempool: ", err)
+		} else if !change.Empty() || job == nil {
+			fmt.Println("mempool:", d.Watcher.Len(), "txs,", len(change.Added), "added,", len(change.Removed), "removed,",
+				len(change.Replaced), "replaced,", change.Rejected, "rejected,", change.Orphans, "orphans waiting")
+			job, mined, err = d.update(job, mined, change)
+			if err != nil {
+				return err
+			}
+		}
+		select {
+		case <-stop:
+			if job != nil && !mined {
+				close(job.stop)
+			}
+			return nil
+		case <-ticker.C:
+		case mined = <-d.doneChan(job, mined):
+			if mined && d.OnBlock != nil {
+				d.OnBlock(job.built)
+			}
+		}
+	}
+}
+
+// doneChan is the channel the current job reports on, or nil (which blocks forever) when there's nothing mining
+func (d *MiningDaemon) doneChan(job *miningJob, mined bool) <-chan bool {
+	if job == nil || mined {
+		return nil
+	}
+	return job.done
+}
+
+// update rebuilds the template after a change and decides whether it's worth switching to
+func (d *MiningDaemon) update(job *miningJob, mined bool, change MempoolChange) (*miningJob, bool, error) {
+	builder, err := d.NewBuilder()
+	if err != nil {
+		return job, mined, err
+	}
+	builder.AddEntries(d.Watcher.Entries())
+	builder.AddReplaced(d.Watcher.Replaced())
+	built, err := builder.Build()
+	if err != nil {
+		return job, mined, err
+	}
+	fees := built.Selected.Fees()
+	if job != nil && !mined {
+		stale := false
+		for _, txId := range change.Removed {
+			if job.txIds[txId] {
+				stale = true
+				break
+			}
+		}
+		if gain := fees - job.fees; !stale && gain < d.MinFeeGain {
+			fmt.Println("template:", len(built.Selected.Txs), "txs,", fees, "sats in fees, gain of", gain, "is under", d.MinFeeGain, "so mining continues")
+			return job, mined, nil
+		}
+		close(job.stop)
+		<-job.done
+	}
+	fmt.Println("template:", len(built.Selected.Txs), "txs,", fees, "sats in fees, mining it")
+	next := &miningJob{built: built, fees: fees, txIds: map[string]bool{}, stop: make(chan struct{}), done: make(chan bool, 1)}
+	for _, transaction := range built.Selected.TxData {
+		next.txIds[transaction.TxID] = true
+	}
+	go func() {
+		found := SolveBlockUntil(built.Block, next.stop)
+		if found {
+			built.Mined = true
+			built.Summary.Hash = built.Block.BlockHash().String()
+		}
+		next.done <- found
+	}()
+	return next, false, nil
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// parentAndChild finds two mempool transactions where the second spends an output of the first
+func parentAndChild(t *testing.T) (types.TransactionData, types.TransactionData) {
+	files, err := os.ReadDir(mempoolTestDir)
+	if err != nil {
+		t.Skip("no mempool directory:", err)
+	}
+	byTxId := map[string]types.TransactionData{}
+	var transactions []types.TransactionData
+	for _, file := range files {
+		transaction, err := LoadTxFile(filepath.Join(mempoolTestDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		byTxId[transaction.TxID] = transaction
+		transactions = append(transactions, transaction)
+	}
+	for _, child := range transactions {
+		for _, input := range child.Vin {
+			if parent, ok := byTxId[input.TxID]; ok {
+				return parent, child
+			}
+		}
+	}
+	t.Skip("no parent and child in the mempool")
+	return types.TransactionData{}, types.TransactionData{}
+}
+
+// TestWatcherHoldsSubmittedOrphans submits a child a poll before its parent, as a peer may relay them, and checks
+// the child waits for the parent rather than being turned down for good
+func TestWatcherHoldsSubmittedOrphans(t *testing.T) {
+	parent, child := parentAndChild(t)
+	parentTx, err := TransactionDataToMsgTx(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childTx, err := TransactionDataToMsgTx(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := NewMempoolWatcher(t.TempDir(), ConsensusProfile, 2)
+	watcher.Prevouts = NewConfirmedUTXOSet([]types.TransactionData{parent, child})
+
+	watcher.Submit(childTx)
+	change, err := watcher.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Rejected != 0 || change.Orphans != 1 || watcher.Len() != 0 {
+		t.Fatalf("child alone: %d rejected, %d orphans, %d in the mempool", change.Rejected, change.Orphans, watcher.Len())
+	}
+	// a poll with nothing new keeps the orphan waiting
+	if change, err = watcher.Poll(); err != nil || change.Orphans != 1 {
+		t.Fatalf("empty poll: %d orphans, %v", change.Orphans, err)
+	}
+
+	watcher.Submit(parentTx)
+	if change, err = watcher.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if change.Orphans != 0 || watcher.Len() != 2 {
+		t.Errorf("with the parent: %d orphans, %d in the mempool", change.Orphans, watcher.Len())
+	}
+
+	// past MaxOrphanTxs the oldest orphan is dropped
+	orphans := MaxOrphanTxs
+	MaxOrphanTxs = 0
+	t.Cleanup(func() { MaxOrphanTxs = orphans })
+	lonely := NewMempoolWatcher(t.TempDir(), ConsensusProfile, 2)
+	lonely.Submit(childTx)
+	if change, err = lonely.Poll(); err != nil || change.Rejected != 1 || change.Orphans != 0 {
+		t.Errorf("no room for orphans: %d rejected, %d orphans, %v", change.Rejected, change.Orphans, err)
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// witnessCommitmentHeader is how a BIP141 witness commitment output's script starts: OP_RETURN, a 36 byte push and
+// the aa21a9ed tag. the 32 byte commitment follows, and anything after it is ignored
+var witnessCommitmentHeader = []byte{txscript.OP_RETURN, txscript.OP_DATA_36, 0xaa, 0x21, 0xa9, 0xed}
+
+// witnessCommitmentSize is the shortest script that can hold a witness commitment
+const witnessCommitmentSize = 38
+
+// the ways a block can get its witnesses wrong, told apart like bitcoind's reject reasons for them
+var (
+	ErrBadWitnessNonceSize   = errors.New("coinbase witness must be a single 32 byte witness reserved value")
+	ErrBadWitnessMerkleMatch = errors.New("witness commitment doesn't match the block's witnesses")
+	ErrUnexpectedWitness     = errors.New("block without a witness commitment has witness data")
+)
+
+// WitnessCommitmentIndex returns the index of the coinbase output holding the block's witness commitment, or -1 if
+// there isn't one. if several outputs look like a commitment the last one counts
+func WitnessCommitmentIndex(coinbaseTx *wire.MsgTx) int {
+	for i := len(coinbaseTx.TxOut) - 1; i >= 0; i-- {
+		pkScript := coinbaseTx.TxOut[i].PkScript
+		if len(pkScript) >= witnessCommitmentSize && bytes.HasPrefix(pkScript, witnessCommitmentHeader) {
+			return i
+		}
+	}
+	return -1
+}
+
+// WitnessCommitmentHash is what the coinbase commits to: the double sha256 of the wtxid merkle root followed by the
+// witness reserved value
+func WitnessCommitmentHash(witnessRoot chainhash.Hash, witnessReservedValue []byte) chainhash.Hash {
+	return chainhash.DoubleHashH(append(witnessRoot[:], witnessReservedValue...))
+}
+
+// CheckWitnessCommitment checks a block's witnesses the way BIP141 has a node do it. a block with a commitment must
+// have a single 32 byte witness reserved value as its coinbase's witness, and the commitment must be the hash of the
+// wtxid merkle root with that value. a block without one can't carry any witness data at all
+func CheckWitnessCommitment(block *wire.MsgBlock) error {
+	coinbaseTx := block.Transactions[0]
+	commitmentIndex := WitnessCommitmentIndex(coinbaseTx)
+	if commitmentIndex < 0 {
+		for i, tx := range block.Transactions {
+			if tx.HasWitness() {
+				return fmt.Errorf("%w: tx %d (%s)", ErrUnexpectedWitness, i, tx.TxHash())
+			}
+		}
+		return nil
+	}
+	witness := coinbaseTx.TxIn[0].Witness
+	if len(witness) != 1 || len(witness[0]) != chainhash.HashSize {
+		return ErrBadWitnessNonceSize
+	}
+	witnessRoot, _ := WitnessMerkleRoot(block.Transactions)
+	commitment := WitnessCommitmentHash(witnessRoot, witness[0])
+	committed := coinbaseTx.TxOut[commitmentIndex].PkScript[len(witnessCommitmentHeader):witnessCommitmentSize]
+	if !bytes.Equal(commitment[:], committed) {
+		return fmt.Errorf("%w: output %d commits to %x, computed %x", ErrBadWitnessMerkleMatch, commitmentIndex, committed, commitment[:])
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package script
+
+import "encoding/hex"
+
+// Class is the template a scriptpubkey follows. the values match the scriptpubkey_type strings in the mempool json
+// where esplora has an equivalent
+type Class string
+
+const (
+	P2PK           Class = "p2pk"
+	P2PKH          Class = "p2pkh"
+	P2SH           Class = "p2sh"
+	P2WPKH         Class = "v0_p2wpkh"
+	P2WSH          Class = "v0_p2wsh"
+	P2TR           Class = "v1_p2tr"
+	Multisig       Class = "multisig"
+	OpReturn       Class = "op_return"
+	Anchor         Class = "anchor"
+	WitnessUnknown Class = "witness_unknown"
+	Unknown        Class = "unknown"
+)
+
+// Classify works out which template a scriptpubkey follows purely from its bytes
+func Classify(script []byte) Class {
+	switch {
+	case len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == OP_PUSHBYTES_20 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG:
+		return P2PKH
+	case len(script) == 23 && script[0] == OP_HASH160 && script[1] == OP_PUSHBYTES_20 && script[22] == OP_EQUAL:
+		return P2SH
+	case len(script) > 0 && script[0] == OP_RETURN:
+		return OpReturn
+	case isP2PK(script):
+		return P2PK
+	}
+	if version, program, ok := WitnessProgram(script); ok {
+		switch {
+		case version == 0 && len(program) == 20:
+			return P2WPKH
+		case version == 0 && len(program) == 32:
+			return P2WSH
+		case version == 0:
+			// v0 programs of any other length can never be spent
+			return Unknown
+		case version == 1 && len(program) == 32:
+			return P2TR
+		case version == 1 && len(program) == 2 && program[0] == 0x4e && program[1] == 0x73:
+			return Anchor
+		default:
+			return WitnessUnknown
+		}
+	}
+	if isBareMultisig(script) {
+		return Multisig
+	}
+	return Unknown
+}
+
+// ClassifyHex is Classify for a hex encoded scriptpubkey. anything that isn't valid hex is Unknown
+func ClassifyHex(scriptHex string) Class {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return Unknown
+	}
+	return Classify(script)
+}
+
+// WitnessProgram splits a segwit scriptpubkey (a version opcode followed by a single 2 to 40 byte push) into its
+// witness version and program
+func WitnessProgram(script []byte) (int, []byte, bool) {
+	if len(script) < 4 || len(script) > 42 {
+		return 0, nil, false
+	}
+	version := SmallInt(script[0])
+	if version < 0 || int(script[1])+2 != len(script) {
+		return 0, nil, false
+	}
+	return version, script[2:], true
+}
+
+// EsploraType is the scriptpubkey_type string esplora uses for the class. bare multisig is "multisig" there too, but
+// esplora has no name for anchors or future witness versions and reports them as "unknown"
+func (class Class) EsploraType() string {
+	switch class {
+	case Anchor, WitnessUnknown:
+		return string(Unknown)
+	}
+	return string(class)
+}
+
+// CoreType is the scriptPubKey type name bitcoin core uses for the class in its rpc output
+func (class Class) CoreType() string {
+	switch class {
+	case P2PK:
+		return "pubkey"
+	case P2PKH:
+		return "pubkeyhash"
+	case P2SH:
+		return "scripthash"
+	case P2WPKH:
+		return "witness_v0_keyhash"
+	case P2WSH:
+		return "witness_v0_scripthash"
+	case P2TR:
+		return "witness_v1_taproot"
+	case Multisig:
+		return "multisig"
+	case OpReturn:
+		return "nulldata"
+	case Anchor:
+		return "anchor"
+	case WitnessUnknown:
+		return "witness_unknown"
+	}
+	return "nonstandard"
+}
+
+// MatchesDeclaredType reports whether a scriptpubkey_type string from the json agrees with the computed class. older
+// esplora versions reported bare multisig as "unknown", which is what the mempool files have, so that's accepted too
+func MatchesDeclaredType(declared string, class Class) bool {
+	if class == Multisig && declared == string(Unknown) {
+		return true
+	}
+	return declared == string(class) || declared == class.EsploraType()
+}
+
+func isP2PK(script []byte) bool {
+	switch {
+	case len(script) == 35 && script[0] == OP_PUSHBYTES_33 && (script[1] == 0x02 || script[1] == 0x03):
+		return script[34] == OP_CHECKSIG
+	case len(script) == 67 && script[0] == OP_PUSHBYTES_65 && script[1] == 0x04:
+		return script[66] == OP_CHECKSIG
+	}
+	return false
+}
+
+func isBareMultisig(script []byte) bool {
+	requiredSigs, pubKeys, err := ParseMultisig(script)
+	if err != nil || requiredSigs < 1 {
+		return false
+	}
+	for _, pubKey := range pubKeys {
+		if len(pubKey) != 33 && len(pubKey) != 65 {
+			return false
+		}
+	}
+	return true
+}
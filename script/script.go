@@ -0,0 +1,220 @@
+package script
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Instruction is a single decoded script element: an opcode, plus the data it pushes if it's a push opcode
+type Instruction struct {
+	Opcode byte
+	Data   []byte
+}
+
+// IsPush reports whether the instruction only pushes data (or a small number) onto the stack
+func (ins Instruction) IsPush() bool {
+	return ins.Opcode <= OP_PUSHNUM_16 && ins.Opcode != 0x50
+}
+
+// Parse decodes raw script bytes into opcodes and their push data. it fails if a push runs past the end of the script
+func Parse(script []byte) ([]Instruction, error) {
+	var instructions []Instruction
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+		var dataLen int
+		switch {
+		case opcode > 0 && opcode < OP_PUSHDATA1:
+			dataLen = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return instructions, errors.New("push past end of script")
+			}
+			dataLen = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return instructions, errors.New("push past end of script")
+			}
+			dataLen = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		case opcode == OP_PUSHDATA4:
+			if i+4 > len(script) {
+				return instructions, errors.New("push past end of script")
+			}
+			dataLen = int(binary.LittleEndian.Uint32(script[i:]))
+			i += 4
+		default:
+			instructions = append(instructions, Instruction{Opcode: opcode})
+			continue
+		}
+		if dataLen < 0 || i+dataLen > len(script) {
+			return instructions, errors.New("push past end of script")
+		}
+		instructions = append(instructions, Instruction{Opcode: opcode, Data: script[i : i+dataLen]})
+		i += dataLen
+	}
+	return instructions, nil
+}
+
+// ParseHex is Parse for a hex encoded script
+func ParseHex(scriptHex string) ([]Instruction, error) {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(script)
+}
+
+// Pushes splits a push only script (such as a scriptsig) into the items it leaves on the stack
+func Pushes(script []byte) ([][]byte, error) {
+	instructions, err := Parse(script)
+	if err != nil {
+		return nil, err
+	}
+	pushes := make([][]byte, 0, len(instructions))
+	for _, ins := range instructions {
+		switch {
+		case !ins.IsPush():
+			return nil, fmt.Errorf("%s is not a push opcode", OpcodeName(ins.Opcode))
+		case ins.Opcode == OP_PUSHNUM_NEG1:
+			pushes = append(pushes, []byte{0x81})
+		case ins.Opcode >= OP_PUSHNUM_1:
+			pushes = append(pushes, []byte{byte(SmallInt(ins.Opcode))})
+		default:
+			pushes = append(pushes, ins.Data)
+		}
+	}
+	return pushes, nil
+}
+
+// LastPush returns the last item a push only script leaves on the stack, e.g the redeem script of a p2sh scriptsig
+func LastPush(script []byte) ([]byte, error) {
+	pushes, err := Pushes(script)
+	if err != nil {
+		return nil, err
+	}
+	if len(pushes) == 0 {
+		return nil, errors.New("script pushes nothing")
+	}
+	return pushes[len(pushes)-1], nil
+}
+
+// ParseMultisig reads "OP_m <pubkey 1> ... <pubkey n> OP_n OP_CHECKMULTISIG" out of the script bytes and returns
+// the number of required signatures and the pubkeys in script order
+func ParseMultisig(script []byte) (int, [][]byte, error) {
+	if len(script) < 3 || script[len(script)-1] != OP_CHECKMULTISIG {
+		return 0, nil, errors.New("not a multisig script")
+	}
+	requiredSigs := SmallInt(script[0])
+	numOfPubKeys := SmallInt(script[len(script)-2])
+	if requiredSigs < 0 || numOfPubKeys < 0 {
+		return 0, nil, errors.New("multisig script m and n must be small integers")
+	}
+	instructions, err := Parse(script[1 : len(script)-2])
+	if err != nil {
+		return 0, nil, err
+	}
+	var pubKeys [][]byte
+	for _, ins := range instructions {
+		if ins.Opcode == OP_0 || ins.Opcode > OP_PUSHDATA4 {
+			return 0, nil, errors.New("multisig script pubkeys must be data pushes")
+		}
+		pubKeys = append(pubKeys, ins.Data)
+	}
+	if len(pubKeys) != numOfPubKeys || requiredSigs > numOfPubKeys {
+		return 0, nil, fmt.Errorf("multisig script is %d-of-%d but has %d pubkeys", requiredSigs, numOfPubKeys, len(pubKeys))
+	}
+	return requiredSigs, pubKeys, nil
+}
+
+// Disasm renders script bytes as asm text in the same format the mempool json uses, e.g
+// "OP_DUP OP_HASH160 OP_PUSHBYTES_20 <hash> OP_EQUALVERIFY OP_CHECKSIG"
+func Disasm(script []byte) string {
+	instructions, err := Parse(script)
+	parts := make([]string, 0, len(instructions)*2+1)
+	for _, ins := range instructions {
+		parts = append(parts, OpcodeName(ins.Opcode))
+		if ins.Opcode != OP_0 && ins.Opcode <= OP_PUSHDATA4 {
+			parts = append(parts, hex.EncodeToString(ins.Data))
+		}
+	}
+	if err != nil {
+		parts = append(parts, "<push past end>")
+	}
+	return strings.Join(parts, " ")
+}
+
+// DisasmHex is Disasm for a hex encoded script
+func DisasmHex(scriptHex string) (string, error) {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return "", err
+	}
+	return Disasm(script), nil
+}
+
+// Assemble turns asm text back into script bytes. it is the inverse of Disasm, so every push opcode has to be
+// followed by its data, and the data length has to agree with the opcode
+func Assemble(asm string) ([]byte, error) {
+	var script bytes.Buffer
+	tokens := strings.Fields(asm)
+	for i := 0; i < len(tokens); i++ {
+		opcode, ok := opcodesByName[tokens[i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode %q", tokens[i])
+		}
+		script.WriteByte(opcode)
+		if opcode == OP_0 || opcode > OP_PUSHDATA4 {
+			continue
+		}
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("%s is missing its data", tokens[i])
+		}
+		i++
+		data, err := hex.DecodeString(tokens[i])
+		if err != nil {
+			return nil, fmt.Errorf("bad push data %q: %v", tokens[i], err)
+		}
+		switch opcode {
+		case OP_PUSHDATA1:
+			if len(data) > 0xff {
+				return nil, errors.New("OP_PUSHDATA1 data is too long")
+			}
+			script.WriteByte(byte(len(data)))
+		case OP_PUSHDATA2:
+			if len(data) > 0xffff {
+				return nil, errors.New("OP_PUSHDATA2 data is too long")
+			}
+			binary.Write(&script, binary.LittleEndian, uint16(len(data)))
+		case OP_PUSHDATA4:
+			binary.Write(&script, binary.LittleEndian, uint32(len(data)))
+		default:
+			if int(opcode) != len(data) {
+				return nil, fmt.Errorf("%s followed by %d bytes", tokens[i-1], len(data))
+			}
+		}
+		script.Write(data)
+	}
+	return script.Bytes(), nil
+}
+
+// VerifyAsm checks that an asm string supplied alongside a script actually describes that script. an empty asm string
+// is treated as "not supplied" and always passes
+func VerifyAsm(scriptHex string, asm string) error {
+	if asm == "" {
+		return nil
+	}
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return err
+	}
+	if canonical := Disasm(script); canonical != strings.Join(strings.Fields(asm), " ") {
+		return fmt.Errorf("asm %q does not match script, expected %q", asm, canonical)
+	}
+	return nil
+}
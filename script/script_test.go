@@ -0,0 +1,338 @@
+package script
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SummerOfBitcoin/code-challenge-2024-alainjr10/types"
+)
+
+// mempoolTestDir is the challenge mempool, relative to this package
+const mempoolTestDir = "../mempool"
+
+// mempoolScripts collects every script in the mempool fixtures that comes with an asm field, keyed by its hex
+func mempoolScripts(t *testing.T) map[string]string {
+	files, err := os.ReadDir(mempoolTestDir)
+	if err != nil {
+		t.Skip("no mempool directory:", err)
+	}
+	scripts := map[string]string{}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(mempoolTestDir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var transaction types.TransactionData
+		if err := json.Unmarshal(contents, &transaction); err != nil {
+			t.Fatalf("%s: %v", file.Name(), err)
+		}
+		for _, input := range transaction.Vin {
+			scripts[input.ScriptSig] = input.ScriptSigAsm
+			scripts[input.Prevout.ScriptPubKey] = input.Prevout.ScriptPubKeyAsm
+		}
+		for _, output := range transaction.Vout {
+			scripts[output.ScriptPubKey] = output.ScriptPubKeyAsm
+		}
+	}
+	return scripts
+}
+
+// TestParseRoundTrip disassembles every mempool script, checks the asm against the json's and assembles it back to
+// the same bytes
+func TestParseRoundTrip(t *testing.T) {
+	for scriptHex, asm := range mempoolScripts(t) {
+		script, err := hex.DecodeString(scriptHex)
+		if err != nil {
+			t.Fatalf("%s: %v", scriptHex, err)
+		}
+		if _, err := Parse(script); err != nil {
+			t.Errorf("%s: %v", scriptHex, err)
+			continue
+		}
+		if err := VerifyAsm(scriptHex, asm); err != nil {
+			t.Errorf("%s: %v", scriptHex, err)
+		}
+		assembled, err := Assemble(Disasm(script))
+		if err != nil {
+			t.Errorf("%s: assembling %q: %v", scriptHex, Disasm(script), err)
+			continue
+		}
+		if !bytes.Equal(assembled, script) {
+			t.Errorf("%s assembles back to %x", scriptHex, assembled)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		ops    []byte
+		data   []string
+		err    bool
+	}{
+		{name: "empty", script: ""},
+		{name: "op_0", script: "00", ops: []byte{OP_0}, data: []string{""}},
+		{name: "pushbytes", script: "02abcd51", ops: []byte{0x02, OP_PUSHNUM_1}, data: []string{"abcd", ""}},
+		{name: "pushdata1", script: "4c02abcd", ops: []byte{OP_PUSHDATA1}, data: []string{"abcd"}},
+		{name: "pushdata1 empty", script: "4c00", ops: []byte{OP_PUSHDATA1}, data: []string{""}},
+		{name: "pushdata2", script: "4d0200abcd", ops: []byte{OP_PUSHDATA2}, data: []string{"abcd"}},
+		{name: "pushdata4", script: "4e02000000abcd", ops: []byte{OP_PUSHDATA4}, data: []string{"abcd"}},
+		{name: "pushbytes past end", script: "02ab", err: true},
+		{name: "pushbytes missing data", script: "01", err: true},
+		{name: "pushdata1 missing length", script: "4c", err: true},
+		{name: "pushdata1 past end", script: "4c02ab", err: true},
+		{name: "pushdata2 missing length", script: "4d01", err: true},
+		{name: "pushdata2 past end", script: "4d0300abcd", err: true},
+		{name: "pushdata4 missing length", script: "4e010000", err: true},
+		{name: "pushdata4 huge", script: "4effffffffab", err: true},
+		{name: "push after opcodes past end", script: "76a914ab", ops: []byte{OP_DUP, OP_HASH160}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instructions, err := ParseHex(test.script)
+			if (err != nil) != test.err {
+				t.Fatalf("error %v, want error %v", err, test.err)
+			}
+			if len(instructions) != len(test.ops) {
+				t.Fatalf("%d instructions, want %d", len(instructions), len(test.ops))
+			}
+			for i, ins := range instructions {
+				if ins.Opcode != test.ops[i] {
+					t.Errorf("instruction %d is %s, want %s", i, OpcodeName(ins.Opcode), OpcodeName(test.ops[i]))
+				}
+				if test.data != nil && hex.EncodeToString(ins.Data) != test.data[i] {
+					t.Errorf("instruction %d pushes %x, want %s", i, ins.Data, test.data[i])
+				}
+			}
+			if test.err {
+				if asm, _ := DisasmHex(test.script); !strings.HasSuffix(asm, "<push past end>") {
+					t.Errorf("truncated script disassembles to %q", asm)
+				}
+			}
+		})
+	}
+}
+
+func TestPushes(t *testing.T) {
+	pushes, err := Pushes(mustHex(t, "0002abcd4f5160"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"", "abcd", "81", "01", "10"}
+	if len(pushes) != len(want) {
+		t.Fatalf("%d pushes, want %d", len(pushes), len(want))
+	}
+	for i, push := range pushes {
+		if hex.EncodeToString(push) != want[i] {
+			t.Errorf("push %d is %x, want %s", i, push, want[i])
+		}
+	}
+	if _, err := Pushes(mustHex(t, "0076")); err == nil {
+		t.Error("script with OP_DUP counted as push only")
+	}
+	if _, err := Pushes(mustHex(t, "0002ab")); err == nil {
+		t.Error("truncated push counted as push only")
+	}
+	if _, err := LastPush(nil); err == nil {
+		t.Error("empty script has a last push")
+	}
+	if last, err := LastPush(mustHex(t, "0002abcd")); err != nil || hex.EncodeToString(last) != "abcd" {
+		t.Errorf("last push %x, %v", last, err)
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		asm    string
+		script string
+		err    bool
+	}{
+		{asm: "OP_DUP OP_HASH160 OP_PUSHBYTES_2 abcd OP_EQUALVERIFY OP_CHECKSIG", script: "76a902abcd88ac"},
+		{asm: "OP_0 OP_PUSHNUM_1 OP_PUSHNUM_16 OP_PUSHNUM_NEG1", script: "0051604f"},
+		{asm: "OP_FALSE OP_TRUE OP_CHECKLOCKTIMEVERIFY OP_CHECKSEQUENCEVERIFY", script: "0051b1b2"},
+		{asm: "OP_PUSHDATA1 abcd", script: "4c02abcd"},
+		{asm: "OP_PUSHDATA2 abcd", script: "4d0200abcd"},
+		{asm: "OP_PUSHDATA4 abcd", script: "4e02000000abcd"},
+		{asm: "  OP_RETURN   OP_PUSHBYTES_1 ff ", script: "6a01ff"},
+		{asm: "OP_NOTANOPCODE", err: true},
+		{asm: "OP_PUSHBYTES_2", err: true},
+		{asm: "OP_PUSHBYTES_2 abcdef", err: true},
+		{asm: "OP_PUSHBYTES_1 zz", err: true},
+		{asm: "OP_PUSHDATA1 " + strings.Repeat("ab", 256), err: true},
+	}
+	for _, test := range tests {
+		script, err := Assemble(test.asm)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want error %v", test.asm, err, test.err)
+			continue
+		}
+		if !test.err && hex.EncodeToString(script) != test.script {
+			t.Errorf("%q assembles to %x, want %s", test.asm, script, test.script)
+		}
+	}
+}
+
+func TestVerifyAsm(t *testing.T) {
+	if err := VerifyAsm("76a902abcd88ac", "OP_DUP OP_HASH160 OP_PUSHBYTES_2 abcd OP_EQUALVERIFY OP_CHECKSIG"); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyAsm("76a902abcd88ac", ""); err != nil {
+		t.Errorf("missing asm: %v", err)
+	}
+	if err := VerifyAsm("76a902abcd88ac", "OP_DUP OP_HASH160 OP_PUSHBYTES_2 abce OP_EQUALVERIFY OP_CHECKSIG"); err == nil {
+		t.Error("asm with other push data matches")
+	}
+	if err := VerifyAsm("6a", "OP_RETURN OP_RETURN"); err == nil {
+		t.Error("asm with an extra opcode matches")
+	}
+}
+
+func TestParseMultisig(t *testing.T) {
+	key := "02" + strings.Repeat("11", 32)
+	tests := []struct {
+		name     string
+		script   string
+		required int
+		keys     int
+		err      bool
+	}{
+		{name: "1-of-1", script: "5121" + key + "51ae", required: 1, keys: 1},
+		{name: "2-of-3", script: "5221" + key + "21" + key + "21" + key + "53ae", required: 2, keys: 3},
+		{name: "m greater than n", script: "5221" + key + "51ae", err: true},
+		{name: "n doesn't match the keys", script: "5121" + key + "52ae", err: true},
+		{name: "not checkmultisig", script: "5121" + key + "51ac", err: true},
+		{name: "m not a small int", script: "0121" + key + "51ae", err: true},
+		{name: "opcode among the keys", script: "517651ae", err: true},
+		{name: "truncated key", script: "5121" + key[:10] + "51ae", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			required, pubKeys, err := ParseMultisig(mustHex(t, test.script))
+			if (err != nil) != test.err {
+				t.Fatalf("error %v, want error %v", err, test.err)
+			}
+			if required != test.required || len(pubKeys) != test.keys {
+				t.Errorf("%d-of-%d, want %d-of-%d", required, len(pubKeys), test.required, test.keys)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	hash20 := bytes.Repeat([]byte{0x11}, 20)
+	hash32 := bytes.Repeat([]byte{0x22}, 32)
+	compressed := append([]byte{0x02}, hash32...)
+	uncompressed := append([]byte{0x04}, bytes.Repeat([]byte{0x33}, 64)...)
+	tests := []struct {
+		name     string
+		script   []byte
+		class    Class
+		esplora  string
+		coreType string
+	}{
+		{"p2pkh", PayToPubKeyHash(hash20), P2PKH, "p2pkh", "pubkeyhash"},
+		{"p2sh", PayToScriptHash(hash20), P2SH, "p2sh", "scripthash"},
+		{"p2pk compressed", PayToPubKey(compressed), P2PK, "p2pk", "pubkey"},
+		{"p2pk uncompressed", PayToPubKey(uncompressed), P2PK, "p2pk", "pubkey"},
+		{"p2wpkh", PayToWitness(0, hash20), P2WPKH, "v0_p2wpkh", "witness_v0_keyhash"},
+		{"p2wsh", PayToWitness(0, hash32), P2WSH, "v0_p2wsh", "witness_v0_scripthash"},
+		{"p2tr", PayToWitness(1, hash32), P2TR, "v1_p2tr", "witness_v1_taproot"},
+		{"anchor", PayToWitness(1, []byte{0x4e, 0x73}), Anchor, "unknown", "anchor"},
+		{"future witness version", PayToWitness(2, hash32), WitnessUnknown, "unknown", "witness_unknown"},
+		{"v0 of another length", PayToWitness(0, hash32[:25]), Unknown, "unknown", "nonstandard"},
+		{"op_return", []byte{OP_RETURN, 0x01, 0xff}, OpReturn, "op_return", "nulldata"},
+		{"bare multisig", mustHex(t, "5121"+hex.EncodeToString(compressed)+"51ae"), Multisig, "multisig", "multisig"},
+		{"multisig with a short key", mustHex(t, "5102111151ae"), Unknown, "unknown", "nonstandard"},
+		{"p2pkh one byte short", PayToPubKeyHash(hash20[:19]), Unknown, "unknown", "nonstandard"},
+		{"p2pk with a bad prefix", PayToPubKey(append([]byte{0x05}, hash32...)), Unknown, "unknown", "nonstandard"},
+		{"empty", nil, Unknown, "unknown", "nonstandard"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			class := Classify(test.script)
+			if class != test.class {
+				t.Fatalf("%x is %s, want %s", test.script, class, test.class)
+			}
+			if got := ClassifyHex(hex.EncodeToString(test.script)); got != class {
+				t.Errorf("ClassifyHex gives %s, Classify %s", got, class)
+			}
+			if got := class.EsploraType(); got != test.esplora {
+				t.Errorf("esplora type %s, want %s", got, test.esplora)
+			}
+			if got := class.CoreType(); got != test.coreType {
+				t.Errorf("core type %s, want %s", got, test.coreType)
+			}
+			if !MatchesDeclaredType(test.esplora, class) {
+				t.Errorf("esplora's own type %s doesn't match", test.esplora)
+			}
+		})
+	}
+	if ClassifyHex("zz") != Unknown {
+		t.Error("bad hex isn't unknown")
+	}
+}
+
+func TestMatchesDeclaredType(t *testing.T) {
+	tests := []struct {
+		declared string
+		class    Class
+		matches  bool
+	}{
+		{"v0_p2wpkh", P2WPKH, true},
+		{"p2pkh", P2WPKH, false},
+		{"unknown", P2WPKH, false},
+		{"multisig", Multisig, true},
+		{"unknown", Multisig, true}, // older esplora
+		{"unknown", Anchor, true},
+		{"anchor", Anchor, true},
+		{"unknown", WitnessUnknown, true},
+		{"v1_p2tr", WitnessUnknown, false},
+		{"", P2TR, false},
+	}
+	for _, test := range tests {
+		if got := MatchesDeclaredType(test.declared, test.class); got != test.matches {
+			t.Errorf("MatchesDeclaredType(%q, %s) = %v", test.declared, test.class, got)
+		}
+	}
+}
+
+func TestCountSigOps(t *testing.T) {
+	key := "21" + "02" + strings.Repeat("11", 32)
+	tests := []struct {
+		script   string
+		accurate int
+		legacy   int
+	}{
+		{"76a914" + strings.Repeat("11", 20) + "88ac", 1, 1},
+		{"52" + key + key + key + "53ae", 3, 20},
+		{"ad", 1, 1},
+		{"ae", 20, 20},
+		{"00ac02ab", 1, 1}, // counts what parsed before the truncated push
+	}
+	for _, test := range tests {
+		script := mustHex(t, test.script)
+		if got := CountSigOps(script, true); got != test.accurate {
+			t.Errorf("%s: %d accurate sigops, want %d", test.script, got, test.accurate)
+		}
+		if got := CountSigOps(script, false); got != test.legacy {
+			t.Errorf("%s: %d sigops, want %d", test.script, got, test.legacy)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,24 @@
+package script
+
+// CountSigOps counts the signature operations in a script the way the consensus sigop limit does. when accurate is
+// set, a CHECKMULTISIG directly preceded by OP_PUSHNUM_n counts as n sigops, otherwise it always counts as 20
+func CountSigOps(script []byte, accurate bool) int {
+	// like bitcoin core, count whatever parsed before any error
+	instructions, _ := Parse(script)
+	count := 0
+	lastOpcode := byte(0xff)
+	for _, ins := range instructions {
+		switch ins.Opcode {
+		case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+			count++
+		case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+			if accurate && lastOpcode >= OP_PUSHNUM_1 && lastOpcode <= OP_PUSHNUM_16 {
+				count += SmallInt(lastOpcode)
+			} else {
+				count += 20
+			}
+		}
+		lastOpcode = ins.Opcode
+	}
+	return count
+}
@@ -0,0 +1,31 @@
+package script
+
+// PayToPubKeyHash builds a p2pkh scriptpubkey for a 20 byte pubkey hash
+func PayToPubKeyHash(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160, OP_PUSHBYTES_20}
+	script = append(script, pubKeyHash...)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// PayToScriptHash builds a p2sh scriptpubkey for a 20 byte script hash
+func PayToScriptHash(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160, OP_PUSHBYTES_20}
+	script = append(script, scriptHash...)
+	return append(script, OP_EQUAL)
+}
+
+// PayToPubKey builds a p2pk scriptpubkey for a serialized (33 or 65 byte) pubkey
+func PayToPubKey(pubKey []byte) []byte {
+	script := append([]byte{byte(len(pubKey))}, pubKey...)
+	return append(script, OP_CHECKSIG)
+}
+
+// PayToWitness builds a segwit scriptpubkey: the version opcode followed by a push of the witness program
+func PayToWitness(version int, program []byte) []byte {
+	versionOpcode := byte(OP_0)
+	if version > 0 {
+		versionOpcode = byte(OP_PUSHNUM_1 + version - 1)
+	}
+	script := []byte{versionOpcode, byte(len(program))}
+	return append(script, program...)
+}
@@ -0,0 +1,117 @@
+package types
+
+// GetBlockResult is a block in the same shape as bitcoin core's getblock at verbosity 2
+type GetBlockResult struct {
+	Hash              string       `json:"hash"`
+	Confirmations     int          `json:"confirmations"`
+	Size              int          `json:"size"`
+	StrippedSize      int          `json:"strippedsize"`
+	Weight            int          `json:"weight"`
+	Height            int          `json:"height"`
+	Version           int32        `json:"version"`
+	VersionHex        string       `json:"versionHex"`
+	MerkleRoot        string       `json:"merkleroot"`
+	Tx                []GetBlockTx `json:"tx"`
+	Time              int64        `json:"time"`
+	Nonce             uint32       `json:"nonce"`
+	Bits              string       `json:"bits"`
+	Difficulty        float64      `json:"difficulty"`
+	NTx               int          `json:"nTx"`
+	PreviousBlockHash string       `json:"previousblockhash"`
+}
+
+type GetBlockTx struct {
+	TxID     string         `json:"txid"`
+	Hash     string         `json:"hash"`
+	Version  int32          `json:"version"`
+	Size     int            `json:"size"`
+	VSize    int            `json:"vsize"`
+	Weight   int            `json:"weight"`
+	Locktime uint32         `json:"locktime"`
+	Vin      []GetBlockVin  `json:"vin"`
+	Vout     []GetBlockVout `json:"vout"`
+	Fee      *float64       `json:"fee,omitempty"` // in BTC, left out for the coinbase
+	Hex      string         `json:"hex"`
+}
+
+type GetBlockVin struct {
+	Coinbase    string             `json:"coinbase,omitempty"`
+	TxID        string             `json:"txid,omitempty"`
+	Vout        *uint32            `json:"vout,omitempty"`
+	ScriptSig   *GetBlockScriptSig `json:"scriptSig,omitempty"`
+	TxInWitness []string           `json:"txinwitness,omitempty"`
+	Sequence    uint32             `json:"sequence"`
+}
+
+type GetBlockScriptSig struct {
+	Asm string `json:"asm"`
+	Hex string `json:"hex"`
+}
+
+type GetBlockVout struct {
+	Value        float64              `json:"value"` // in BTC
+	N            int                  `json:"n"`
+	ScriptPubKey GetBlockScriptPubKey `json:"scriptPubKey"`
+}
+
+type GetBlockScriptPubKey struct {
+	Asm     string `json:"asm"`
+	Hex     string `json:"hex"`
+	Address string `json:"address,omitempty"`
+	Type    string `json:"type"`
+}
+
+// BlockSummary is the short report written next to a mined block
+type BlockSummary struct {
+	Hash          string `json:"hash"`
+	Height        int    `json:"height"`
+	TxCount       int    `json:"tx_count"`
+	Fees          int    `json:"fees"`
+	CoinbaseValue int    `json:"coinbase_value"`
+	Size          int    `json:"size"`
+	StrippedSize  int    `json:"stripped_size"`
+	Weight        int    `json:"weight"`
+	VSize         int    `json:"vsize"`
+	SigOpCost     int    `json:"sigop_cost"`
+}
+
+// TxProof is what the prove command prints for a transaction: its merkle branch, and the merkleblock (the same
+// serialization gettxoutproof returns) proving it's in the block
+type TxProof struct {
+	TxID        string   `json:"txid"`
+	BlockHash   string   `json:"blockhash"`
+	Index       int      `json:"index"`
+	MerkleRoot  string   `json:"merkleroot"`
+	MerkleProof []string `json:"merkle_branch"`
+	Proof       string   `json:"proof"`
+}
+
+// BlockFilter is a block's BIP158 filter as the filter command prints it, getblockfilter's result plus the filter's
+// size and, if asked, which scripts it matches
+type BlockFilter struct {
+	BlockHash  string          `json:"blockhash"`
+	FilterType string          `json:"filtertype"`
+	Filter     string          `json:"filter"`
+	Header     string          `json:"header"`
+	N          uint32          `json:"n"`
+	Matches    map[string]bool `json:"matches,omitempty"`
+}
+
+// CompactRelayReport is what the compact command prints: how a block relays as a BIP152 compact block to a peer
+// whose mempool is ours
+type CompactRelayReport struct {
+	BlockHash         string  `json:"blockhash"`
+	TxCount           int     `json:"tx_count"`
+	BlockSize         int     `json:"block_size"`
+	CompactBlockSize  int     `json:"cmpctblock_size"`
+	Prefilled         int     `json:"prefilled"`
+	FromMempool       int     `json:"from_mempool"`
+	Collisions        int     `json:"shortid_collisions"`
+	Missing           int     `json:"missing"`
+	GetBlockTxnSize   int     `json:"getblocktxn_size"`
+	BlockTxnSize      int     `json:"blocktxn_size"`
+	RelayBytes        int     `json:"relay_bytes"`
+	SavedPercent      float64 `json:"saved_percent"`
+	Reconstructed     bool    `json:"reconstructed"`
+	ReconstructionErr string  `json:"reconstruction_error,omitempty"`
+}
@@ -0,0 +1,77 @@
+package types
+
+// BlockTemplate is a block template in the shape getblocktemplate returns it (BIP22/23)
+type BlockTemplate struct {
+	Capabilities             []string          `json:"capabilities"`
+	Version                  int32             `json:"version"`
+	Rules                    []string          `json:"rules"`
+	VbAvailable              map[string]int    `json:"vbavailable"`
+	VbRequired               int               `json:"vbrequired"`
+	PreviousBlockHash        string            `json:"previousblockhash"`
+	Transactions             []BlockTemplateTx `json:"transactions"`
+	CoinbaseValue            int               `json:"coinbasevalue"`
+	LongPollID               string            `json:"longpollid,omitempty"`
+	Target                   string            `json:"target"`
+	MinTime                  int64             `json:"mintime"`
+	Mutable                  []string          `json:"mutable"`
+	NonceRange               string            `json:"noncerange"`
+	SigOpLimit               int               `json:"sigoplimit"`
+	SizeLimit                int               `json:"sizelimit"`
+	WeightLimit              int               `json:"weightlimit"`
+	CurTime                  int64             `json:"curtime"`
+	Bits                     string            `json:"bits"`
+	Height                   int               `json:"height"`
+	DefaultWitnessCommitment string            `json:"default_witness_commitment,omitempty"`
+	// Replaced isn't part of getblocktemplate, it lists the mempool transactions conflicting ones replaced
+	Replaced []Replacement `json:"replaced,omitempty"`
+}
+
+// BlockTemplateTx is a transaction entry in a BlockTemplate
+type BlockTemplateTx struct {
+	Data    string `json:"data"`
+	TxID    string `json:"txid"`
+	Hash    string `json:"hash"` // the wtxid
+	Depends []int  `json:"depends"`
+	Fee     int    `json:"fee"`
+	SigOps  int    `json:"sigops"`
+	Weight  int    `json:"weight"`
+}
+
+// Replacement is a mempool transaction that was replaced by a conflicting one paying more
+type Replacement struct {
+	TxID       string `json:"txid"`
+	ReplacedBy string `json:"replaced_by"`
+	Fee        int    `json:"fee"` // what the replaced transaction paid
+}
+
+// MempoolEntry is a mempool transaction with its unconfirmed ancestors and descendants, in the shape getmempoolentry
+// returns it. the ancestor and descendant aggregates count the transaction itself, sizes are in vbytes
+type MempoolEntry struct {
+	TxID              string   `json:"txid"`
+	WTxID             string   `json:"wtxid"`
+	VSize             int      `json:"vsize"`
+	Fee               int      `json:"fee"`
+	AncestorCount     int      `json:"ancestorcount"`
+	AncestorSize      int      `json:"ancestorsize"`
+	AncestorFees      int      `json:"ancestorfees"`
+	DescendantCount   int      `json:"descendantcount"`
+	DescendantSize    int      `json:"descendantsize"`
+	DescendantFees    int      `json:"descendantfees"`
+	Depends           []string `json:"depends"`
+	SpentBy           []string `json:"spentby"`
+	BIP125Replaceable bool     `json:"bip125-replaceable"`
+}
+
+// MempoolStats is the report the stats command prints about a mempool
+type MempoolStats struct {
+	TxCount            int                `json:"tx_count"`
+	ValidCount         int                `json:"valid_count"`
+	InvalidCount       int                `json:"invalid_count"`
+	UnsupportedCount   int                `json:"unsupported_count"`
+	InputTypes         map[string]int     `json:"input_types"`
+	TotalFees          int                `json:"total_fees"`
+	TotalWeight        int                `json:"total_weight"`
+	ValidFees          int                `json:"valid_fees"`
+	ValidWeight        int                `json:"valid_weight"`
+	FeeRatePercentiles map[string]float64 `json:"feerate_percentiles"` // sat/vB over the valid txs
+}
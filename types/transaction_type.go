@@ -6,27 +6,62 @@ type TransactionVin struct {
 	Prevout            TransactionVout `json:"prevout"`
 	ScriptSig          string          `json:"scriptsig"`
 	ScriptSigAsm       string          `json:"scriptsig_asm"`
-	Witness            []string        `json:"witness"`
+	Witness            []string        `json:"witness,omitempty"`
 	IsCoinbase         bool            `json:"is_coinbase"`
 	Sequence           int             `json:"sequence"`
-	InnerRedeemScript  string          `json:"inner_redeemscript_asm"`
-	InnerWitnessScript string          `json:"inner_witnessscript_asm"`
+	InnerRedeemScript  string          `json:"inner_redeemscript_asm,omitempty"`
+	InnerWitnessScript string          `json:"inner_witnessscript_asm,omitempty"`
 }
 
 type TransactionVout struct {
 	ScriptPubKey        string `json:"scriptpubkey"`
 	ScriptPubKeyAsm     string `json:"scriptpubkey_asm"`
 	ScriptPubKeyType    string `json:"scriptpubkey_type"`
-	ScriptPubKeyAddress string `json:"scriptpubkey_address"`
+	ScriptPubKeyAddress string `json:"scriptpubkey_address,omitempty"`
 	Value               int    `json:"value"`
 }
 
 type TransactionData struct {
-	TxFilename string            `json:"tx_filename"`
-	Version    int               `json:"version"`
-	Locktime   int               `json:"locktime"`
-	Vin        []TransactionVin  `json:"vin"`
-	Vout       []TransactionVout `json:"vout"`
+	TxFilename   string            `json:"tx_filename"`
+	TxID         string            `json:"txid,omitempty"`  // computed from the serialized tx when it's loaded
+	WTxID        string            `json:"wtxid,omitempty"` // computed from the serialized tx (with witness) when it's loaded
+	DeclaredTxID string            `json:"-"`               // the txid the json itself carried, if any
+	Version      int               `json:"version"`
+	Locktime     int               `json:"locktime"`
+	Vin          []TransactionVin  `json:"vin"`
+	Vout         []TransactionVout `json:"vout"`
+}
+
+// EsploraTx is a transaction in the full esplora api format, i.e the mempool json format plus the fields esplora
+// computes (txid, size, weight, fee and status)
+type EsploraTx struct {
+	TxID     string            `json:"txid"`
+	Version  int               `json:"version"`
+	Locktime int               `json:"locktime"`
+	Vin      []EsploraVin      `json:"vin"`
+	Vout     []TransactionVout `json:"vout"`
+	Size     int               `json:"size"`
+	Weight   int               `json:"weight"`
+	Fee      int               `json:"fee"`
+	Status   EsploraTxStatus   `json:"status"`
+}
+
+// EsploraVin is TransactionVin as esplora serializes it, where a coinbase input has a null prevout
+type EsploraVin struct {
+	TxID               string           `json:"txid"`
+	Vout               int              `json:"vout"`
+	Prevout            *TransactionVout `json:"prevout"`
+	ScriptSig          string           `json:"scriptsig"`
+	ScriptSigAsm       string           `json:"scriptsig_asm"`
+	Witness            []string         `json:"witness,omitempty"`
+	IsCoinbase         bool             `json:"is_coinbase"`
+	Sequence           int              `json:"sequence"`
+	InnerRedeemScript  string           `json:"inner_redeemscript_asm,omitempty"`
+	InnerWitnessScript string           `json:"inner_witnessscript_asm,omitempty"`
+}
+
+type EsploraTxStatus struct {
+	Confirmed bool `json:"confirmed"`
 }
 
 type UTXOSetEntry struct {